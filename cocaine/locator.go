@@ -1,20 +1,43 @@
 package cocaine
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ugorji/go/codec"
 )
 
+// the limit of Resolve and ResolveCancelable
+const resolveTimeout = 5 * time.Second
+
+var (
+	// Resolve replies are decoded leniently: unknown fields are skipped
+	// and missing ones are left zero, so upgrades of cocaine-runtime
+	// don't break the resolving
+	mhResolve = codec.MsgpackHandle{
+		BasicHandle: codec.BasicHandle{
+			DecodeOptions: codec.DecodeOptions{
+				ErrorIfNoField: false,
+			},
+		},
+	}
+	hResolve = &mhResolve
+)
+
 type Endpoint struct {
 	Host string
 	Port int
 }
 
+// AsString returns the address to dial. IPv6 hosts are enclosed
+// in square brackets like "[::1]:10053"
 func (endpoint *Endpoint) AsString() string {
-	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
 }
 
 type ResolveResult struct {
@@ -22,6 +45,35 @@ type ResolveResult struct {
 	Endpoint `codec:",omitempty"`
 	Version  int
 	API      map[int64]string
+	// Graph describes protocols of service methods.
+	// It is nil if cocaine-runtime doesn't send it
+	Graph DispatchGraph `codec:",omitempty"`
+}
+
+// DispatchGraph maps method numbers to their protocols
+type DispatchGraph map[int64]GraphMethod
+
+// GraphMethod describes a service method and protocols of its streams.
+// nil stream means that the protocol is recursive
+type GraphMethod struct {
+	Name       string
+	Downstream *StreamGraph
+	Upstream   *StreamGraph
+}
+
+// StreamGraph maps message types to their descriptions
+type StreamGraph map[int64]*StreamGraphItem
+
+// StreamGraphItem describes a message type of a stream
+// and the protocol which follows it
+type StreamGraphItem struct {
+	Name        string
+	Description *StreamGraph
+}
+
+// OK reports whether the service has been resolved successfully
+func (r *ResolveResult) OK() bool {
+	return r.success
 }
 
 func (r *ResolveResult) getMethodNumber(name string) (number int64, err error) {
@@ -39,59 +91,363 @@ type Locator struct {
 	unpacker *streamUnpacker
 	socketIO
 	logger LocalLogger
+	// nil means every Resolve asks the locator
+	cache *resolveCache
+
+	// the locators to fail over to,
+	// socketIO is connected to endpoints[current]
+	endpoints []string
+	current   int
+	dial      func(endpoint string) (socketIO, error)
+	// guards socketIO and unpacker, which are replaced on a failover
+	mu     sync.Mutex
+	closed bool
+	// set if a request has been abandoned waiting for the reply,
+	// which must not be taken as an answer to the next request
+	stale bool
+	// serializes replacements of the connection,
+	// so concurrent callers replace it once
+	reconnectMu sync.Mutex
 }
 
+// LocatorOption configures a Locator. It is passed to NewLocator
+// along with the endpoint
+type LocatorOption func(*Locator)
+
+// WithResolveCache makes the locator keep successful results of Resolve
+// for ttl, so repeated calls for the same service don't reach the network.
+// Use Locator.Invalidate to drop a result, which has turned out to be stale.
+func WithResolveCache(ttl time.Duration) LocatorOption {
+	return func(locator *Locator) {
+		locator.cache = newResolveCache(ttl)
+	}
+}
+
+// NewLocator connects to the locator. Optional args are endpoints
+// of locators as strings or []string (default is the -locator flag)
+// and LocatorOption values. Endpoints are dialed in order until
+// a connection succeeds. If the connection drops during Resolve,
+// the locator reconnects to the next endpoint and asks it again.
 func NewLocator(logger LocalLogger, args ...interface{}) (*Locator, error) {
-	endpoint := flagLocator
+	parseFlags()
 
-	if len(args) == 1 {
-		if _endpoint, ok := args[0].(string); ok {
-			endpoint = _endpoint
+	var (
+		endpoints []string
+		opts      []LocatorOption
+	)
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			endpoints = append(endpoints, arg)
+		case []string:
+			endpoints = append(endpoints, arg...)
+		case LocatorOption:
+			opts = append(opts, arg)
 		}
 	}
 
-	sock, err := newAsyncRWSocket("tcp", endpoint, time.Second*5, logger)
-	if err != nil {
+	if len(endpoints) == 0 {
+		endpoints = []string{flagLocator}
+	}
+
+	locator := &Locator{
+		logger:    logger,
+		endpoints: endpoints,
+		dial: func(endpoint string) (socketIO, error) {
+			return newAsyncRWSocket("tcp", endpoint, time.Second*5, logger)
+		},
+	}
+	for _, opt := range opts {
+		opt(locator)
+	}
+
+	if err := locator.connect(0); err != nil {
 		return nil, err
 	}
-	return &Locator{newStreamUnpacker(), sock, logger}, nil
+	return locator, nil
+}
+
+// connect dials endpoints in order starting from the given one
+// and wrapping around. It fails once every endpoint has failed
+func (locator *Locator) connect(from int) error {
+	var err error
+	for i := 0; i < len(locator.endpoints); i++ {
+		current := (from + i) % len(locator.endpoints)
+
+		var sock socketIO
+		if sock, err = locator.dial(locator.endpoints[current]); err != nil {
+			locator.logger.Warnf("unable to connect to the locator %s: %v",
+				locator.endpoints[current], err)
+			continue
+		}
+
+		locator.mu.Lock()
+		if locator.closed {
+			locator.mu.Unlock()
+			sock.Close()
+			return errors.New("the locator is closed")
+		}
+		locator.socketIO = sock
+		locator.unpacker = newStreamUnpacker()
+		locator.current = current
+		locator.stale = false
+		locator.mu.Unlock()
+		return nil
+	}
+
+	if len(locator.endpoints) > 1 {
+		return fmt.Errorf("unable to connect to any of locators %v: %v", locator.endpoints, err)
+	}
+	return err
+}
+
+// reconnect replaces the connection sock by a new one starting
+// from the endpoint at the offset from the current one.
+// It does nothing if sock has been already replaced by another caller
+func (locator *Locator) reconnect(sock socketIO, offset int) error {
+	locator.reconnectMu.Lock()
+	defer locator.reconnectMu.Unlock()
+
+	locator.mu.Lock()
+	if locator.socketIO != sock {
+		locator.mu.Unlock()
+		return nil
+	}
+	locator.socketIO.Close()
+	from := locator.current + offset
+	locator.mu.Unlock()
+
+	return locator.connect(from)
+}
+
+// failover replaces the dropped connection sock by one to the next endpoint
+func (locator *Locator) failover(sock socketIO) error {
+	return locator.reconnect(sock, 1)
+}
+
+// abandon marks the connection as stale,
+// as the reply to a pending request may still arrive
+func (locator *Locator) abandon(sock socketIO) {
+	locator.mu.Lock()
+	if locator.socketIO == sock {
+		locator.stale = true
+	}
+	locator.mu.Unlock()
+}
+
+// staleConn returns the connection and whether it is stale
+func (locator *Locator) staleConn() (socketIO, bool) {
+	locator.mu.Lock()
+	defer locator.mu.Unlock()
+	return locator.socketIO, locator.stale
+}
+
+func (locator *Locator) getConn() (socketIO, *streamUnpacker) {
+	locator.mu.Lock()
+	defer locator.mu.Unlock()
+	return locator.socketIO, locator.unpacker
+}
+
+func (locator *Locator) isClosed() bool {
+	locator.mu.Lock()
+	defer locator.mu.Unlock()
+	return locator.closed
 }
 
 func (locator *Locator) unpackchunk(chunk rawMessage) ResolveResult {
 	var res ResolveResult
-	err := codec.NewDecoderBytes(chunk, h).Decode(&res)
+	err := codec.NewDecoderBytes(chunk, hResolve).Decode(&res)
 	if err != nil {
 		locator.logger.Errf("unpack chunk error: %v", err)
 	}
 	return res
 }
 
+// Resolve resolves the service in background. The channel receives
+// the result, which is not OK if the service is unknown, every locator
+// has failed or no reply has arrived within 5 seconds.
 func (locator *Locator) Resolve(name string) chan ResolveResult {
-	Out := make(chan ResolveResult)
+	Out := make(chan ResolveResult, 1)
 	go func() {
-		var resolveresult ResolveResult
-		resolveresult.success = false
-		msg := ServiceMethod{messageInfo{0, 0}, []interface{}{name}}
-		locator.socketIO.Write() <- packMsg(&msg)
-		closed := false
-		for !closed {
-			answer := <-locator.socketIO.Read()
-			msgs := locator.unpacker.Feed(answer, locator.logger)
-			for _, item := range msgs {
-				switch id := item.getTypeID(); id {
-				case CHUNK:
-					resolveresult = locator.unpackchunk(item.getPayload()[0].([]byte))
-					resolveresult.success = true
-				case CHOKE:
-					closed = true
-				}
-			}
-		}
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		resolveresult, _ := locator.ResolveContext(ctx, name)
 		Out <- resolveresult
 	}()
 	return Out
 }
 
+// ResolveContext resolves the service and returns once the locator
+// has replied or ctx is done. In the latter case ctx.Err() is returned
+// and the connection is replaced before the next request, so
+// the late reply is dropped. The result is not OK if the service
+// is unknown or every locator has failed.
+func (locator *Locator) ResolveContext(ctx context.Context, name string) (ResolveResult, error) {
+	return locator.resolve(ctx, name)
+}
+
+// ResolveCancelable works like Resolve, but allows to stop resolving
+// by calling the returned function. The channel receives at most one result
+// and is closed when resolving is done, cancelled or has timed out.
+func (locator *Locator) ResolveCancelable(name string) (<-chan ResolveResult, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	Out := make(chan ResolveResult, 1)
+	go func() {
+		defer close(Out)
+		if resolveresult, err := locator.resolve(ctx, name); err == nil {
+			Out <- resolveresult
+		}
+	}()
+	return Out, cancel
+}
+
+// Invalidate drops the cached result of the service, e.g. after
+// a failed connection to its endpoint, so the next Resolve asks
+// the locator again. It does nothing if the cache is disabled.
+func (locator *Locator) Invalidate(name string) {
+	if locator.cache != nil {
+		locator.cache.remove(name)
+	}
+}
+
+func (locator *Locator) resolve(ctx context.Context, name string) (ResolveResult, error) {
+	if locator.cache != nil {
+		if resolveresult, ok := locator.cache.get(name); ok {
+			return resolveresult, nil
+		}
+	}
+
+	resolveresult, err := locator.resolveRemote(ctx, name)
+	if err == nil && resolveresult.success && locator.cache != nil {
+		locator.cache.put(name, resolveresult)
+	}
+	return resolveresult, err
+}
+
+// resolveRemote asks locators one by one until a connection survives
+// the request. An unsuccessful result means every locator has failed
+func (locator *Locator) resolveRemote(ctx context.Context, name string) (ResolveResult, error) {
+	if sock, stale := locator.staleConn(); stale {
+		if err := locator.reconnect(sock, 0); err != nil {
+			return ResolveResult{}, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		sock, unpacker := locator.getConn()
+		resolveresult, lost, err := locator.resolveOnce(ctx, sock, unpacker, name)
+		if !lost || attempt >= len(locator.endpoints) || locator.isClosed() {
+			return resolveresult, err
+		}
+
+		locator.logger.Warnf("the connection to a locator is lost during resolving %s", name)
+		// the connection is replaced once, so concurrent
+		// requests are retried over the new one
+		if err := locator.failover(sock); err != nil {
+			locator.logger.Errf("unable to fail over: %v", err)
+			return resolveresult, nil
+		}
+	}
+}
+
+// resolveOnce sends a request over sock and reads the reply.
+// lost reports whether the connection has dropped
+func (locator *Locator) resolveOnce(ctx context.Context, sock socketIO, unpacker *streamUnpacker, name string) (resolveresult ResolveResult, lost bool, err error) {
+	resolveresult.success = false
+	msg := NewServiceMethod(0, 0, name)
+	select {
+	case sock.Write() <- packMsg(msg):
+	case <-sock.IsClosed():
+		return resolveresult, true, nil
+	case <-ctx.Done():
+		return resolveresult, false, ctx.Err()
+	}
+
+	closed := false
+	for !closed {
+		var (
+			answer rawMessage
+			ok     bool
+		)
+		select {
+		case answer, ok = <-sock.Read():
+			if !ok {
+				// the connection is lost
+				return resolveresult, true, nil
+			}
+		case <-ctx.Done():
+			locator.abandon(sock)
+			return resolveresult, false, ctx.Err()
+		}
+
+		msgs := unpacker.Feed(answer, locator.logger)
+		for _, item := range msgs {
+			switch id := item.getTypeID(); id {
+			case CHUNK:
+				resolveresult = locator.unpackchunk(item.getPayload()[0].([]byte))
+				resolveresult.success = true
+			case CHOKE:
+				closed = true
+			}
+		}
+	}
+	return resolveresult, false, nil
+}
+
 func (locator *Locator) Close() {
+	locator.mu.Lock()
+	defer locator.mu.Unlock()
+	locator.closed = true
 	locator.socketIO.Close()
 }
+
+// resolveCache keeps successful results of Resolve for ttl
+type resolveCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedResolve
+}
+
+type cachedResolve struct {
+	result  ResolveResult
+	expires time.Time
+}
+
+func newResolveCache(ttl time.Duration) *resolveCache {
+	return &resolveCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedResolve),
+	}
+}
+
+func (c *resolveCache) get(name string) (ResolveResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		return ResolveResult{}, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(c.entries, name)
+		return ResolveResult{}, false
+	}
+	return entry.result, true
+}
+
+func (c *resolveCache) put(name string, result ResolveResult) {
+	c.mu.Lock()
+	c.entries[name] = cachedResolve{
+		result:  result,
+		expires: time.Now().Add(c.ttl),
+	}
+	c.mu.Unlock()
+}
+
+func (c *resolveCache) remove(name string) {
+	c.mu.Lock()
+	delete(c.entries, name)
+	c.mu.Unlock()
+}
@@ -0,0 +1,388 @@
+package cocaine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+func packResolveReply(t *testing.T, reply []interface{}) rawMessage {
+	var buf []byte
+	assert.NoError(t, codec.NewEncoderBytes(&buf, h).Encode(reply))
+	return buf
+}
+
+func TestLocatorUnpackChunkGraph(t *testing.T) {
+	locator := &Locator{logger: &LocalLoggerImpl{}}
+	chunk := packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "resolve"},
+		map[int64]interface{}{
+			0: []interface{}{
+				"resolve",
+				map[int64]interface{}{
+					0: []interface{}{"value", map[int64]interface{}{}},
+					1: []interface{}{"error", map[int64]interface{}{}},
+				},
+				nil,
+			},
+		},
+	})
+
+	res := locator.unpackchunk(chunk)
+	assert.Equal(t, "localhost:10053", res.AsString())
+	assert.Equal(t, map[int64]string{0: "resolve"}, res.API)
+	if !assert.Len(t, res.Graph, 1) {
+		t.FailNow()
+	}
+
+	method := res.Graph[0]
+	assert.Equal(t, "resolve", method.Name)
+	assert.Nil(t, method.Upstream)
+	if assert.NotNil(t, method.Downstream) {
+		assert.Equal(t, "value", (*method.Downstream)[0].Name)
+		assert.Equal(t, "error", (*method.Downstream)[1].Name)
+	}
+}
+
+func TestLocatorUnpackChunkNoGraph(t *testing.T) {
+	locator := &Locator{logger: &LocalLoggerImpl{}}
+	chunk := packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "resolve"},
+	})
+
+	res := locator.unpackchunk(chunk)
+	assert.Equal(t, "localhost:10053", res.AsString())
+	assert.Nil(t, res.Graph)
+}
+
+type testSocket struct {
+	in, out chan rawMessage
+	closed  chan struct{}
+}
+
+func newTestSocket() *testSocket {
+	return &testSocket{
+		in:     make(chan rawMessage, 1),
+		out:    make(chan rawMessage),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *testSocket) Read() chan rawMessage     { return s.out }
+func (s *testSocket) Write() chan rawMessage    { return s.in }
+func (s *testSocket) IsClosed() <-chan struct{} { return s.closed }
+func (s *testSocket) Close()                    { close(s.closed) }
+
+func TestLocatorResolveCancelable(t *testing.T) {
+	sock := newTestSocket()
+	locator := &Locator{unpacker: newStreamUnpacker(), socketIO: sock, logger: &LocalLoggerImpl{}}
+
+	result, cancel := locator.ResolveCancelable("storage")
+	// the request has been sent, but there is no reply
+	<-sock.Write()
+	cancel()
+
+	select {
+	case _, ok := <-result:
+		assert.False(t, ok, "no result is expected after cancel")
+	case <-time.After(time.Second):
+		t.Fatal("the resolving goroutine has not exited")
+	}
+}
+
+func TestLocatorResolveOK(t *testing.T) {
+	sock := newTestSocket()
+	locator := &Locator{unpacker: newStreamUnpacker(), socketIO: sock, logger: &LocalLoggerImpl{}}
+
+	result := locator.Resolve("storage")
+	<-sock.Write()
+	reply := packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "write"},
+	})
+	sock.Read() <- packMsg(&chunk{messageInfo{CHUNK, 0}, reply})
+	sock.Read() <- packMsg(&choke{messageInfo{CHOKE, 0}})
+
+	res := <-result
+	assert.True(t, res.OK())
+	assert.Equal(t, "localhost:10053", res.AsString())
+
+	// no reply means the failure
+	result = locator.Resolve("unknown")
+	<-sock.Write()
+	sock.Read() <- packMsg(&choke{messageInfo{CHOKE, 0}})
+
+	res = <-result
+	assert.False(t, res.OK())
+}
+
+func TestLocatorResolveCache(t *testing.T) {
+	sock := newTestSocket()
+	locator := &Locator{unpacker: newStreamUnpacker(), socketIO: sock, logger: &LocalLoggerImpl{}}
+	WithResolveCache(time.Minute)(locator)
+
+	reply := packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "write"},
+	})
+	resolveRemote := func() ResolveResult {
+		result := locator.Resolve("storage")
+		<-sock.Write()
+		sock.Read() <- packMsg(&chunk{messageInfo{CHUNK, 0}, reply})
+		sock.Read() <- packMsg(&choke{messageInfo{CHOKE, 0}})
+		return <-result
+	}
+
+	res := resolveRemote()
+	assert.True(t, res.OK())
+
+	// the cached result is returned without a request
+	res = <-locator.Resolve("storage")
+	assert.True(t, res.OK())
+	assert.Equal(t, "localhost:10053", res.AsString())
+	assert.Len(t, sock.Write(), 0)
+
+	locator.Invalidate("storage")
+	res = resolveRemote()
+	assert.True(t, res.OK())
+
+	// failures are not cached
+	for i := 0; i < 2; i++ {
+		result := locator.Resolve("unknown")
+		<-sock.Write()
+		sock.Read() <- packMsg(&choke{messageInfo{CHOKE, 0}})
+		res = <-result
+		assert.False(t, res.OK())
+	}
+}
+
+func TestResolveCacheExpires(t *testing.T) {
+	cache := newResolveCache(time.Millisecond)
+	cache.put("storage", ResolveResult{success: true})
+
+	_, ok := cache.get("storage")
+	assert.True(t, ok)
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok = cache.get("storage")
+	assert.False(t, ok)
+}
+
+func newFailoverTestLocator(t *testing.T, socks map[string]*testSocket, endpoints ...string) *Locator {
+	locator := &Locator{
+		logger:    &LocalLoggerImpl{},
+		endpoints: endpoints,
+		dial: func(endpoint string) (socketIO, error) {
+			if sock, ok := socks[endpoint]; ok {
+				return sock, nil
+			}
+			return nil, errors.New("connection refused")
+		},
+	}
+	assert.NoError(t, locator.connect(0))
+	return locator
+}
+
+func TestLocatorConnect(t *testing.T) {
+	sock := newTestSocket()
+	locator := newFailoverTestLocator(t, map[string]*testSocket{"b": sock}, "a", "b")
+	assert.Equal(t, 1, locator.current)
+	assert.Equal(t, socketIO(sock), locator.socketIO)
+
+	locator.endpoints = []string{"a", "c"}
+	assert.Error(t, locator.connect(0))
+}
+
+func TestLocatorResolveFailover(t *testing.T) {
+	socks := map[string]*testSocket{
+		"a": newTestSocket(),
+		"b": newTestSocket(),
+	}
+	locator := newFailoverTestLocator(t, socks, "a", "b")
+
+	result := locator.Resolve("storage")
+	<-socks["a"].Write()
+	// the connection drops before the reply
+	close(socks["a"].out)
+
+	// the request is sent to the next locator
+	<-socks["b"].Write()
+	reply := packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "write"},
+	})
+	socks["b"].Read() <- packMsg(&chunk{messageInfo{CHUNK, 0}, reply})
+	socks["b"].Read() <- packMsg(&choke{messageInfo{CHOKE, 0}})
+
+	res := <-result
+	assert.True(t, res.OK())
+	assert.Equal(t, "localhost:10053", res.AsString())
+	assert.Equal(t, 1, locator.current)
+}
+
+func TestLocatorConcurrentFailover(t *testing.T) {
+	socks := map[string]*testSocket{
+		"a": newTestSocket(),
+		"b": newTestSocket(),
+		"c": newTestSocket(),
+	}
+	locator := newFailoverTestLocator(t, socks, "a", "b", "c")
+
+	var (
+		mu    sync.Mutex
+		dials []string
+	)
+	dial := locator.dial
+	locator.dial = func(endpoint string) (socketIO, error) {
+		mu.Lock()
+		dials = append(dials, endpoint)
+		mu.Unlock()
+		return dial(endpoint)
+	}
+
+	first, second := locator.Resolve("storage"), locator.Resolve("storage")
+	<-socks["a"].Write()
+	<-socks["a"].Write()
+	// both requests are lost along with the connection
+	close(socks["a"].out)
+
+	// and retried over the same new connection
+	<-socks["b"].Write()
+	<-socks["b"].Write()
+	reply := append(packMsg(&chunk{messageInfo{CHUNK, 0}, packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "write"},
+	})}), packMsg(&choke{messageInfo{CHOKE, 0}})...)
+	for i := 0; i < 2; i++ {
+		socks["b"].Read() <- reply
+		select {
+		case res := <-first:
+			assert.True(t, res.OK())
+			first = nil
+		case res := <-second:
+			assert.True(t, res.OK())
+			second = nil
+		case <-time.After(time.Second):
+			t.Fatal("no result of Resolve")
+		}
+	}
+
+	assert.Equal(t, []string{"b"}, dials)
+	assert.Equal(t, 1, locator.current)
+}
+
+func TestLocatorResolveAllFailed(t *testing.T) {
+	socks := map[string]*testSocket{
+		"a": newTestSocket(),
+		"b": newTestSocket(),
+	}
+	locator := newFailoverTestLocator(t, socks, "a", "b")
+
+	result := locator.Resolve("storage")
+	<-socks["a"].Write()
+	close(socks["a"].out)
+	<-socks["b"].Write()
+	close(socks["b"].out)
+
+	select {
+	case res := <-result:
+		assert.False(t, res.OK())
+	case <-time.After(time.Second):
+		t.Fatal("Resolve hangs after every locator has failed")
+	}
+}
+
+func TestLocatorResolveContext(t *testing.T) {
+	socks := map[string]*testSocket{"a": newTestSocket()}
+	locator := newFailoverTestLocator(t, socks, "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the locator never replies
+	_, err := locator.ResolveContext(ctx, "storage")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	<-socks["a"].Write()
+
+	// the connection with the pending request is replaced
+	stale := socks["a"]
+	socks["a"] = newTestSocket()
+	result := locator.Resolve("storage")
+	<-socks["a"].Write()
+	reply := packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "write"},
+	})
+	socks["a"].Read() <- packMsg(&chunk{messageInfo{CHUNK, 0}, reply})
+	socks["a"].Read() <- packMsg(&choke{messageInfo{CHOKE, 0}})
+
+	res := <-result
+	assert.True(t, res.OK())
+	select {
+	case <-stale.IsClosed():
+	default:
+		t.Fatal("the stale connection has not been closed")
+	}
+}
+
+func TestEndpointAsString(t *testing.T) {
+	endpoints := map[string]Endpoint{
+		"127.0.0.1:10053":     {"127.0.0.1", 10053},
+		"localhost:10053":     {"localhost", 10053},
+		"[::1]:10053":         {"::1", 10053},
+		"[2001:db8::1]:10053": {"2001:db8::1", 10053},
+	}
+
+	for expected, endpoint := range endpoints {
+		assert.Equal(t, expected, endpoint.AsString())
+	}
+}
+
+func TestLocatorUnpackChunkVersionSkew(t *testing.T) {
+	locator := &Locator{logger: &LocalLoggerImpl{}}
+
+	// a newer runtime sends more fields
+	res := locator.unpackchunk(packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+		map[int64]string{0: "resolve"},
+		map[int64]interface{}{},
+		"unknown field",
+		[]interface{}{1, 2, 3},
+	}))
+	assert.Equal(t, "localhost:10053", res.AsString())
+	assert.Equal(t, 1, res.Version)
+	assert.Equal(t, map[int64]string{0: "resolve"}, res.API)
+
+	// an older runtime sends less fields
+	res = locator.unpackchunk(packResolveReply(t, []interface{}{
+		[]interface{}{"localhost", 10053},
+		1,
+	}))
+	assert.Equal(t, "localhost:10053", res.AsString())
+	assert.Equal(t, 1, res.Version)
+	assert.Nil(t, res.API)
+	assert.Nil(t, res.Graph)
+
+	// unknown keys of a map are skipped
+	var buf []byte
+	assert.NoError(t, codec.NewEncoderBytes(&buf, h).Encode(map[string]interface{}{
+		"Version": 2,
+		"Unknown": "field",
+	}))
+	res = locator.unpackchunk(buf)
+	assert.Equal(t, 2, res.Version)
+}
@@ -60,6 +60,8 @@ func createIO(name string, args ...interface{}) (sock socketWriter, verbosity in
 }
 
 func NewLoggerWithName(loggerName string, args ...interface{}) (logger *Logger, err error) {
+	// the name of the application is attached to messages
+	parseFlags()
 	sock, verbosity, err := createIO(loggerName, args...)
 	if err != nil {
 		return
@@ -115,8 +117,8 @@ func (logger *Logger) log(level int64, message ...interface{}) bool {
 				return false
 			}
 		default:
-			msg := ServiceMethod{messageInfo{0, 0}, []interface{}{level, fmt.Sprintf("app/%s", flagApp), fmt.Sprint(message...)}}
-			logger.Write() <- packMsg(&msg)
+			msg := NewServiceMethod(0, 0, level, fmt.Sprintf("app/%s", flagApp), fmt.Sprint(message...))
+			logger.Write() <- packMsg(msg)
 			return true
 		}
 	}
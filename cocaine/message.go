@@ -71,6 +71,12 @@ type ServiceMethod struct {
 	Data []interface{}
 }
 
+// NewServiceMethod builds a call of the method with the given id
+// in the session. args are passed to the method as is
+func NewServiceMethod(methodID, session int64, args ...interface{}) *ServiceMethod {
+	return &ServiceMethod{messageInfo{methodID, session}, args}
+}
+
 type messageInterface interface {
 	getTypeID() int64
 	getSessionID() int64
@@ -32,3 +32,10 @@ func TestMessageUnpackErrorMsg(t *testing.T) {
 	assert.Equal(t, errorCode, e.Code, "bad error code")
 	assert.Equal(t, errorMessage, e.Message, "bad error message")
 }
+
+func TestMessagePackServiceMethod(t *testing.T) {
+	msg := NewServiceMethod(0, 1, "storage")
+	// msgpack.packb([0, 1, ["storage"]])
+	expected := []byte{147, 0, 1, 145, 167, 115, 116, 111, 114, 97, 103, 101}
+	assert.Equal(t, rawMessage(expected), packMsg(msg))
+}
@@ -116,7 +116,7 @@ func NewServiceWithLocalLogger(name string, localLogger LocalLogger, args ...int
 		return
 	}
 
-	if !info.success {
+	if !info.OK() {
 		err = fmt.Errorf("Unable to resolve service %s", name)
 		return
 	}
@@ -236,8 +236,8 @@ func (service *Service) call(name string, args ...interface{}) chan ServiceResul
 	}
 	in, out := service.getServiceChanPair()
 	id := service.sessions.Attach(in)
-	msg := ServiceMethod{messageInfo{method, id}, args}
-	service.socketIO.Write() <- packMsg(&msg)
+	msg := NewServiceMethod(method, id, args...)
+	service.socketIO.Write() <- packMsg(msg)
 	return out
 }
 
@@ -1,11 +1,15 @@
 package cocaine
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -17,21 +21,31 @@ var (
 	flagEndpoint string
 	flagApp      string
 	flagLocator  string
-)
 
-func init() {
-	flagSet := flag.NewFlagSet("cocaine11", flag.ContinueOnError)
-	flagSet.SetOutput(ioutil.Discard)
+	flagsOnce sync.Once
+)
 
-	flagSet.StringVar(&flagUUID, "uuid", "", "UUID")
-	flagSet.StringVar(&flagEndpoint, "endpoint", "", "Connection path")
-	flagSet.StringVar(&flagApp, "app", "standalone", "Connection path")
-	flagSet.StringVar(&flagLocator, "locator", "localhost:10053", "Connection path")
-	flagSet.Parse(os.Args[1:])
+// parseFlags reads arguments passed by cocaine-runtime on the first use,
+// rather than on import. A dedicated FlagSet is used,
+// so flag.CommandLine of the application is not touched.
+func parseFlags() {
+	flagsOnce.Do(func() {
+		flagSet := flag.NewFlagSet("cocaine11", flag.ContinueOnError)
+		flagSet.SetOutput(ioutil.Discard)
+
+		flagSet.StringVar(&flagUUID, "uuid", "", "UUID")
+		flagSet.StringVar(&flagEndpoint, "endpoint", "", "Connection path")
+		flagSet.StringVar(&flagApp, "app", "standalone", "Connection path")
+		flagSet.StringVar(&flagLocator, "locator", "localhost:10053", "Connection path")
+		flagSet.Parse(os.Args[1:])
+	})
 }
 
 const (
 	HEARTBEAT_TIMEOUT = time.Second * 20
+
+	// the time handlers have to return after a terminate
+	terminateTimeout = time.Second * 5
 )
 
 type Request struct {
@@ -42,6 +56,14 @@ type Request struct {
 
 type EventHandler func(*Request, *Response)
 
+// ContextEventHandler works like EventHandler, but receives a context
+// which is cancelled when cocaine-runtime closes the session by a choke
+// or an error, terminates the worker or the worker is stopped by Worker.Stop.
+// Data sent before the choke is still delivered by Request.Read.
+// After a terminate handlers are given 5 seconds to return,
+// then the process exits.
+type ContextEventHandler func(context.Context, *Request, *Response)
+
 func newRequest() *Request {
 	request := Request{make(chan []byte), make(chan []byte), make(chan bool)}
 	go func() {
@@ -90,11 +112,27 @@ type Response struct {
 	from_handler chan []byte
 	to_worker    chan rawMessage
 	quit         chan bool
+	// closed once replies have been passed to the worker after Close
+	done chan struct{}
+	// set by Close
+	mu     sync.Mutex
+	closed bool
 }
 
+// ErrResponseClosed is returned by Response.WriteChecked
+// if the response has been closed
+var ErrResponseClosed = errors.New("the response has been closed")
+
 func newResponse(session int64, to_worker chan rawMessage) *Response {
-	response := Response{session, make(chan []byte), to_worker, make(chan bool)}
+	response := Response{
+		session:      session,
+		from_handler: make(chan []byte),
+		to_worker:    to_worker,
+		quit:         make(chan bool),
+		done:         make(chan struct{}),
+	}
 	go func() {
+		defer close(response.done)
 		var pending [][]byte
 		quit := false
 		for {
@@ -126,18 +164,69 @@ func newResponse(session int64, to_worker chan rawMessage) *Response {
 func (response *Response) Write(data interface{}) {
 	var res []byte
 	codec.NewEncoderBytes(&res, h).Encode(&data)
-	response.from_handler <- packMsg(&chunk{messageInfo{CHUNK, response.session}, res})
+	response.send(packMsg(&chunk{messageInfo{CHUNK, response.session}, res}))
+}
+
+// send passes msg to the worker. Replies are dropped
+// once the response has been closed and flushed
+func (response *Response) send(msg rawMessage) error {
+	select {
+	case response.from_handler <- msg:
+		return nil
+	case <-response.done:
+		return ErrResponseClosed
+	}
+}
+
+func (response *Response) isClosed() bool {
+	response.mu.Lock()
+	defer response.mu.Unlock()
+	return response.closed
+}
+
+// WriteChecked works like Write, but returns an error
+// if data can not be encoded or the response has been closed.
+func (response *Response) WriteChecked(data interface{}) error {
+	if response.isClosed() {
+		return ErrResponseClosed
+	}
+
+	var res []byte
+	if err := codec.NewEncoderBytes(&res, h).Encode(&data); err != nil {
+		return err
+	}
+	return response.send(packMsg(&chunk{messageInfo{CHUNK, response.session}, res}))
+}
+
+// WriteJSON sends v encoded as JSON to a client.
+// Unlike Write, it returns the encoding error,
+// so a handler is able to reply with ErrorMsg.
+func (response *Response) WriteJSON(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return response.send(packMsg(&chunk{messageInfo{CHUNK, response.session}, body}))
 }
 
 // Notify a client about finishing the datastream.
+// Subsequent calls do nothing.
 func (response *Response) Close() {
-	response.from_handler <- packMsg(&choke{messageInfo{CHOKE, response.session}})
+	response.mu.Lock()
+	if response.closed {
+		response.mu.Unlock()
+		return
+	}
+	response.closed = true
+	response.mu.Unlock()
+
+	response.send(packMsg(&choke{messageInfo{CHOKE, response.session}}))
 	response.quit <- true
 }
 
 // Send error to a client. Specify code and message, which describes this error.
 func (response *Response) ErrorMsg(code int, msg string) {
-	response.from_handler <- packMsg(&errorMsg{messageInfo{ERROR, response.session}, code, msg})
+	response.send(packMsg(&errorMsg{messageInfo{ERROR, response.session}, code, msg}))
 }
 
 type FallbackHandler func(string, *Request, *Response)
@@ -161,11 +250,33 @@ type Worker struct {
 
 	fallback       FallbackHandler
 	disown_timeout time.Duration
+
+	contextHandlers map[string]ContextEventHandler
+	// cancels contexts of aborted sessions. It is owned by Loop
+	cancels map[int64]context.CancelFunc
+	// the parent of contexts of all sessions
+	ctx    context.Context
+	cancel context.CancelFunc
+	// running handlers, which are waited for after a terminate
+	handlers sync.WaitGroup
+	// os.Exit, replaced by tests
+	exit func(int)
+
+	stopped  chan struct{}
+	stopOnce sync.Once
 }
 
 // Creates new instance of Worker. Returns error on fail.
 func NewWorkerWithLocalLogger(localLogger LocalLogger) (worker *Worker, err error) {
-	sock, err := newAsyncRWSocket("unix", flagEndpoint, time.Second*5, localLogger)
+	parseFlags()
+	return NewWorkerWithEndpoint(flagEndpoint, flagUUID, localLogger)
+}
+
+// NewWorkerWithEndpoint works like NewWorkerWithLocalLogger, but takes
+// the endpoint of cocaine-runtime and the UUID of the worker from arguments
+// instead of the command line, e.g. if the application parses flags itself.
+func NewWorkerWithEndpoint(endpoint, workerUUID string, localLogger LocalLogger) (worker *Worker, err error) {
+	sock, err := newAsyncRWSocket("unix", endpoint, time.Second*5, localLogger)
 	if err != nil {
 		return
 	}
@@ -175,11 +286,19 @@ func NewWorkerWithLocalLogger(localLogger LocalLogger) (worker *Worker, err erro
 		return
 	}
 
-	workerID, _ := uuid.FromString(flagUUID)
+	workerID, _ := uuid.FromString(workerUUID)
 
 	disown_timeout := 5 * time.Second
 
-	w := Worker{
+	worker = newWorker(sock, workerID, logger, disown_timeout)
+	worker.handshake()
+	worker.heartbeat()
+	return
+}
+
+func newWorker(sock socketIO, workerID uuid.UUID, logger *Logger, disown_timeout time.Duration) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Worker{
 		unpacker:        newStreamUnpacker(),
 		uuid:            workerID,
 		logger:          logger,
@@ -190,12 +309,15 @@ func NewWorkerWithLocalLogger(localLogger LocalLogger) (worker *Worker, err erro
 		socketIO:        sock,
 		fallback:        defaultFallbackHandler,
 		disown_timeout:  disown_timeout,
+		contextHandlers: make(map[string]ContextEventHandler),
+		cancels:         make(map[int64]context.CancelFunc),
+		ctx:             ctx,
+		cancel:          cancel,
+		exit:            os.Exit,
+		stopped:         make(chan struct{}),
 	}
 	w.disown_timer.Stop()
-	w.handshake()
-	w.heartbeat()
-	worker = &w
-	return
+	return w
 }
 
 func NewWorker() (worker *Worker, err error) {
@@ -206,8 +328,39 @@ func (worker *Worker) SetFallbackHandler(fallback FallbackHandler) {
 	worker.fallback = fallback
 }
 
+// OnContext binds ContextEventHandler to the event.
+// Handlers passed to Loop take precedence over ones bound by OnContext.
+// This function must be called before Loop.
+func (worker *Worker) OnContext(event string, handler ContextEventHandler) {
+	worker.contextHandlers[event] = handler
+}
+
+// Stop makes Loop return and cancels contexts of all sessions.
+// The worker can not be used after Stop.
+func (worker *Worker) Stop() {
+	worker.stopOnce.Do(func() {
+		close(worker.stopped)
+	})
+}
+
+func (worker *Worker) lookupHandler(bind map[string]EventHandler, event string) (ContextEventHandler, bool) {
+	if callback, ok := bind[event]; ok {
+		return func(ctx context.Context, req *Request, resp *Response) {
+			callback(req, resp)
+		}, true
+	}
+
+	callback, ok := worker.contextHandlers[event]
+	return callback, ok
+}
+
 // Initializes worker in runtime as starting. Launchs an eventloop.
+// It returns after Stop is called.
 func (worker *Worker) Loop(bind map[string]EventHandler) {
+	defer worker.Close()
+	// handlers must not outlive the worker
+	defer worker.cancel()
+
 	for {
 		select {
 		case answer := <-worker.Read():
@@ -222,6 +375,19 @@ func (worker *Worker) Loop(bind map[string]EventHandler) {
 					worker.logger.Debug("Receive choke")
 					worker.sessions[msg.getSessionID()].close()
 					delete(worker.sessions, msg.getSessionID())
+					// the client has gone
+					if cancel, ok := worker.cancels[msg.getSessionID()]; ok {
+						cancel()
+						delete(worker.cancels, msg.getSessionID())
+					}
+
+				case *errorMsg:
+					worker.logger.Debug(fmt.Sprintf("Receive error %d %s", msg.Code, msg.Message))
+					// the session is aborted by cocaine-runtime
+					if cancel, ok := worker.cancels[msg.getSessionID()]; ok {
+						cancel()
+						delete(worker.cancels, msg.getSessionID())
+					}
 
 				case *invoke:
 					worker.logger.Debug(fmt.Sprintf("Receive invoke %s %d", msg.Event, msg.getSessionID()))
@@ -229,8 +395,13 @@ func (worker *Worker) Loop(bind map[string]EventHandler) {
 					req := newRequest()
 					resp := newResponse(cur_session, worker.from_handlers)
 					worker.sessions[cur_session] = req
-					if callback, ok := bind[msg.Event]; ok {
+					if callback, ok := worker.lookupHandler(bind, msg.Event); ok {
+						ctx, cancel := context.WithCancel(worker.ctx)
+						worker.cancels[cur_session] = cancel
+						worker.handlers.Add(1)
 						go func() {
+							defer worker.handlers.Done()
+							defer cancel()
 							defer func() {
 								if r := recover(); r != nil {
 									errMsg := fmt.Sprintf("Error in event: '%s', exception: %s", msg.Event, r)
@@ -240,7 +411,7 @@ func (worker *Worker) Loop(bind map[string]EventHandler) {
 									resp.Close()
 								}
 							}()
-							callback(req, resp)
+							callback(ctx, req, resp)
 						}()
 					} else {
 						go func() {
@@ -259,7 +430,8 @@ func (worker *Worker) Loop(bind map[string]EventHandler) {
 
 				case *terminateStruct:
 					worker.logger.Info("Receive terminate")
-					os.Exit(0)
+					worker.terminate()
+					return
 
 				default:
 					worker.logger.Warn("Unknown message")
@@ -271,9 +443,41 @@ func (worker *Worker) Loop(bind map[string]EventHandler) {
 
 		case <-worker.disown_timer.C:
 			worker.logger.Info("Disowned")
-			os.Exit(0)
+			worker.exit(0)
+
+		case outcoming := <-worker.from_handlers:
+			worker.Write() <- outcoming
+
+		case <-worker.stopped:
+			return
+		}
+	}
+}
+
+// terminate cancels contexts of all sessions and gives handlers
+// terminateTimeout to return, then the process exits
+func (worker *Worker) terminate() {
+	worker.cancel()
+	worker.cancels = make(map[int64]context.CancelFunc)
 
+	done := make(chan struct{})
+	go func() {
+		worker.handlers.Wait()
+		close(done)
+	}()
+
+	timeout := time.After(terminateTimeout)
+	for {
+		select {
+		case <-done:
+			worker.exit(0)
+			return
+		case <-timeout:
+			worker.logger.Warn("Handlers have not returned after terminate")
+			worker.exit(0)
+			return
 		case outcoming := <-worker.from_handlers:
+			// replies of cancelled handlers
 			worker.Write() <- outcoming
 		}
 	}
@@ -0,0 +1,234 @@
+package cocaine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWorker(sock socketIO) *Worker {
+	return newWorker(sock, uuid.UUID{}, &Logger{verbosity: LOGINGNORE}, time.Hour)
+}
+
+func TestWorkerOnContextCancelledByError(t *testing.T) {
+	sock := newTestSocket()
+	w := newTestWorker(sock)
+
+	var (
+		started = make(chan struct{})
+		done    = make(chan error, 1)
+	)
+	w.OnContext("sleep", func(ctx context.Context, req *Request, resp *Response) {
+		close(started)
+		<-ctx.Done()
+		done <- ctx.Err()
+	})
+	go w.Loop(nil)
+	defer w.Stop()
+
+	sock.out <- packMsg(&invoke{messageInfo{INVOKE, 1}, "sleep"})
+	<-started
+	sock.out <- packMsg(&errorMsg{messageInfo{ERROR, 1}, 1, "aborted"})
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("the context has not been cancelled")
+	}
+}
+
+func TestWorkerOnContextChoke(t *testing.T) {
+	sock := newTestSocket()
+	w := newTestWorker(sock)
+
+	w.OnContext("echo", func(ctx context.Context, req *Request, resp *Response) {
+		data := <-req.Read()
+		// the data has been delivered before the context is cancelled
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Error("the context must be cancelled by the choke")
+		}
+		resp.Write(string(data))
+		resp.Close()
+	})
+	// plain handlers keep working along with context ones
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		w.Loop(map[string]EventHandler{
+			"ping": func(req *Request, resp *Response) {
+				resp.Close()
+			},
+		})
+	}()
+
+	sock.out <- packMsg(&invoke{messageInfo{INVOKE, 1}, "echo"})
+	sock.out <- packMsg(&chunk{messageInfo{CHUNK, 1}, []byte("hello")})
+	sock.out <- packMsg(&invoke{messageInfo{INVOKE, 2}, "ping"})
+	// the echo replies once the choke has been received,
+	// so it is sent last, as replies are not read meanwhile
+	sock.out <- packMsg(&choke{messageInfo{CHOKE, 1}})
+
+	replies := make(map[int64][]int64)
+	for len(replies[1]) < 2 || len(replies[2]) < 1 {
+		select {
+		case raw := <-sock.Write():
+			msgs := newStreamUnpacker().Feed(raw, &LocalLoggerImpl{})
+			for _, msg := range msgs {
+				replies[msg.getSessionID()] = append(replies[msg.getSessionID()], msg.getTypeID())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no reply from the worker")
+		}
+	}
+	assert.Equal(t, []int64{CHUNK, CHOKE}, replies[1])
+	assert.Equal(t, []int64{CHOKE}, replies[2])
+
+	w.Stop()
+	select {
+	case <-loopDone:
+	case <-time.After(time.Second):
+		t.Fatal("Loop has not returned after Stop")
+	}
+}
+
+func TestWorkerStopCancelsHandlers(t *testing.T) {
+	sock := newTestSocket()
+	w := newTestWorker(sock)
+
+	var (
+		started = make(chan struct{})
+		done    = make(chan error, 1)
+	)
+	w.OnContext("sleep", func(ctx context.Context, req *Request, resp *Response) {
+		close(started)
+		<-ctx.Done()
+		done <- ctx.Err()
+	})
+	go w.Loop(nil)
+
+	sock.out <- packMsg(&invoke{messageInfo{INVOKE, 1}, "sleep"})
+	<-started
+	w.Stop()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("the context has not been cancelled")
+	}
+}
+
+func TestWorkerTerminateWaitsForHandlers(t *testing.T) {
+	sock := newTestSocket()
+	w := newTestWorker(sock)
+
+	exited := make(chan int, 1)
+	w.exit = func(code int) {
+		exited <- code
+	}
+
+	var (
+		started  = make(chan struct{})
+		returned = make(chan struct{})
+	)
+	w.OnContext("sleep", func(ctx context.Context, req *Request, resp *Response) {
+		close(started)
+		<-ctx.Done()
+		// cleanup of the cancelled handler
+		time.Sleep(20 * time.Millisecond)
+		resp.Close()
+		close(returned)
+	})
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		w.Loop(nil)
+	}()
+
+	sock.out <- packMsg(&invoke{messageInfo{INVOKE, 1}, "sleep"})
+	<-started
+	sock.out <- packMsg(&terminateStruct{messageInfo{TERMINATE, 0}, "normal", "shutdown"})
+
+	select {
+	case code := <-exited:
+		assert.Equal(t, 0, code)
+	case <-time.After(time.Second):
+		t.Fatal("the worker has not exited")
+	}
+
+	select {
+	case <-returned:
+	default:
+		t.Fatal("the worker must wait for the handler")
+	}
+	<-loopDone
+	assert.Empty(t, w.cancels)
+}
+
+func TestResponseWriteJSON(t *testing.T) {
+	sock := newTestSocket()
+	w := newTestWorker(sock)
+
+	go w.Loop(map[string]EventHandler{
+		"json": func(req *Request, resp *Response) {
+			defer resp.Close()
+			assert.NoError(t, resp.WriteJSON(map[string]int{"a": 1}))
+			if err := resp.WriteJSON(make(chan int)); err != nil {
+				resp.ErrorMsg(1, err.Error())
+			}
+		},
+	})
+	defer w.Stop()
+
+	sock.out <- packMsg(&invoke{messageInfo{INVOKE, 1}, "json"})
+
+	var replies []messageInterface
+	unpacker := newStreamUnpacker()
+	for len(replies) < 3 {
+		select {
+		case raw := <-sock.Write():
+			replies = append(replies, unpacker.Feed(raw, &LocalLoggerImpl{})...)
+		case <-time.After(time.Second):
+			t.Fatal("no reply from the worker")
+		}
+	}
+
+	if assert.IsType(t, &chunk{}, replies[0]) {
+		assert.Equal(t, []byte(`{"a":1}`), replies[0].(*chunk).Data)
+	}
+	if assert.IsType(t, &errorMsg{}, replies[1]) {
+		assert.Contains(t, replies[1].(*errorMsg).Message, "unsupported type")
+	}
+	assert.Equal(t, int64(CHOKE), replies[2].getTypeID())
+}
+
+func TestResponseWriteChecked(t *testing.T) {
+	toWorker := make(chan rawMessage, 10)
+	resp := newResponse(1, toWorker)
+
+	assert.NoError(t, resp.WriteChecked("data"))
+	assert.Error(t, resp.WriteChecked(make(chan int)))
+	resp.Close()
+	// a deferred Close along with an explicit one
+	resp.Close()
+	assert.Equal(t, ErrResponseClosed, resp.WriteChecked("late"))
+
+	var types []int64
+	for len(types) < 2 {
+		select {
+		case raw := <-toWorker:
+			for _, msg := range newStreamUnpacker().Feed(raw, &LocalLoggerImpl{}) {
+				types = append(types, msg.getTypeID())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message from the response")
+		}
+	}
+	assert.Equal(t, []int64{CHUNK, CHOKE}, types)
+}
@@ -0,0 +1,73 @@
+package cocaine12
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// AccessStatusOK means that a session is closed normally
+	AccessStatusOK = "ok"
+	// AccessStatusError means that a session is finished with an error
+	AccessStatusError = "error"
+)
+
+// AccessLogEntry describes a finished session
+type AccessLogEntry struct {
+	Event    string        `json:"event"`
+	Session  uint64        `json:"session"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// BytesIn is the number of bytes received from a client
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of bytes sent to a client
+	BytesOut int64 `json:"bytes_out"`
+	// Status is either AccessStatusOK or AccessStatusError
+	Status string `json:"status"`
+	// Category and Code describe an error
+	// if the session is finished with an error
+	Category int `json:"category,omitempty"`
+	Code     int `json:"code,omitempty"`
+	// Version is the version of the application set by Worker.SetVersion
+	Version string `json:"version,omitempty"`
+}
+
+// AccessLogger is called when a session is closed
+type AccessLogger func(AccessLogEntry)
+
+func newAccessLogEntry(session *workerSession, summary responseSummary) AccessLogEntry {
+	entry := AccessLogEntry{
+		Event:    session.event,
+		Session:  session.id,
+		Start:    session.startTime,
+		Duration: time.Since(session.startTime),
+		BytesIn:  session.getBytesIn(),
+		BytesOut: summary.bytesOut,
+		Status:   AccessStatusOK,
+	}
+
+	if summary.failed {
+		entry.Status = AccessStatusError
+		entry.Category = summary.category
+		entry.Code = summary.code
+	}
+
+	return entry
+}
+
+// NewJSONAccessLogger returns AccessLogger which writes
+// entries to out as JSON objects separated by a newline
+func NewJSONAccessLogger(out io.Writer) AccessLogger {
+	var (
+		mu      sync.Mutex
+		encoder = json.NewEncoder(out)
+	)
+
+	return func(entry AccessLogEntry) {
+		mu.Lock()
+		encoder.Encode(entry)
+		mu.Unlock()
+	}
+}
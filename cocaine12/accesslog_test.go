@@ -0,0 +1,213 @@
+package cocaine12
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerAccessLog(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	entries := make(chan AccessLogEntry, 2)
+	w.SetAccessLogger(func(entry AccessLogEntry) {
+		entries <- entry
+	})
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		defer res.Close()
+		data, _ := req.Read(ctx)
+		res.Write(data)
+		res.Write(data)
+	})
+	w.On("error", func(ctx context.Context, req Request, res Response) {
+		req.Read(ctx)
+		res.ErrorMsg(-100, "dummyError")
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "echo")
+	runtime.Write() <- newChunkV1(2, []byte("Dummy"))
+	runtime.Write() <- newChokeV1(2)
+
+	select {
+	case entry := <-entries:
+		assert.Equal(t, "echo", entry.Event)
+		assert.Equal(t, uint64(2), entry.Session)
+		assert.Equal(t, int64(5), entry.BytesIn)
+		assert.Equal(t, int64(10), entry.BytesOut)
+		assert.Equal(t, AccessStatusOK, entry.Status)
+		assert.False(t, entry.Start.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+
+	runtime.Write() <- newInvokeV1(3, "error")
+	runtime.Write() <- newChunkV1(3, []byte("Dummy"))
+	runtime.Write() <- newChokeV1(3)
+
+	select {
+	case entry := <-entries:
+		assert.Equal(t, "error", entry.Event)
+		assert.Equal(t, uint64(3), entry.Session)
+		assert.Equal(t, AccessStatusError, entry.Status)
+		assert.Equal(t, -100, entry.Code)
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+}
+
+func TestWorkerAccessLogRejected(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	entries := make(chan AccessLogEntry, 1)
+	w.SetAccessLogger(func(entry AccessLogEntry) {
+		entries <- entry
+	})
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		t.Error("a disabled event must not be handled")
+	})
+	w.DisableEvent("echo")
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "echo")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Error)
+
+	select {
+	case entry := <-entries:
+		assert.Equal(t, "echo", entry.Event)
+		assert.Equal(t, uint64(2), entry.Session)
+		assert.Equal(t, AccessStatusError, entry.Status)
+		assert.Equal(t, ErrorEventDisabled, entry.Code)
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+}
+
+func TestResponseOnCloseWithoutLock(t *testing.T) {
+	in, out := testConn()
+	defer in.Close()
+	sock, _ := newAsyncRW(out)
+	defer sock.Close()
+
+	response := newResponse(newV1Protocol(), 2, sock, make(chan struct{}))
+	calls := make(chan int64, 2)
+	response.onClose = func(summary responseSummary) {
+		// the callback may use the response
+		calls <- response.bytesOut()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		response.Write([]byte("data"))
+		response.Close()
+		response.ErrorMsg(-100, "closed already")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("onClose is called under the lock")
+	}
+	assert.Equal(t, int64(4), <-calls)
+	assert.Len(t, calls, 0, "onClose must be called once")
+}
+
+func TestJSONAccessLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONAccessLogger(&buf)
+
+	logger(AccessLogEntry{Event: "a", Session: 2, Status: AccessStatusOK})
+	logger(AccessLogEntry{Event: "b", Session: 3, Status: AccessStatusError, Code: 100})
+
+	dec := json.NewDecoder(&buf)
+	var entry map[string]interface{}
+
+	assert.NoError(t, dec.Decode(&entry))
+	assert.Equal(t, "a", entry["event"])
+	assert.Equal(t, "ok", entry["status"])
+	assert.NotContains(t, entry, "code")
+
+	entry = nil
+	assert.NoError(t, dec.Decode(&entry))
+	assert.Equal(t, "b", entry["event"])
+	assert.Equal(t, "error", entry["status"])
+	assert.Equal(t, float64(100), entry["code"])
+}
+
+func TestWorkerAccessLogService(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	s, peer := newTestService("logging")
+	defer s.Close()
+	defer peer.Close()
+
+	w.SetAccessLogService(s)
+	w.impl.accessLogService.batchSize = 2
+	w.impl.accessLogService.flushInterval = time.Hour
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	readBatch := func() []AccessLogEntry {
+		var msg *Message
+		select {
+		case msg = <-peer.Read():
+		case <-time.After(time.Second):
+			t.Fatal("no access log batch has been emitted")
+		}
+		assert.Equal(t, uint64(loggerEmit), msg.MsgType)
+		if !assert.Len(t, msg.Payload, 4) {
+			t.FailNow()
+		}
+
+		var body []byte
+		switch message := msg.Payload[2].(type) {
+		case string:
+			body = []byte(message)
+		case []byte:
+			body = message
+		}
+
+		var batch []AccessLogEntry
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		for decoder.More() {
+			var entry AccessLogEntry
+			if !assert.NoError(t, decoder.Decode(&entry)) {
+				t.FailNow()
+			}
+			batch = append(batch, entry)
+		}
+		return batch
+	}
+
+	for i := uint64(2); i < 5; i++ {
+		runtime.Write() <- newInvokeV1(i, "echo")
+		checkTypeAndSession(t, readTestMessage(t, runtime), i, v1Close)
+		runtime.Write() <- newChokeV1(i)
+	}
+
+	// the first two entries are emitted by a single call
+	batch := readBatch()
+	if assert.Len(t, batch, 2) {
+		assert.Equal(t, "echo", batch[0].Event)
+		assert.Equal(t, uint64(2), batch[0].Session)
+		assert.Equal(t, uint64(3), batch[1].Session)
+	}
+
+	// the rest is flushed once the worker is stopped
+	w.Stop()
+	<-onStop
+	batch = readBatch()
+	if assert.Len(t, batch, 1) {
+		assert.Equal(t, uint64(4), batch[0].Session)
+	}
+}
@@ -0,0 +1,166 @@
+package cocaine12
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// entries are emitted once so many of them are collected
+	accessLogBatchSize = 100
+	// or once the oldest one has been waiting so long
+	accessLogFlushInterval = time.Second
+	// entries which don't fit the queue are written to the local logger
+	accessLogQueueSize = 1024
+	// the limit of a reconnection to the logging service
+	accessLogReconnectTimeout = time.Second
+)
+
+// serviceAccessLogger emits batches of access log entries
+// to a cocaine logging service
+type serviceAccessLogger struct {
+	service *Service
+	source  string
+	// receives entries if the logging service is down
+	fallback Logger
+
+	batchSize     int
+	flushInterval time.Duration
+
+	entries chan AccessLogEntry
+
+	// protects closed, so no entries are queued after run exits
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newServiceAccessLogger(service *Service) *serviceAccessLogger {
+	fallback, _ := newFallbackLogger()
+	return &serviceAccessLogger{
+		service:       service,
+		source:        fmt.Sprintf("app/%s/access", GetDefaults().ApplicationName()),
+		fallback:      fallback,
+		batchSize:     accessLogBatchSize,
+		flushInterval: accessLogFlushInterval,
+		entries:       make(chan AccessLogEntry, accessLogQueueSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// log queues the entry without blocking a handler
+func (s *serviceAccessLogger) log(entry AccessLogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		s.logLocally([]AccessLogEntry{entry})
+		return
+	}
+
+	select {
+	case s.entries <- entry:
+	default:
+		s.logLocally([]AccessLogEntry{entry})
+	}
+}
+
+func (s *serviceAccessLogger) run() {
+	defer close(s.done)
+
+	var (
+		batch = make([]AccessLogEntry, 0, s.batchSize)
+		timer = time.NewTimer(s.flushInterval)
+	)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			s.emit(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case entry := <-s.entries:
+			if len(batch) == 0 {
+				timer.Reset(s.flushInterval)
+			}
+			batch = append(batch, entry)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+
+		case <-timer.C:
+			flush()
+
+		case <-s.stop:
+			for {
+				select {
+				case entry := <-s.entries:
+					batch = append(batch, entry)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close emits queued entries and stops the logger.
+// Entries logged after that are written to the local logger
+func (s *serviceAccessLogger) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+}
+
+// emit sends the batch by a single call of the logging service.
+// The message contains the entries as JSON objects separated
+// by a newline like NewJSONAccessLogger writes them
+func (s *serviceAccessLogger) emit(batch []AccessLogEntry) {
+	if s.service.disconnected() {
+		ctx, cancel := context.WithTimeout(context.Background(), accessLogReconnectTimeout)
+		err := s.service.Reconnect(ctx, false)
+		cancel()
+		if err != nil {
+			s.logLocally(batch)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range batch {
+		encoder.Encode(entry)
+	}
+
+	attrs := []attrPair{{"entries", len(batch)}}
+	msg := &Message{
+		CommonMessageInfo: CommonMessageInfo{s.service.sessions.Next(), loggerEmit},
+		Payload:           []interface{}{InfoLevel, s.source, buf.String(), attrs},
+	}
+	s.service.sendMsg(msg)
+}
+
+func (s *serviceAccessLogger) logLocally(batch []AccessLogEntry) {
+	for _, entry := range batch {
+		line, _ := json.Marshal(entry)
+		s.fallback.Infof("%s %s", s.source, line)
+	}
+}
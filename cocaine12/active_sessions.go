@@ -0,0 +1,88 @@
+package cocaine12
+
+import (
+	"sort"
+	"time"
+)
+
+// SessionInfo describes an active session of the worker
+type SessionInfo struct {
+	ID    uint64
+	Event string
+	// Age is the time since the session has been invoked
+	Age time.Duration
+	// BytesIn is the number of bytes received from a client
+	BytesIn int64
+	// BytesOut is the number of bytes sent to a client
+	BytesOut int64
+}
+
+// sessionsByID sorts sessions by id
+type sessionsByID []SessionInfo
+
+func (s sessionsByID) Len() int           { return len(s) }
+func (s sessionsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// sessionsRequest is passed by Sessions and CancelAllSessions to the loop
+type sessionsRequest struct {
+	cancel bool
+	done   chan []SessionInfo
+}
+
+// Sessions returns active sessions of the worker ordered by id.
+// Sessions are owned by the loop, so it must be called after Worker.Run.
+// It returns nil if the worker has been stopped.
+func (w *WorkerNG) Sessions() []SessionInfo {
+	return w.requestSessions(false)
+}
+
+// CancelAllSessions cancels contexts of all active sessions, replies
+// to their clients with ErrorSessionCancelled and returns the cancelled
+// sessions. The worker keeps serving new invokes. It must be called
+// after Worker.Run. It returns nil if the worker has been stopped.
+func (w *WorkerNG) CancelAllSessions() []SessionInfo {
+	return w.requestSessions(true)
+}
+
+func (w *WorkerNG) requestSessions(cancel bool) []SessionInfo {
+	request := sessionsRequest{
+		cancel: cancel,
+		done:   make(chan []SessionInfo, 1),
+	}
+
+	select {
+	case w.sessionsRequests <- request:
+	case <-w.stopped:
+		return nil
+	case <-w.getConn().IsClosed():
+		return nil
+	}
+
+	// the loop always replies
+	return <-request.done
+}
+
+func (w *WorkerNG) onSessionsRequest(request sessionsRequest) {
+	infos := make([]SessionInfo, 0, len(w.sessions))
+	now := time.Now()
+	for id, session := range w.sessions {
+		infos = append(infos, SessionInfo{
+			ID:       id,
+			Event:    session.event,
+			Age:      now.Sub(session.startTime),
+			BytesIn:  session.getBytesIn(),
+			BytesOut: session.response.bytesOut(),
+		})
+	}
+	sort.Sort(sessionsByID(infos))
+
+	if request.cancel && len(infos) > 0 {
+		w.logWithFields(Fields{
+			"sessions": len(infos),
+		}).Warnf("cancelling all active sessions")
+		w.terminateAllSessions(ErrorSessionCancelled, "the session has been cancelled by the worker")
+	}
+
+	request.done <- infos
+}
@@ -2,9 +2,11 @@ package cocaine12
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ugorji/go/codec"
@@ -21,6 +23,37 @@ var (
 	hAsocket = &mhAsocket
 )
 
+// Codec defines the envelope of messages exchanged with cocaine-runtime:
+// the handshake, heartbeats and the frames of sessions.
+// Functions returned by NewEncoder and NewDecoder are never called concurrently.
+type Codec interface {
+	// NewEncoder returns a function which writes a message to w
+	NewEncoder(w io.Writer) func(*Message) error
+	// NewDecoder returns a function which reads the next message from r
+	NewDecoder(r io.Reader) func() (*Message, error)
+}
+
+// MsgpackCodec is the default envelope of messages
+type MsgpackCodec struct{}
+
+// NewEncoder implements Codec
+func (MsgpackCodec) NewEncoder(w io.Writer) func(*Message) error {
+	encoder := codec.NewEncoder(w, hAsocket)
+	return func(msg *Message) error {
+		return encoder.Encode(msg)
+	}
+}
+
+// NewDecoder implements Codec
+func (MsgpackCodec) NewDecoder(r io.Reader) func() (*Message, error) {
+	decoder := codec.NewDecoder(r, hAsocket)
+	return func() (*Message, error) {
+		var message *Message
+		err := decoder.Decode(&message)
+		return message, err
+	}
+}
+
 type asyncSender interface {
 	Send(*Message)
 }
@@ -33,6 +66,36 @@ type socketIO interface {
 	Close()
 }
 
+// trackedSender is implemented by sockets which are able
+// to report when a message has been written to the connection
+type trackedSender interface {
+	sendTracked(msg *Message) <-chan struct{}
+}
+
+// connErrorNotifier is implemented by sockets which are able
+// to report IO errors of the underlying connection
+type connErrorNotifier interface {
+	setErrorHandler(handler ConnErrorHandler)
+}
+
+// envelopeSetter is implemented by sockets
+// which allow to replace the envelope of messages
+type envelopeSetter interface {
+	setEnvelope(envelope Codec)
+}
+
+// gracefulCloser is implemented by sockets which are able
+// to flush pending messages before closing
+type gracefulCloser interface {
+	closeGracefully(timeout time.Duration)
+}
+
+// transporter is implemented by sockets which know
+// the network of the underlying connection
+type transporter interface {
+	Transport() string
+}
+
 type asyncBuff struct {
 	in  chan *Message
 	out chan *Message
@@ -97,6 +160,9 @@ func (bf *asyncBuff) loop() {
 				// message queue is empty and
 				// no more messages are expected
 				return
+			} else if quitAfterTimeout != nil {
+				// the buffer is drained
+				return
 			}
 
 			select {
@@ -147,6 +213,7 @@ func (bf *asyncBuff) Stop() error {
 }
 
 // Drain waits for the duration to let the buffer send pending messages.
+// The buffer is stopped as soon as it is empty.
 // It is prohibited to call Drain after Stop
 func (bf *asyncBuff) Drain(d time.Duration) error {
 	var timeoutChan = time.After(d)
@@ -157,21 +224,55 @@ func (bf *asyncBuff) Drain(d time.Duration) error {
 	return bf.Stop()
 }
 
+// Framer wraps messages into frames of a transport.
+// ReadFrame and WriteFrame are called from different goroutines,
+// but each of them is never called concurrently with itself.
+type Framer interface {
+	// ReadFrame returns the next frame which contains one encoded message
+	ReadFrame(r io.Reader) ([]byte, error)
+	// WriteFrame writes one encoded message as a frame
+	WriteFrame(w io.Writer, b []byte) error
+}
+
 // Biderectional socket
 type asyncRWSocket struct {
 	sync.Mutex
-	conn          io.ReadWriteCloser
-	upstreamBuf   *asyncBuff
-	downstreamBuf *asyncBuff
-	closed        chan struct{} // broadcast channel
+	conn io.ReadWriteCloser
+	// nil means that messages are written to the connection as is
+	framer Framer
+	// it is protected by the mutex, as it can be replaced
+	// until the first message is read or written
+	envelope Codec
+	// the size of the buffer of the read loop, 0 means the default size
+	readBufferSize int
+	upstreamBuf    *asyncBuff
+	downstreamBuf  *asyncBuff
+	closed         chan struct{} // broadcast channel
+	closeOnce      sync.Once
+	// is closed when writeloop exits
+	writeDone chan struct{}
+	onError   ConnErrorHandler
+	// messages sent by sendTracked, which are not written yet.
+	// It is protected by the mutex
+	tracked map[*Message]chan struct{}
+	// the size of tracked, it must be accessed atomically
+	trackedCount int64
 }
 
 func newAsyncRW(conn io.ReadWriteCloser) (*asyncRWSocket, error) {
+	return newAsyncFramedRW(conn, nil, 0)
+}
+
+func newAsyncFramedRW(conn io.ReadWriteCloser, framer Framer, readBufferSize int) (*asyncRWSocket, error) {
 	sock := &asyncRWSocket{
-		conn:          conn,
-		upstreamBuf:   newAsyncBuf(),
-		downstreamBuf: newAsyncBuf(),
-		closed:        make(chan struct{}),
+		conn:           conn,
+		framer:         framer,
+		envelope:       MsgpackCodec{},
+		readBufferSize: readBufferSize,
+		upstreamBuf:    newAsyncBuf(),
+		downstreamBuf:  newAsyncBuf(),
+		closed:         make(chan struct{}),
+		writeDone:      make(chan struct{}),
 	}
 
 	sock.readloop()
@@ -180,8 +281,12 @@ func newAsyncRW(conn io.ReadWriteCloser) (*asyncRWSocket, error) {
 	return sock, nil
 }
 
-func newUnixConnection(address string, timeout time.Duration) (socketIO, error) {
-	return newAsyncConnection("unix", address, timeout)
+func newUnixConnection(address string, timeout time.Duration, framer Framer, readBufferSize int) (socketIO, error) {
+	conn, err := dialConnection("unix", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncFramedRW(conn, framer, readBufferSize)
 }
 
 func newTCPConnection(address string, timeout time.Duration) (socketIO, error) {
@@ -189,22 +294,58 @@ func newTCPConnection(address string, timeout time.Duration) (socketIO, error) {
 }
 
 func newAsyncConnection(family string, address string, timeout time.Duration) (socketIO, error) {
+	conn, err := dialConnection(family, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncRW(conn)
+}
+
+func dialConnection(family string, address string, timeout time.Duration) (net.Conn, error) {
 	dialer := net.Dialer{
 		Timeout:   timeout,
 		DualStack: true,
 	}
 
-	conn, err := dialer.Dial(family, address)
-	if err != nil {
-		return nil, err
+	return dialer.Dial(family, address)
+}
+
+// Transport returns the network of the underlying connection,
+// e.g. "unix" or "tcp". It is empty if the connection is not a network one
+func (sock *asyncRWSocket) Transport() string {
+	if conn, ok := sock.conn.(net.Conn); ok {
+		return conn.LocalAddr().Network()
 	}
-	return newAsyncRW(conn)
+	return ""
 }
 
+// Close closes the connection and drops pending messages.
+// It is safe to call it many times
 func (sock *asyncRWSocket) Close() {
-	sock.upstreamBuf.Stop()
-	sock.downstreamBuf.Stop()
-	sock.close()
+	sock.closeOnce.Do(func() {
+		// unblock senders first, as nobody reads
+		// from buffers after they are stopped
+		sock.close()
+		sock.upstreamBuf.Stop()
+		sock.downstreamBuf.Stop()
+	})
+}
+
+// closeGracefully waits up to timeout for pending messages
+// to be written and closes the connection
+func (sock *asyncRWSocket) closeGracefully(timeout time.Duration) {
+	sock.closeOnce.Do(func() {
+		deadline := time.After(timeout)
+		sock.upstreamBuf.Drain(timeout)
+		// the last message may be still being written
+		select {
+		case <-sock.writeDone:
+		case <-deadline:
+		}
+
+		sock.close()
+		sock.downstreamBuf.Stop()
+	})
 }
 
 func (sock *asyncRWSocket) close() {
@@ -219,6 +360,47 @@ func (sock *asyncRWSocket) close() {
 	}
 }
 
+func (sock *asyncRWSocket) setErrorHandler(handler ConnErrorHandler) {
+	sock.Lock()
+	sock.onError = handler
+	sock.Unlock()
+}
+
+func (sock *asyncRWSocket) setEnvelope(envelope Codec) {
+	sock.Lock()
+	sock.envelope = envelope
+	sock.Unlock()
+}
+
+func (sock *asyncRWSocket) getEnvelope() Codec {
+	sock.Lock()
+	defer sock.Unlock()
+	return sock.envelope
+}
+
+// notifyError passes an IO error to the attached handler.
+// Errors caused by Close() or by EOF from the other side are not reported.
+func (sock *asyncRWSocket) notifyError(op string, err error) {
+	if err == io.EOF {
+		return
+	}
+
+	sock.Lock()
+	handler := sock.onError
+	sock.Unlock()
+
+	select {
+	case <-sock.closed:
+		// the connection has been closed by us
+		return
+	default:
+	}
+
+	if handler != nil {
+		handler(op, err)
+	}
+}
+
 func (sock *asyncRWSocket) IsClosed() (broadcast <-chan struct{}) {
 	return sock.closed
 }
@@ -240,13 +422,58 @@ func (sock *asyncRWSocket) Send(msg *Message) {
 	}
 }
 
+// sendTracked works like Send, but the returned channel
+// is closed once the message is written to the connection
+func (sock *asyncRWSocket) sendTracked(msg *Message) <-chan struct{} {
+	written := make(chan struct{})
+
+	sock.Lock()
+	if sock.tracked == nil {
+		sock.tracked = make(map[*Message]chan struct{})
+	}
+	sock.tracked[msg] = written
+	sock.Unlock()
+	atomic.AddInt64(&sock.trackedCount, 1)
+
+	sock.Send(msg)
+	return written
+}
+
+// markWritten notifies the sender of a tracked message
+func (sock *asyncRWSocket) markWritten(msg *Message) {
+	if atomic.LoadInt64(&sock.trackedCount) == 0 {
+		return
+	}
+
+	sock.Lock()
+	written, ok := sock.tracked[msg]
+	delete(sock.tracked, msg)
+	sock.Unlock()
+
+	if ok {
+		atomic.AddInt64(&sock.trackedCount, -1)
+		close(written)
+	}
+}
+
 func (sock *asyncRWSocket) writeloop() {
 	go func() {
-		var buf = bufio.NewWriter(sock.conn)
-		encoder := codec.NewEncoder(buf, hAsocket)
+		defer close(sock.writeDone)
+
+		var (
+			buf = bufio.NewWriter(sock.conn)
+			// it is created on the first message,
+			// as the envelope can be replaced until then
+			encode func(*Message) error
+		)
 		for incoming := range sock.upstreamBuf.out {
-			err := encoder.Encode(incoming)
+			if encode == nil {
+				encode = sock.messageEncoder(buf)
+			}
+
+			err := encode(incoming)
 			if err != nil {
+				sock.notifyError("write", err)
 				sock.close()
 				// blackhole all pending writes. See #31
 				go func() {
@@ -257,22 +484,72 @@ func (sock *asyncRWSocket) writeloop() {
 				return
 			}
 			buf.Flush()
+			sock.markWritten(incoming)
 		}
 	}()
 }
 
 func (sock *asyncRWSocket) readloop() {
 	go func() {
-		decoder := codec.NewDecoder(bufio.NewReader(sock.conn), hAsocket)
-		for {
-			var message *Message
-			err := decoder.Decode(&message)
-			if err != nil {
-				close(sock.downstreamBuf.in)
-				sock.close()
-				return
+		var r = bufio.NewReader(sock.conn)
+		if sock.readBufferSize > 0 {
+			r = bufio.NewReaderSize(sock.conn, sock.readBufferSize)
+		}
+		// wait for the first message to create the decoder,
+		// as the envelope can be replaced until then
+		_, err := r.Peek(1)
+		if err == nil {
+			decode := sock.messageDecoder(r)
+			for {
+				var message *Message
+				if message, err = decode(); err != nil {
+					break
+				}
+
+				select {
+				case sock.downstreamBuf.in <- message:
+				case <-sock.closed:
+					// the buffer may have been stopped
+				}
 			}
-			sock.downstreamBuf.in <- message
 		}
+
+		sock.notifyError("read", err)
+		close(sock.downstreamBuf.in)
+		sock.close()
 	}()
 }
+
+// messageEncoder returns a function which writes a message to w
+// according to the framing of the socket
+func (sock *asyncRWSocket) messageEncoder(w io.Writer) func(*Message) error {
+	envelope := sock.getEnvelope()
+	if sock.framer == nil {
+		return envelope.NewEncoder(w)
+	}
+
+	return func(msg *Message) error {
+		var frame bytes.Buffer
+		if err := envelope.NewEncoder(&frame)(msg); err != nil {
+			return err
+		}
+		return sock.framer.WriteFrame(w, frame.Bytes())
+	}
+}
+
+// messageDecoder returns a function which reads the next message from r
+// according to the framing of the socket
+func (sock *asyncRWSocket) messageDecoder(r io.Reader) func() (*Message, error) {
+	envelope := sock.getEnvelope()
+	if sock.framer == nil {
+		return envelope.NewDecoder(r)
+	}
+
+	return func() (*Message, error) {
+		frame, err := sock.framer.ReadFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		return envelope.NewDecoder(bytes.NewReader(frame))()
+	}
+}
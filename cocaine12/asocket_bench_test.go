@@ -0,0 +1,36 @@
+package cocaine12
+
+import (
+	"bytes"
+	"testing"
+)
+
+func doBenchmarkASocketLargeFrames(b *testing.B, readBufferSize int) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	peer, _ := newAsyncFramedRW(in, nil, readBufferSize)
+	defer sock.Close()
+	defer peer.Close()
+
+	chunk := bytes.Repeat([]byte("x"), 1024*1024)
+	msg := newChunkV1(2, chunk)
+
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sock.Write() <- msg
+		<-peer.Read()
+	}
+}
+
+func BenchmarkASocketLargeFramesDefaultBuffer(b *testing.B) {
+	doBenchmarkASocketLargeFrames(b, 0)
+}
+
+func BenchmarkASocketLargeFrames64KBuffer(b *testing.B) {
+	doBenchmarkASocketLargeFrames(b, 64*1024)
+}
+
+func BenchmarkASocketLargeFrames1MBuffer(b *testing.B) {
+	doBenchmarkASocketLargeFrames(b, 1024*1024)
+}
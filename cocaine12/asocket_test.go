@@ -1,10 +1,20 @@
 package cocaine12
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
 )
 
 func TestASocketDrain(t *testing.T) {
@@ -38,6 +48,217 @@ func TestASocketDrain(t *testing.T) {
 func TestASocketConnect(t *testing.T) {
 	_, err := newTCPConnection("128.0.0.1:45000", time.Second)
 	assert.Error(t, err)
-	_, err = newUnixConnection("unix.sock", time.Second)
+	_, err = newUnixConnection("unix.sock", time.Second, nil, 0)
 	assert.Error(t, err)
 }
+
+// lengthPrefixFramer prefixes every frame with its 4-byte length
+type lengthPrefixFramer struct {
+	framesRead, framesWritten int64
+}
+
+func (f *lengthPrefixFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&f.framesRead, 1)
+	return frame, nil
+}
+
+func (f *lengthPrefixFramer) WriteFrame(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	atomic.AddInt64(&f.framesWritten, 1)
+	return nil
+}
+
+func TestASocketFramer(t *testing.T) {
+	framer := new(lengthPrefixFramer)
+	in, out := testConn()
+	sock, _ := newAsyncFramedRW(out, framer, 0)
+	peer, _ := newAsyncFramedRW(in, framer, 0)
+	defer sock.Close()
+	defer peer.Close()
+
+	sent := []*Message{
+		newInvokeV1(2, "echo"),
+		newChunkV1(2, []byte("Dummy")),
+		newChokeV1(2),
+	}
+	for _, msg := range sent {
+		sock.Write() <- msg
+	}
+
+	for _, msg := range sent {
+		select {
+		case received := <-peer.Read():
+			checkTypeAndSession(t, received, msg.Session, msg.MsgType)
+		case <-time.After(time.Second):
+			t.Fatal("no message has been received")
+		}
+	}
+
+	assert.Equal(t, int64(len(sent)), atomic.LoadInt64(&framer.framesWritten))
+	assert.Equal(t, int64(len(sent)), atomic.LoadInt64(&framer.framesRead))
+}
+
+func TestWorkerTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "worker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	unixSock, err := newUnixConnection(unixListener.Addr().String(), time.Second, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixSock.Close()
+
+	tcpSock, err := newTCPConnection(tcpListener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpSock.Close()
+
+	for expected, sock := range map[string]socketIO{
+		"unix": unixSock,
+		"tcp":  tcpSock,
+	} {
+		w, err := newWorker(sock, "uuid", 1, true)
+		if err != nil {
+			t.Fatal("unable to create worker", err)
+		}
+		assert.Equal(t, expected, w.Transport())
+	}
+
+	a, _ := NewMemorySocketPair(MemorySocketOptions{})
+	defer a.Close()
+	w, err := newWorker(a, "uuid", 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+	assert.Equal(t, "", w.Transport())
+}
+
+// bincCodec is an alternative envelope which counts encoded messages
+type bincCodec struct {
+	encoded int64
+	decoded int64
+}
+
+var hBinc = &codec.BincHandle{
+	BasicHandle: codec.BasicHandle{
+		EncodeOptions: codec.EncodeOptions{
+			StructToArray: true,
+		},
+	},
+}
+
+func (c *bincCodec) NewEncoder(w io.Writer) func(*Message) error {
+	encoder := codec.NewEncoder(w, hBinc)
+	return func(msg *Message) error {
+		atomic.AddInt64(&c.encoded, 1)
+		return encoder.Encode(msg)
+	}
+}
+
+func (c *bincCodec) NewDecoder(r io.Reader) func() (*Message, error) {
+	decoder := codec.NewDecoder(r, hBinc)
+	return func() (*Message, error) {
+		var message *Message
+		if err := decoder.Decode(&message); err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&c.decoded, 1)
+		return message, nil
+	}
+}
+
+func TestWorkerEnvelopeCodec(t *testing.T) {
+	var envelope = new(bincCodec)
+
+	w, runtime := newTestWorker(t)
+	runtime.setEnvelope(envelope)
+	w.SetEnvelopeCodec(envelope)
+	w.On("echo", func(ctx context.Context, req Request, resp Response) {
+		defer resp.Close()
+		data, _ := req.Read(ctx)
+		// wait for the choke to be decoded
+		_, err := req.Read(ctx)
+		assert.Equal(t, ErrStreamIsClosed, err)
+		resp.Write(data)
+	})
+
+	onStop := runTestWorker(t, w, runtime)
+	defer func() {
+		w.Stop()
+		<-onStop
+	}()
+
+	runtime.Write() <- newInvokeV1(2, "echo")
+	runtime.Write() <- newChunkV1(2, []byte("Dummy"))
+	runtime.Write() <- newChokeV1(2)
+
+	chunk := readTestMessage(t, runtime)
+	checkTypeAndSession(t, chunk, 2, v1Write)
+	assert.Equal(t, []byte("Dummy"), chunk.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+
+	// handshake, heartbeat, chunk and choke from the worker
+	// along with heartbeat, invoke, chunk and choke from the runtime
+	assert.Equal(t, int64(8), atomic.LoadInt64(&envelope.encoded))
+	assert.Equal(t, int64(8), atomic.LoadInt64(&envelope.decoded))
+}
+
+func TestASocketReadBufferSize(t *testing.T) {
+	// the chunk is much larger than the buffer,
+	// so it is read by many parts
+	chunk := bytes.Repeat([]byte("chunk"), 64*1024)
+
+	for _, framer := range []Framer{nil, new(lengthPrefixFramer)} {
+		in, out := testConn()
+		sock, _ := newAsyncFramedRW(out, framer, 0)
+		peer, _ := newAsyncFramedRW(in, framer, 16)
+
+		sock.Write() <- newChunkV1(2, chunk)
+		sock.Write() <- newChokeV1(2)
+
+		for _, expected := range []uint64{v1Write, v1Close} {
+			select {
+			case received := <-peer.Read():
+				checkTypeAndSession(t, received, 2, expected)
+				if expected == v1Write {
+					assert.Equal(t, chunk, received.Payload[0])
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no message has been received")
+			}
+		}
+
+		sock.Close()
+		peer.Close()
+	}
+}
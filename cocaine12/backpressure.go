@@ -0,0 +1,127 @@
+package cocaine12
+
+import (
+	"sync/atomic"
+)
+
+// BackpressureMode defines how the worker behaves
+// when the limit of active handlers is reached
+type BackpressureMode int
+
+const (
+	// ModeReject replies to new invokes with ErrorOverloaded
+	ModeReject BackpressureMode = iota
+	// ModeThrottle defers an invoke until a handler finishes
+	// and stops reading from the connection meanwhile,
+	// so cocaine-runtime slows down the delivery.
+	// Chunks which arrive after the deferred invoke are not read either,
+	// so running handlers must not wait for the input for a long time.
+	// Heartbeat replies are still read in this mode to not be disowned.
+	ModeThrottle
+)
+
+// overloadState counts active handlers
+type overloadState struct {
+	// the limit of concurrently running handlers, 0 means no limit
+	maxActiveHandlers int
+	mode              BackpressureMode
+	// it must be accessed atomically
+	activeHandlers int64
+	// notifies the loop that a handler has finished
+	handlerFinished chan struct{}
+	// deferred handlers in ModeThrottle.
+	// It is owned by the loop
+	pending []func()
+	// limits of particular events
+	eventLimits map[string]*eventLimit
+}
+
+func newOverloadState() overloadState {
+	return overloadState{
+		mode:            ModeReject,
+		handlerFinished: make(chan struct{}, 1),
+		eventLimits:     make(map[string]*eventLimit),
+	}
+}
+
+func (o *overloadState) isOverloaded() bool {
+	return o.maxActiveHandlers > 0 &&
+		atomic.LoadInt64(&o.activeHandlers) >= int64(o.maxActiveHandlers)
+}
+
+// startPending starts deferred handlers until the limit is reached
+func (o *overloadState) startPending() {
+	for _, limit := range o.eventLimits {
+		limit.startPending()
+	}
+
+	for len(o.pending) > 0 && !o.isOverloaded() {
+		start := o.pending[0]
+		// help GC a bit
+		o.pending[0] = nil
+		o.pending = o.pending[1:]
+		start()
+	}
+}
+
+// isIdle reports whether there are neither running nor deferred handlers
+func (o *overloadState) isIdle() bool {
+	if atomic.LoadInt64(&o.activeHandlers) > 0 || len(o.pending) > 0 {
+		return false
+	}
+
+	for _, limit := range o.eventLimits {
+		if len(limit.pending) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *overloadState) onHandlerStarted() {
+	atomic.AddInt64(&o.activeHandlers, 1)
+}
+
+func (o *overloadState) onHandlerFinished() {
+	atomic.AddInt64(&o.activeHandlers, -1)
+	select {
+	case o.handlerFinished <- struct{}{}:
+	default:
+		// the loop has been already notified
+	}
+}
+
+// eventLimit bounds the number of concurrently running handlers of an event.
+// A slot is taken when a handler is scheduled, so handlers deferred
+// by the global limit are counted too
+type eventLimit struct {
+	max int
+	// it must be accessed atomically
+	active int64
+	// deferred handlers in ModeThrottle.
+	// It is owned by the loop
+	pending []func()
+}
+
+func (l *eventLimit) isFull() bool {
+	return atomic.LoadInt64(&l.active) >= int64(l.max)
+}
+
+func (l *eventLimit) acquire() {
+	atomic.AddInt64(&l.active, 1)
+}
+
+func (l *eventLimit) release() {
+	atomic.AddInt64(&l.active, -1)
+}
+
+// startPending starts deferred handlers until the limit is reached
+func (l *eventLimit) startPending() {
+	for len(l.pending) > 0 && !l.isFull() {
+		start := l.pending[0]
+		// help GC a bit
+		l.pending[0] = nil
+		l.pending = l.pending[1:]
+		start()
+	}
+}
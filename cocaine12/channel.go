@@ -2,13 +2,20 @@ package cocaine12
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 )
 
+// ErrChannelCancelled is returned by Rx.Get after the channel is closed by Close
+var ErrChannelCancelled = errors.New("the channel has been cancelled")
+
 type Channel interface {
 	Rx
 	Tx
+	// Close cancels the call: it closes the stream to the service
+	// if the protocol allows it and drops all the incoming frames
+	Close() error
 }
 
 type Rx interface {
@@ -26,11 +33,58 @@ type channel struct {
 	traceReceived CloseSpan
 	// we call when data is sent
 	traceSent CloseSpan
+	// we call when the last frame of the call arrives.
+	// It closes the span of the call
+	traceFinished CloseSpan
+	// we call when the call ends with an error
+	traceFailed func(error)
+	finishOnce  sync.Once
+	// closed when the call is over
+	finished chan struct{}
 
 	rx
 	tx
 }
 
+func (ch *channel) Get(ctx context.Context) (ServiceResult, error) {
+	res, err := ch.rx.Get(ctx)
+	if res != nil && (res.Err() != nil || ch.rx.Closed()) {
+		ch.finish(res.Err())
+	}
+	return res, err
+}
+
+func (ch *channel) finish(err error) {
+	ch.finishOnce.Do(func() {
+		if err != nil {
+			ch.traceFailed(err)
+		}
+		ch.traceFinished()
+		close(ch.finished)
+	})
+}
+
+// watch cancels the call when ctx is done or
+// the worker, whose handler has made the call, terminates handlers
+func (ch *channel) watch(ctx context.Context) {
+	done, terminating := ctx.Done(), WorkerTerminating(ctx)
+	if done == nil && terminating == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-done:
+		case <-terminating:
+		case <-ch.finished:
+			return
+		case <-ch.rx.cancelled:
+			return
+		}
+		ch.Close()
+	}()
+}
+
 func (ch *channel) push(res ServiceResult) {
 	ch.traceReceived()
 	ch.rx.push(res)
@@ -41,9 +95,27 @@ func (ch *channel) Call(ctx context.Context, name string, args ...interface{}) e
 	return ch.tx.Call(ctx, name, args...)
 }
 
+func (ch *channel) Close() error {
+	if !ch.rx.cancel() {
+		// already closed
+		return nil
+	}
+
+	ch.tx.service.sessions.Detach(ch.tx.id)
+	ch.finish(nil)
+
+	if !ch.tx.closable() {
+		return nil
+	}
+
+	return ch.Call(context.Background(), "close")
+}
+
 type rx struct {
 	pushBuffer chan ServiceResult
 	rxTree     *streamDescription
+	// closed by Channel.Close
+	cancelled chan struct{}
 
 	sync.Mutex
 	queue []ServiceResult
@@ -51,6 +123,10 @@ type rx struct {
 }
 
 func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
+	if rx.isCancelled() {
+		return nil, ErrChannelCancelled
+	}
+
 	if rx.Closed() {
 		return nil, ErrStreamIsClosed
 	}
@@ -74,6 +150,8 @@ func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
 
 		select {
 		case res = <-rx.pushBuffer:
+		case <-rx.cancelled:
+			return nil, ErrChannelCancelled
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		}
@@ -95,25 +173,39 @@ func (rx *rx) Get(ctx context.Context) (ServiceResult, error) {
 	// allow to attach various protocols
 	switch temp.Name {
 	case "error":
-		var (
-			catAndCode [2]int
-			message    string
-		)
-
-		if err := res.ExtractTuple(&catAndCode, &message); err != nil {
+		_, payload, _ := res.Result()
+		perr, err := decodeErrorPayload(payload)
+		if err != nil {
 			return res, err
 		}
 
-		res.setError(&ErrRequest{
-			Message:  message,
-			Category: catAndCode[0],
-			Code:     catAndCode[1],
-		})
+		res.setError(perr)
 	}
 
 	return res, nil
 }
 
+// cancel returns false if rx has been already cancelled
+func (rx *rx) cancel() bool {
+	rx.Lock()
+	defer rx.Unlock()
+
+	if rx.isCancelled() {
+		return false
+	}
+	close(rx.cancelled)
+	return true
+}
+
+func (rx *rx) isCancelled() bool {
+	select {
+	case <-rx.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
 func (rx *rx) Closed() bool {
 	return rx.done
 }
@@ -131,14 +223,33 @@ func (rx *rx) push(res ServiceResult) {
 
 type tx struct {
 	service *Service
-	txTree  *streamDescription
 	id      uint64
-	done    bool
+
+	// Close may be called by watch concurrently with Call
+	mu     sync.Mutex
+	txTree *streamDescription
+	done   bool
 
 	headers CocaineHeaders
 }
 
+// closable returns true if the protocol allows to close the stream
+func (tx *tx) closable() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done || tx.txTree == nil {
+		return false
+	}
+
+	_, err := tx.txTree.MethodByName("close")
+	return err == nil
+}
+
 func (tx *tx) Call(ctx context.Context, name string, args ...interface{}) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
 	if tx.done {
 		return fmt.Errorf("tx is done")
 	}
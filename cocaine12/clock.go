@@ -0,0 +1,170 @@
+package cocaine12
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock creates all timers of the worker: heartbeat, disown,
+// terminate grace period and per session deadline and idle ones.
+// It is replaced by FakeClock in tests, see WithClock
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine once d elapses.
+	// C of the returned Timer is nil
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock. It behaves like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// FakeClock is a Clock for tests. Its time moves only by Advance,
+// so timers of the worker fire without sleeping.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+	// timers which have not fired or been stopped yet
+	timers map[*fakeTimer]struct{}
+}
+
+// NewFakeClock creates a clock stopped at the Unix epoch
+func NewFakeClock() *FakeClock {
+	return &FakeClock{
+		now:    time.Unix(0, 0),
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+// Now returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer, which fires once the clock
+// is advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule(t, d)
+	return t
+}
+
+// AfterFunc creates a timer, which calls f in its own goroutine
+// once the clock is advanced by d
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{
+		clock: c,
+		fn:    f,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule(t, d)
+	return t
+}
+
+// Advance moves the time forward and fires expired timers
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			c.fire(t)
+		}
+	}
+}
+
+// schedule must be called under the lock
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = c.now.Add(d)
+	if d <= 0 {
+		c.fire(t)
+		return
+	}
+	c.timers[t] = struct{}{}
+}
+
+// fire must be called under the lock
+func (c *FakeClock) fire(t *fakeTimer) {
+	delete(c.timers, t)
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+
+	// like time.Timer the channel keeps a single value
+	select {
+	case t.c <- c.now:
+	default:
+	}
+}
+
+// stop must be called under the lock
+func (c *FakeClock) stop(t *fakeTimer) bool {
+	_, active := c.timers[t]
+	delete(c.timers, t)
+	return active
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	fn       func()
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	return t.clock.stop(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	active := t.clock.stop(t)
+	t.clock.schedule(t, d)
+	return active
+}
@@ -0,0 +1,154 @@
+package cocaine12
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fired(timer Timer) bool {
+	select {
+	case <-timer.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock()
+	timer := clock.NewTimer(time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+	assert.False(t, fired(timer))
+	clock.Advance(time.Millisecond)
+	assert.True(t, fired(timer))
+	assert.False(t, timer.Stop(), "the timer has fired already")
+
+	assert.False(t, timer.Reset(time.Second))
+	assert.True(t, timer.Stop())
+	clock.Advance(time.Hour)
+	assert.False(t, fired(timer), "a stopped timer must not fire")
+
+	timer.Reset(0)
+	assert.True(t, fired(timer))
+}
+
+func TestFakeClockAfterFunc(t *testing.T) {
+	clock := NewFakeClock()
+	called := make(chan time.Time, 1)
+	timer := clock.AfterFunc(time.Second, func() {
+		called <- clock.Now()
+	})
+	assert.Nil(t, timer.C())
+
+	clock.Advance(time.Second)
+	select {
+	case now := <-called:
+		assert.Equal(t, time.Unix(1, 0), now)
+	case <-time.After(time.Second):
+		t.Fatal("the function has not been called")
+	}
+	assert.False(t, timer.Stop())
+}
+
+func TestWorkerAdvanceClockDisown(t *testing.T) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	runtime, _ := newAsyncRW(in)
+
+	w, err := NewWorkerWithOptions(
+		WithConnection(sock),
+		WithClock(NewFakeClock()),
+		WithTimeouts(TimeoutConfig{
+			Heartbeat: time.Minute,
+			Disown:    time.Hour,
+		}),
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer w.Stop()
+
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.Run(nil)
+	}()
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	// the heartbeat is never replied
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+
+	assert.NoError(t, w.AdvanceClock(time.Hour))
+	select {
+	case err := <-onStop:
+		assert.Equal(t, ErrDisowned, err)
+	case <-time.After(time.Second):
+		t.Fatal("the worker has not been disowned")
+	}
+}
+
+func TestWorkerAdvanceClockRealClock(t *testing.T) {
+	w, _ := newTestWorker(t)
+	defer w.Stop()
+
+	assert.Equal(t, ErrNoFakeClock, w.AdvanceClock(time.Second))
+}
+
+func TestWorkerAdvanceClockRequestIdle(t *testing.T) {
+	const testSession = 10
+
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	runtime, _ := newAsyncRW(in)
+
+	w, err := NewWorkerWithOptions(
+		WithConnection(sock),
+		WithClock(NewFakeClock()),
+		WithTimeouts(TimeoutConfig{
+			Heartbeat:   time.Hour,
+			Disown:      time.Hour,
+			RequestIdle: time.Minute,
+		}),
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer w.Stop()
+
+	started := make(chan struct{})
+	readErr := make(chan error, 1)
+	w.On("upload", func(ctx context.Context, req Request, res Response) {
+		close(started)
+		_, err := req.Read(ctx)
+		readErr <- err
+	})
+
+	go w.Run(nil)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+
+	runtime.Write() <- newInvokeV1(testSession, "upload")
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("the handler has not been started")
+	}
+
+	// the client stalls without sending a chunk
+	assert.NoError(t, w.AdvanceClock(time.Minute))
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorRequestIdleTimeout, code)
+
+	select {
+	case err := <-readErr:
+		if perr, ok := err.(*ErrRequest); assert.True(t, ok, "unexpected error %v", err) {
+			assert.Equal(t, ErrorRequestIdleTimeout, perr.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read has not returned")
+	}
+}
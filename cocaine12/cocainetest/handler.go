@@ -0,0 +1,88 @@
+package cocainetest
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cocaine/cocaine-framework-go/cocaine12"
+)
+
+// CancelGrace is the time given to a handler to return
+// after its context has been cancelled by RunHandlerWithCancel
+var CancelGrace = time.Second
+
+// ErrCancelIgnored means that a handler has not returned
+// within CancelGrace after its context had been cancelled
+var ErrCancelIgnored = errors.New("the handler has ignored the cancellation")
+
+// RecordedResponse is a reply of a handler run by RunHandlerWithCancel.
+// It is recorded like a reply of cocaine12.Worker.InvokeLocal
+type RecordedResponse struct {
+	cocaine12.RecordedResponse
+	// Cancelled reports whether the context had been cancelled
+	// before the handler returned
+	Cancelled bool
+}
+
+func newRecordedResponse(resp *Response, cancelled bool) *RecordedResponse {
+	recorded := &RecordedResponse{
+		RecordedResponse: cocaine12.RecordedResponse{
+			Body:     resp.Bytes(),
+			Closed:   resp.closed,
+			Progress: resp.Progress,
+		},
+		Cancelled: cancelled,
+	}
+
+	if resp.Err != nil {
+		recorded.Err = &cocaine12.ErrRequest{
+			Message: resp.Err.Msg,
+			Code:    resp.Err.Code,
+		}
+		recorded.RetryAfter = resp.Err.RetryAfter
+	}
+	return recorded
+}
+
+// RunHandlerWithCancel invokes a handler with a request of given chunks
+// and cancels its context after cancelAfter. It returns ErrCancelIgnored
+// if the handler keeps running for CancelGrace after the cancellation.
+func RunHandlerWithCancel(h cocaine12.EventHandler, chunks [][]byte, cancelAfter time.Duration) (*RecordedResponse, error) {
+	req := NewRequest()
+	for _, chunk := range chunks {
+		req.Write(chunk)
+	}
+	resp := NewResponse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h(ctx, req, resp)
+	}()
+
+	cancelTimer := time.NewTimer(cancelAfter)
+	defer cancelTimer.Stop()
+
+	select {
+	case <-done:
+		return newRecordedResponse(resp, false), nil
+	case <-cancelTimer.C:
+		cancel()
+	}
+
+	graceTimer := time.NewTimer(CancelGrace)
+	defer graceTimer.Stop()
+
+	select {
+	case <-done:
+		return newRecordedResponse(resp, true), nil
+	case <-graceTimer.C:
+		// the handler still owns the response,
+		// so it can not be returned
+		return nil, ErrCancelIgnored
+	}
+}
@@ -0,0 +1,69 @@
+package cocainetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cocaine/cocaine-framework-go/cocaine12"
+)
+
+func slowEcho(ctx context.Context, req cocaine12.Request, resp cocaine12.Response) {
+	data, err := req.Read(ctx)
+	if err != nil {
+		resp.ErrorMsg(100, err.Error())
+		return
+	}
+
+	select {
+	case <-time.After(time.Millisecond * 100):
+		resp.Write(data)
+		resp.Close()
+	case <-ctx.Done():
+		resp.ErrorMsg(100, ctx.Err().Error())
+	}
+}
+
+func TestRunHandlerWithCancel(t *testing.T) {
+	resp, err := RunHandlerWithCancel(slowEcho, [][]byte{[]byte("PING")}, time.Millisecond*10)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, resp.Cancelled)
+	assert.Empty(t, resp.Body)
+	assert.True(t, resp.Closed)
+	if assert.NotNil(t, resp.Err) {
+		assert.Equal(t, context.Canceled.Error(), resp.Err.Message)
+	}
+
+	resp, err = RunHandlerWithCancel(slowEcho, [][]byte{[]byte("PING")}, time.Second)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.False(t, resp.Cancelled)
+	assert.Equal(t, []byte("PING"), resp.Body)
+	assert.True(t, resp.Closed)
+	assert.Nil(t, resp.Err)
+}
+
+func TestRunHandlerWithCancelIgnored(t *testing.T) {
+	defer func(grace time.Duration) {
+		CancelGrace = grace
+	}(CancelGrace)
+	CancelGrace = time.Millisecond * 10
+
+	finished := make(chan struct{})
+	defer func() {
+		<-finished
+	}()
+
+	resp, err := RunHandlerWithCancel(func(ctx context.Context, req cocaine12.Request, resp cocaine12.Response) {
+		defer close(finished)
+		time.Sleep(time.Millisecond * 100)
+		resp.Close()
+	}, nil, time.Millisecond*10)
+	assert.Equal(t, ErrCancelIgnored, err)
+	assert.Nil(t, resp)
+}
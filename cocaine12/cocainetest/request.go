@@ -2,10 +2,15 @@ package cocainetest
 
 import (
 	"context"
+	"time"
+
+	"github.com/ugorji/go/codec"
 
 	cocaine "github.com/cocaine/cocaine-framework-go/cocaine12"
 )
 
+var mh codec.MsgpackHandle
+
 type Request struct {
 	chunks [][]byte
 }
@@ -31,3 +36,22 @@ func (r *Request) Read(ctx context.Context) (chunk []byte, err error) {
 	chunk, r.chunks = r.chunks[0], r.chunks[1:]
 	return
 }
+
+// ReadAll returns the rest of chunks concatenated.
+// The request is never blocked, so the timeout is ignored.
+func (r *Request) ReadAll(ctx context.Context, timeout ...time.Duration) ([]byte, error) {
+	var data []byte
+	for _, chunk := range r.chunks {
+		data = append(data, chunk...)
+	}
+	r.chunks = r.chunks[:0]
+	return data, nil
+}
+
+func (r *Request) RawAndDecode(ctx context.Context, v interface{}) ([]byte, error) {
+	raw, err := r.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return raw, codec.NewDecoderBytes(raw, &mh).Decode(v)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"syscall"
+	"time"
 
 	"github.com/cocaine/cocaine-framework-go/cocaine12"
 )
@@ -12,11 +13,15 @@ type Response struct {
 	*bytes.Buffer
 	closed bool
 	Err    *CocaineError
+	// Progress contains all reported progress values
+	Progress []float64
 }
 
 type CocaineError struct {
 	Msg  string
 	Code int
+	// RetryAfter is the hint sent by RetryableError
+	RetryAfter time.Duration
 }
 
 var _ cocaine12.Response = NewResponse()
@@ -54,3 +59,29 @@ func (r *Response) ErrorMsg(code int, msg string) error {
 	}
 	return r.Close()
 }
+
+func (r *Response) RetryableError(code int, msg string, retryAfter time.Duration) error {
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+
+	r.Err = &CocaineError{
+		Msg:        msg,
+		Code:       code,
+		RetryAfter: retryAfter,
+	}
+	return r.Close()
+}
+
+func (r *Response) SetProgress(pct float64) error {
+	if pct < 0 || pct > 100 {
+		return cocaine12.ErrInvalidProgress
+	}
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+
+	r.Progress = append(r.Progress, pct)
+	return nil
+}
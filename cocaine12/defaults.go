@@ -138,3 +138,49 @@ func newDefaults(args []string, setname string) *defaultValues {
 
 	return values
 }
+
+// WorkerConfig is the runtime configuration provided
+// by Cocaine-Runtime to the worker
+type WorkerConfig struct {
+	ApplicationName string
+	// Endpoint is the unix socket path to connect to Cocaine-Runtime
+	Endpoint string
+	UUID     string
+	Protocol int
+	// Locators are default endpoints of locators
+	Locators []string
+	DC       string
+	Debug    bool
+	Token    Token
+	// ReadBufferSize is the size of the buffer used to read
+	// from the connection. A buffer larger than usual messages
+	// reduces the number of reads. 0 means the default size
+	ReadBufferSize int
+}
+
+// LoadWorkerConfig returns the configuration of the worker
+// parsed from the command line and the environment.
+// It returns ErrNoCocaineEndpoint if the endpoint is not provided,
+// as the worker is unable to connect to Cocaine-Runtime without it
+func LoadWorkerConfig() (WorkerConfig, error) {
+	return newWorkerConfig(GetDefaults())
+}
+
+func newWorkerConfig(values DefaultValues) (WorkerConfig, error) {
+	config := WorkerConfig{
+		ApplicationName: values.ApplicationName(),
+		Endpoint:        values.Endpoint(),
+		UUID:            values.UUID(),
+		Protocol:        values.Protocol(),
+		Locators:        append([]string(nil), values.Locators()...),
+		DC:              values.DC(),
+		Debug:           values.Debug(),
+		Token:           values.Token(),
+	}
+
+	if config.Endpoint == "" {
+		return config, ErrNoCocaineEndpoint
+	}
+
+	return config, nil
+}
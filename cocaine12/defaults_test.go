@@ -44,3 +44,21 @@ func TestParseToken(t *testing.T) {
 	assert.Equal(t, "TVM", def.Token().Type(), "invalid token type")
 	assert.Equal(t, "very_secret", def.Token().Body(), "invalid token body")
 }
+
+func TestWorkerConfig(t *testing.T) {
+	args := []string{"--app", "echo",
+		"--locator", "host1:10053,127.0.0.1:10054",
+		"--uuid", "uuid", "--protocol", "1",
+		"--endpoint", "/var/run/cocaine/sock"}
+	config, err := newWorkerConfig(newDefaults(args, "test"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo", config.ApplicationName)
+	assert.Equal(t, "/var/run/cocaine/sock", config.Endpoint)
+	assert.Equal(t, "uuid", config.UUID)
+	assert.Equal(t, 1, config.Protocol)
+	assert.Equal(t, []string{"host1:10053", "127.0.0.1:10054"}, config.Locators)
+	assert.Equal(t, "global", config.DC)
+
+	_, err = newWorkerConfig(newDefaults([]string{}, "test"))
+	assert.Equal(t, ErrNoCocaineEndpoint, err)
+}
@@ -0,0 +1,42 @@
+package cocaine12
+
+// DuplicateSessionPolicy defines how the worker behaves when
+// cocaine-runtime sends an invoke with the id of an active session
+type DuplicateSessionPolicy int
+
+const (
+	// DuplicateReject replies to the new invoke with ErrorDuplicateSession.
+	// The active session keeps running
+	DuplicateReject DuplicateSessionPolicy = iota
+	// DuplicateReplace terminates the active session with ErrorDuplicateSession,
+	// cancels the context of its handler and starts the new one
+	DuplicateReplace
+)
+
+// onDuplicateInvoke handles an invoke, which reuses the id of an active
+// session. It reports whether the invoke should be started
+func (w *WorkerNG) onDuplicateInvoke(msg *Message) bool {
+	active := w.sessions[msg.Session]
+
+	w.logWithFields(Fields{
+		"session": msg.Session,
+		"event":   active.event,
+		"policy":  w.duplicateSessionPolicy,
+	}).Warnf("invoke for an active session: %s", msg.String())
+	w.metrics.IncProtocolAnomaly(AnomalyDuplicateSession)
+
+	if w.duplicateSessionPolicy != DuplicateReplace {
+		// the id still belongs to the active session,
+		// so it is not abandoned
+		event, _ := getEventName(msg)
+		response := w.newRejectResponse(msg.Session, event)
+		response.ErrorMsg(ErrorDuplicateSession, "the session is already active")
+		return false
+	}
+
+	w.terminateSession(msg.Session, ErrorDuplicateSession, "the session has been replaced by a new invoke")
+	active.cancel()
+	// the id belongs to the new session now
+	delete(w.abandonedSessions, msg.Session)
+	return true
+}
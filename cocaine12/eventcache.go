@@ -0,0 +1,231 @@
+package cocaine12
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// eventCache keeps responses of an idempotent event,
+// so identical requests are served without running the handler
+type eventCache struct {
+	keyFn func(Request) string
+	ttl   time.Duration
+	// the clock of the worker, which expires entries
+	clock Clock
+	// builds recorded frames
+	frames handlerProtocolGenerator
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	// chunks, progress and the close in the order of the handler
+	frames  []*Message
+	expires time.Time
+}
+
+func newEventCache(keyFn func(Request) string, ttl time.Duration, clock Clock) *eventCache {
+	return &eventCache{
+		keyFn:   keyFn,
+		ttl:     ttl,
+		clock:   clock,
+		frames:  newV1Protocol(),
+		entries: make(map[string]cachedResponse),
+	}
+}
+
+func (c *eventCache) get(key string) ([]*Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if c.clock.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.frames, true
+}
+
+func (c *eventCache) put(key string, frames []*Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	// drop expired entries, which are never requested again
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cachedResponse{
+		frames:  frames,
+		expires: now.Add(c.ttl),
+	}
+}
+
+// serve replies from the cache or runs the handler and caches its response.
+// A response is cached if the handler has closed it without an error.
+// The worker terminates a session through the response it has passed,
+// so the response is not cached if the context is done either.
+// An empty key means the request must not be cached
+func (c *eventCache) serve(ctx context.Context, req Request, res Response, handler EventHandler) {
+	buffered := &bufferedRequest{source: req}
+	request := hookRead(req, buffered.read)
+	key := c.keyFn(request)
+	buffered.replay = true
+
+	if key == "" {
+		handler(ctx, request, res)
+		return
+	}
+
+	if frames, ok := c.get(key); ok {
+		replayFrames(frames, res)
+		return
+	}
+
+	recording := &recordingResponse{
+		Response: res,
+		frames:   c.frames,
+	}
+	handler(ctx, request, recording)
+
+	if frames, ok := recording.result(); ok && ctx.Err() == nil {
+		c.put(key, frames)
+	}
+}
+
+// replayFrames sends recorded frames to a client
+// like the handler has sent them, the last one is the close
+func replayFrames(frames []*Message, res Response) {
+	for _, frame := range frames {
+		switch frame.MsgType {
+		case v1Write:
+			res.Write(frame.Payload[0].([]byte))
+		case v1Progress:
+			res.SetProgress(frame.Payload[0].(float64))
+		case v1Close:
+			res.Close()
+		}
+	}
+}
+
+// bufferedRequest keeps chunks read by a cache key function,
+// so the handler reads them again
+type bufferedRequest struct {
+	source Request
+	chunks [][]byte
+	// set once the key is calculated
+	replay bool
+}
+
+func (r *bufferedRequest) read(ctx context.Context) ([]byte, error) {
+	if r.replay && len(r.chunks) > 0 {
+		chunk := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		return chunk, nil
+	}
+
+	data, err := r.source.Read(ctx)
+	if err == nil && !r.replay {
+		r.chunks = append(r.chunks, data)
+	}
+	return data, err
+}
+
+// recordingResponse passes replies to a client
+// and records the frames to replay them from the cache
+type recordingResponse struct {
+	Response
+	frames handlerProtocolGenerator
+
+	mu       sync.Mutex
+	recorded []*Message
+	// set if the client has got an error or
+	// a frame has not been sent
+	failed bool
+	// set once the handler has closed the response
+	closed bool
+}
+
+func (r *recordingResponse) Write(data []byte) (int, error) {
+	n, err := r.Response.Write(data)
+	r.recordChunk(data, err)
+	return n, err
+}
+
+func (r *recordingResponse) ZeroCopyWrite(data []byte) error {
+	err := r.Response.ZeroCopyWrite(data)
+	r.recordChunk(data, err)
+	return err
+}
+
+// recordChunk copies data, as the caller may reuse the buffer
+func (r *recordingResponse) recordChunk(data []byte, err error) {
+	r.record(r.frames.newChunk(localSession, append([]byte(nil), data...)), err)
+}
+
+func (r *recordingResponse) Close() error {
+	err := r.Response.Close()
+	r.record(r.frames.newChoke(localSession), err)
+	if err == nil {
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *recordingResponse) SetProgress(pct float64) error {
+	err := r.Response.SetProgress(pct)
+	r.record(r.frames.newProgress(localSession, pct), err)
+	return err
+}
+
+func (r *recordingResponse) ErrorMsg(code int, message string) error {
+	r.fail()
+	return r.Response.ErrorMsg(code, message)
+}
+
+func (r *recordingResponse) RetryableError(code int, message string, retryAfter time.Duration) error {
+	r.fail()
+	return r.Response.RetryableError(code, message, retryAfter)
+}
+
+// record keeps the frame if it has been sent to a client,
+// otherwise the response is incomplete and must not be cached
+func (r *recordingResponse) record(frame *Message, err error) {
+	if err != nil {
+		r.fail()
+		return
+	}
+
+	r.mu.Lock()
+	r.recorded = append(r.recorded, frame)
+	r.mu.Unlock()
+}
+
+func (r *recordingResponse) fail() {
+	r.mu.Lock()
+	r.failed = true
+	r.mu.Unlock()
+}
+
+// result returns the recorded frames,
+// if the response may be served from the cache
+func (r *recordingResponse) result() ([]*Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failed || !r.closed {
+		return nil, false
+	}
+	return append([]*Message(nil), r.recorded...), true
+}
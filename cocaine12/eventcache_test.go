@@ -0,0 +1,194 @@
+package cocaine12
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerEventCache(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var calls int32
+	w.SetEventCache("get", func(req Request) string {
+		key, _ := req.Read(context.Background())
+		return string(key)
+	}, time.Minute)
+	w.On("get", func(ctx context.Context, req Request, res Response) {
+		atomic.AddInt32(&calls, 1)
+		key, err := req.Read(ctx)
+		if err != nil {
+			res.ErrorMsg(-1, err.Error())
+			return
+		}
+		if string(key) == "missing" {
+			res.ErrorMsg(404, "not found")
+			return
+		}
+		res.Write(append([]byte("value of "), key...))
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	request := func(session uint64, key string) {
+		runtime.Write() <- newInvokeV1(session, "get")
+		runtime.Write() <- newChunkV1(session, []byte(key))
+		runtime.Write() <- newChokeV1(session)
+	}
+
+	for session := uint64(2); session < 4; session++ {
+		request(session, "a")
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Write)
+		assert.Equal(t, []byte("value of a"), msg.Payload[0])
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Close)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "the second request must be served from the cache")
+
+	request(4, "b")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 4, v1Write)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 4, v1Close)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// errors are not cached
+	for session := uint64(5); session < 7; session++ {
+		request(session, "missing")
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Error)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestWorkerEventCacheReplaysFrames(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var calls int32
+	w.SetEventCache("get", func(req Request) string {
+		return "key"
+	}, time.Minute)
+	w.On("get", func(ctx context.Context, req Request, res Response) {
+		atomic.AddInt32(&calls, 1)
+		res.Write([]byte("first"))
+		res.SetProgress(50)
+		res.Write([]byte("second"))
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	for session := uint64(2); session < 4; session++ {
+		runtime.Write() <- newInvokeV1(session, "get")
+		runtime.Write() <- newChokeV1(session)
+
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Write)
+		assert.Equal(t, []byte("first"), msg.Payload[0])
+
+		msg = readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Write)
+		assert.Equal(t, []byte("second"), msg.Payload[0])
+		pct, ok := msg.Headers.Progress()
+		assert.True(t, ok, "the progress must be replayed")
+		assert.Equal(t, 50.0, pct)
+
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Close)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "the second request must be served from the cache")
+}
+
+func TestWorkerEventCacheTerminatedSession(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var calls int32
+	w.SetEventCache("get", func(req Request) string {
+		return "key"
+	}, time.Minute)
+	w.OnWithTimeout("get", func(ctx context.Context, req Request, res Response) {
+		atomic.AddInt32(&calls, 1)
+		res.Write([]byte("partial"))
+		// the worker replies with ErrorHandlerTimeout
+		<-ctx.Done()
+	}, 20*time.Millisecond)
+	runTestWorker(t, w, runtime)
+
+	for session := uint64(2); session < 4; session++ {
+		// the request stream is left open, so the session is in flight
+		runtime.Write() <- newInvokeV1(session, "get")
+
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Write)
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Error)
+		code, _ := unpackTestError(t, msg)
+		assert.Equal(t, ErrorHandlerTimeout, code)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "a truncated response must not be cached")
+}
+
+func TestEventCacheExpiration(t *testing.T) {
+	clock := NewFakeClock()
+	cache := newEventCache(func(Request) string { return "key" }, time.Minute, clock)
+	cache.put("key", []*Message{newChunkV1(localSession, []byte("cached"))})
+
+	clock.Advance(time.Minute)
+	frames, ok := cache.get("key")
+	if assert.True(t, ok) && assert.Len(t, frames, 1) {
+		assert.Equal(t, []byte("cached"), frames[0].Payload[0])
+	}
+
+	clock.Advance(time.Nanosecond)
+	_, ok = cache.get("key")
+	assert.False(t, ok)
+}
+
+func TestRecordingResponseCopiesData(t *testing.T) {
+	recording := &recordingResponse{
+		Response: newResponse(newV1Protocol(), localSession, new(responseRecorder), nil),
+		frames:   newV1Protocol(),
+	}
+
+	buf := []byte("first")
+	recording.ZeroCopyWrite(buf)
+	copy(buf, "reuse")
+	recording.Write(buf)
+	copy(buf, "third")
+	recording.Close()
+
+	frames, ok := recording.result()
+	if assert.True(t, ok) && assert.Len(t, frames, 3) {
+		assert.Equal(t, []byte("first"), frames[0].Payload[0])
+		assert.Equal(t, []byte("reuse"), frames[1].Payload[0])
+	}
+}
+
+func TestWorkerSetEventCacheWhileRunning(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var calls int32
+	w.On("get", func(ctx context.Context, req Request, res Response) {
+		atomic.AddInt32(&calls, 1)
+		res.Write([]byte("value"))
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	request := func(session uint64) {
+		runtime.Write() <- newInvokeV1(session, "get")
+		runtime.Write() <- newChokeV1(session)
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Write)
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Close)
+	}
+
+	request(2)
+	w.SetEventCache("get", func(req Request) string {
+		return "key"
+	}, time.Minute)
+	for session := uint64(3); session < 5; session++ {
+		request(session)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "the cache must be applied to the running worker")
+}
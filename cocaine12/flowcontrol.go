@@ -0,0 +1,85 @@
+package cocaine12
+
+import (
+	"sync"
+)
+
+// flowControl bounds the number of bytes of a response,
+// which have been passed to the connection, but are not written yet
+type flowControl struct {
+	sender trackedSender
+	window int64
+	// is closed once the response is closed
+	done chan struct{}
+
+	mu       sync.Mutex
+	inflight []inflightChunk
+	bytes    int64
+}
+
+type inflightChunk struct {
+	size    int64
+	written <-chan struct{}
+}
+
+func newFlowControl(sender trackedSender, window int) *flowControl {
+	return &flowControl{
+		sender: sender,
+		window: int64(window),
+		done:   make(chan struct{}),
+	}
+}
+
+func (f *flowControl) send(msg *Message, size int) {
+	written := f.sender.sendTracked(msg)
+
+	f.mu.Lock()
+	f.inflight = append(f.inflight, inflightChunk{int64(size), written})
+	f.bytes += int64(size)
+	f.mu.Unlock()
+}
+
+// wait blocks while the window is full. It returns early
+// if the worker or the response is closed
+func (f *flowControl) wait(workerClosed <-chan struct{}) {
+	for {
+		oldest, full := f.oldest()
+		if !full {
+			return
+		}
+
+		select {
+		case <-oldest:
+		case <-workerClosed:
+			return
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// oldest forgets written chunks and returns the oldest pending one
+// if the window is full
+func (f *flowControl) oldest() (<-chan struct{}, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.inflight) > 0 && isWritten(f.inflight[0].written) {
+		f.bytes -= f.inflight[0].size
+		f.inflight = f.inflight[1:]
+	}
+
+	if len(f.inflight) == 0 || f.bytes < f.window {
+		return nil, false
+	}
+	return f.inflight[0].written, true
+}
+
+func isWritten(written <-chan struct{}) bool {
+	select {
+	case <-written:
+		return true
+	default:
+		return false
+	}
+}
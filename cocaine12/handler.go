@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type request struct {
@@ -24,6 +26,16 @@ var (
 	ErrStreamIsClosed = errors.New("Stream is closed")
 	// ErrBadPayload means that a message payload is malformed
 	ErrBadPayload = errors.New("payload is not []byte")
+	// ErrInvalidProgress means that a progress is out of range [0, 100]
+	ErrInvalidProgress = errors.New("progress must be in range [0, 100]")
+	// ErrWorkerClosed means that the worker has been disowned or stopped,
+	// so a reply can not be delivered to a client anymore.
+	// A handler should abort on this error
+	ErrWorkerClosed = errors.New("the worker has been closed")
+	// ErrPayloadTooLarge means that a write would exceed the limit
+	// of bytes sent in a session set by Worker.SetMaxPayload
+	// or Worker.SetEventMaxPayload. The data is not sent
+	ErrPayloadTooLarge = errors.New("the payload limit of the session is exceeded")
 	// ErrMalformedErrorMessage means that we receive a corrupted or
 	// unproper message
 	ErrMalformedErrorMessage = &ErrRequest{
@@ -71,29 +83,28 @@ func (request *request) Read(ctx context.Context) ([]byte, error) {
 		}
 
 		// Error message
-		if len(msg.Payload) == 0 {
-			return nil, ErrMalformedErrorMessage
-		}
-
-		var perr struct {
-			CodeInfo [2]int
-			Message  string
-		}
-
-		if err := convertPayload(msg.Payload, &perr); err != nil {
+		perr, err := decodeErrorPayload(msg.Payload)
+		if err != nil {
 			return nil, err
 		}
-
-		return nil, &ErrRequest{
-			Message:  perr.Message,
-			Category: perr.CodeInfo[0],
-			Code:     perr.CodeInfo[1],
-		}
+		return nil, perr
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
+func (request *request) RawAndDecode(ctx context.Context, v interface{}) ([]byte, error) {
+	raw, err := request.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return raw, decodeChunk(raw, v)
+}
+
+func (request *request) ReadAll(ctx context.Context, timeout ...time.Duration) ([]byte, error) {
+	return readAll(ctx, request, timeout)
+}
+
 func (request *request) push(msg *Message) {
 	request.fromWorker <- msg
 }
@@ -106,14 +117,47 @@ type response struct {
 	handlerProtocolGenerator
 	session  uint64
 	toWorker asyncSender
-	closed   bool
+	// is closed when the worker is disowned or stopped
+	workerClosed <-chan struct{}
+
+	// protects closed as a response can be
+	// terminated by the worker
+	mu     sync.Mutex
+	closed bool
+	// set once onClose has been called
+	notified bool
+
+	summary responseSummary
+	// the limit of bytes sent to a client, 0 means no limit
+	maxPayload int64
+	// is called after the response is closed
+	onClose func(responseSummary)
+	// are attached to the first frame sent to a client
+	headers CocaineHeaders
+	// the progress, which is attached to the next frame
+	progress CocaineHeaders
+	// send progress by dedicated frames, see Worker.SetProgressFrames
+	progressFrames bool
+	// bounds chunks, which are not written to the connection yet,
+	// nil means no limit
+	flow *flowControl
+}
+
+// responseSummary describes what has been sent to a client
+type responseSummary struct {
+	bytesOut int64
+	failed   bool
+	category int
+	code     int
+	message  string
 }
 
-func newResponse(h handlerProtocolGenerator, session uint64, toWorker asyncSender) *response {
+func newResponse(h handlerProtocolGenerator, session uint64, toWorker asyncSender, workerClosed <-chan struct{}) *response {
 	response := &response{
 		handlerProtocolGenerator: h,
 		session:                  session,
 		toWorker:                 toWorker,
+		workerClosed:             workerClosed,
 		closed:                   false,
 	}
 
@@ -136,34 +180,82 @@ func (r *response) Write(data []byte) (n int, err error) {
 // ZeroCopyWrite sends data to a client.
 // Response takes the ownership of the buffer, so provided buffer must not be edited.
 func (r *response) ZeroCopyWrite(data []byte) error {
+	if r.flow != nil {
+		// it must not hold the lock, as the worker
+		// may close the response meanwhile
+		r.flow.wait(r.workerClosed)
+	}
+
+	r.mu.Lock()
+	defer r.unlock()
+
+	if r.abortIfWorkerClosed(ErrorWorkerTerminating, "the worker has been closed") {
+		return ErrWorkerClosed
+	}
+
 	if r.isClosed() {
 		return io.ErrClosedPipe
 	}
 
-	r.toWorker.Send(r.newChunk(r.session, data))
+	if r.maxPayload > 0 && r.summary.bytesOut+int64(len(data)) > r.maxPayload {
+		return ErrPayloadTooLarge
+	}
+
+	r.summary.bytesOut += int64(len(data))
+	if r.flow != nil {
+		msg := r.newChunk(r.session, data)
+		r.attachHeaders(msg)
+		r.flow.send(msg, len(data))
+		return nil
+	}
+	r.send(r.newChunk(r.session, data))
 	return nil
 }
 
 // Notify a client about finishing the datastream.
 func (r *response) Close() error {
+	r.mu.Lock()
+	defer r.unlock()
+
+	if r.abortIfWorkerClosed(ErrorWorkerTerminating, "the worker has been closed") {
+		return ErrWorkerClosed
+	}
+
 	if r.isClosed() {
 		// we treat it as a network connection
 		return syscall.EINVAL
 	}
 
 	r.close()
-	r.toWorker.Send(r.newChoke(r.session))
+	r.send(r.newChoke(r.session))
 	return nil
 }
 
 // Send error to a client. Specify code and message, which describes this error.
 func (r *response) ErrorMsg(code int, message string) error {
+	return r.errorMsg(code, message, nil)
+}
+
+// RetryableError sends error to a client with a hint when to retry the request.
+func (r *response) RetryableError(code int, message string, retryAfter time.Duration) error {
+	return r.errorMsg(code, message, retryAfterHeaders(retryAfter))
+}
+
+func (r *response) errorMsg(code int, message string, headers CocaineHeaders) error {
+	r.mu.Lock()
+	defer r.unlock()
+
+	if r.abortIfWorkerClosed(code, message) {
+		return ErrWorkerClosed
+	}
+
 	if r.isClosed() {
 		return io.ErrClosedPipe
 	}
 
 	r.close()
-	r.toWorker.Send(r.newError(
+	r.fail(code, message)
+	msg := r.newError(
 		// current session number
 		r.session,
 		// category
@@ -172,18 +264,113 @@ func (r *response) ErrorMsg(code int, message string) error {
 		code,
 		// error message
 		message,
-	))
+	)
+	msg.Headers = headers
+	r.send(msg)
+	return nil
+}
+
+func (r *response) SetProgress(pct float64) error {
+	if pct < 0 || pct > 100 {
+		return ErrInvalidProgress
+	}
+
+	r.mu.Lock()
+	defer r.unlock()
+
+	if r.abortIfWorkerClosed(ErrorWorkerTerminating, "the worker has been closed") {
+		return ErrWorkerClosed
+	}
+
+	if r.isClosed() {
+		return io.ErrClosedPipe
+	}
+
+	if r.progressFrames {
+		r.send(r.newProgress(r.session, pct))
+		return nil
+	}
+
+	// the latest value replaces one, which has not been sent yet
+	r.progress = progressHeaders(pct)
 	return nil
 }
 
+// send passes msg to the worker. Pending headers are attached
+// to the first message, the pending progress to the next one. It must be called under the lock
+func (r *response) send(msg *Message) {
+	r.attachHeaders(msg)
+	r.toWorker.Send(msg)
+}
+
+func (r *response) attachHeaders(msg *Message) {
+	if len(r.headers) > 0 {
+		msg.Headers = append(msg.Headers, r.headers...)
+		r.headers = nil
+	}
+	if len(r.progress) > 0 {
+		msg.Headers = append(msg.Headers, r.progress...)
+		r.progress = nil
+	}
+}
+
 func (r *response) close() {
 	r.closed = true
+	if r.flow != nil {
+		close(r.flow.done)
+	}
+}
+
+// bytesOut returns the number of bytes sent to a client so far
+func (r *response) bytesOut() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.summary.bytesOut
 }
 
 func (r *response) isClosed() bool {
 	return r.closed
 }
 
+// abortIfWorkerClosed reports whether the worker has been closed.
+// Nothing can be delivered to a client in this case, so the response
+// is closed as failed with code and message. It must be called under the lock
+func (r *response) abortIfWorkerClosed(code int, message string) bool {
+	select {
+	case <-r.workerClosed:
+	default:
+		return false
+	}
+
+	if !r.isClosed() {
+		r.close()
+		r.fail(code, message)
+	}
+	return true
+}
+
+// fail records the error which has finished the response
+func (r *response) fail(code int, message string) {
+	r.summary.failed = true
+	r.summary.category = cworkererrorcategory
+	r.summary.code = code
+	r.summary.message = message
+}
+
+// unlock releases the lock and calls onClose once the response
+// has been closed. The callback is called without the lock,
+// as it may block or use the response
+func (r *response) unlock() {
+	notify := r.closed && !r.notified
+	r.notified = r.closed
+	summary := r.summary
+	r.mu.Unlock()
+
+	if notify && r.onClose != nil {
+		r.onClose(summary)
+	}
+}
+
 func loop(input <-chan *Message, output chan *Message, onclose <-chan struct{}) {
 	defer close(output)
 
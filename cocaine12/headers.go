@@ -0,0 +1,217 @@
+package cocaine12
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeadersValue is the key of invoke headers in a handler context
+const HeadersValue = "cocaine.headers"
+
+// RetryAfterHeader is the name of the header of an error frame,
+// which carries the number of seconds a client should wait
+// before retrying the request like Retry-After of HTTP
+const RetryAfterHeader = "retry-after"
+
+// ChunkContinuedHeader is the name of the header of a chunk, which
+// is followed by the next part of the same message. Its value is "true"
+// or "1". The last part is a chunk without the header or with another value.
+// The parts are joined by the worker if Worker.SetChunkReassembly is enabled
+const ChunkContinuedHeader = "chunk-continued"
+
+// ProgressHeader is the name of the header, which carries the progress
+// of a request in percents set by Response.SetProgress.
+// It is attached to the next frame of the response
+const ProgressHeader = "progress"
+
+// RequestIDHeader is the name of the header, which carries the id
+// of a request. A client may set it in an invoke, otherwise the worker
+// generates one. The id is echoed in the first frame of the response
+// if Worker.SetRequestIDEcho is enabled
+const RequestIDHeader = "request-id"
+
+// RequestIDValue is the key of the request id in a handler context,
+// use GetRequestID to read it
+const RequestIDValue = "cocaine.request_id"
+
+// GetHeaders returns headers of the invoke which has started the handler.
+// It returns nil if ctx has no headers attached
+func GetHeaders(ctx context.Context) CocaineHeaders {
+	if val, ok := ctx.Value(HeadersValue).(CocaineHeaders); ok {
+		return val
+	}
+	return nil
+}
+
+func attachHeaders(ctx context.Context, headers CocaineHeaders) context.Context {
+	return context.WithValue(ctx, HeadersValue, headers)
+}
+
+// GetRequestID returns the id of the request, which has started the handler.
+// It returns an empty string if ctx has no id attached
+func GetRequestID(ctx context.Context) string {
+	switch val := ctx.Value(RequestIDValue).(type) {
+	case *requestID:
+		return val.String()
+	case string:
+		return val
+	}
+	return ""
+}
+
+func attachRequestID(ctx context.Context, id *requestID) context.Context {
+	return context.WithValue(ctx, RequestIDValue, id)
+}
+
+// requestID is the id sent by a client in RequestIDHeader,
+// the trace id if the request is traced or a random one.
+// The random id is generated on the first use,
+// as most requests never ask for it
+type requestID struct {
+	once sync.Once
+	id   string
+}
+
+func newRequestID(headers CocaineHeaders) *requestID {
+	r := new(requestID)
+	if id, ok := headers.RequestID(); ok && id != "" {
+		r.set(id)
+	} else if traceInfo, err := headers.getTraceData(); err == nil {
+		r.set(fmt.Sprintf("%x", traceInfo.Trace))
+	}
+	return r
+}
+
+func (r *requestID) set(id string) {
+	r.once.Do(func() {
+		r.id = id
+	})
+}
+
+func (r *requestID) String() string {
+	r.once.Do(func() {
+		r.id = randomRequestID()
+	})
+	return r.id
+}
+
+func randomRequestID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// the system source of randomness is broken,
+		// the id only has to differ from the previous one
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Get returns the value of the first header with the given name.
+// Only headers with a literal name are looked up,
+// as indexed ones refer to the table of runtime.
+func (h CocaineHeaders) Get(name string) (string, bool) {
+	for _, header := range h {
+		// [is_indexed, name, value]
+		fields, ok := header.([]interface{})
+		if !ok || len(fields) != 3 {
+			continue
+		}
+
+		if key, ok := headerString(fields[1]); !ok || key != name {
+			continue
+		}
+
+		if value, ok := headerString(fields[2]); ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+func headerString(field interface{}) (string, bool) {
+	switch t := field.(type) {
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	default:
+		return "", false
+	}
+}
+
+// RetryAfter returns the hint set by Response.RetryableError
+func (h CocaineHeaders) RetryAfter() (time.Duration, bool) {
+	value, ok := h.Get(RetryAfterHeader)
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// ChunkContinued reports whether a chunk is followed
+// by the next part of the same message, see ChunkContinuedHeader
+func (h CocaineHeaders) ChunkContinued() bool {
+	value, ok := h.Get(ChunkContinuedHeader)
+	if !ok {
+		return false
+	}
+
+	continued, err := strconv.ParseBool(value)
+	return err == nil && continued
+}
+
+// Progress returns the value set by Response.SetProgress
+func (h CocaineHeaders) Progress() (float64, bool) {
+	value, ok := h.Get(ProgressHeader)
+	if !ok {
+		return 0, false
+	}
+
+	pct, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pct, true
+}
+
+// RequestID returns the id of a request, see RequestIDHeader
+func (h CocaineHeaders) RequestID() (string, bool) {
+	return h.Get(RequestIDHeader)
+}
+
+// retryAfterSeconds formats the hint rounded up to seconds
+func retryAfterSeconds(retryAfter time.Duration) string {
+	seconds := (retryAfter + time.Second - 1) / time.Second
+	if seconds < 0 {
+		seconds = 0
+	}
+	return strconv.FormatInt(int64(seconds), 10)
+}
+
+func retryAfterHeaders(retryAfter time.Duration) CocaineHeaders {
+	return CocaineHeaders{
+		[]interface{}{false, RetryAfterHeader, retryAfterSeconds(retryAfter)},
+	}
+}
+
+func progressHeaders(pct float64) CocaineHeaders {
+	return CocaineHeaders{
+		[]interface{}{false, ProgressHeader, strconv.FormatFloat(pct, 'f', -1, 64)},
+	}
+}
+
+func requestIDHeaders(id string) CocaineHeaders {
+	return CocaineHeaders{
+		[]interface{}{false, RequestIDHeader, id},
+	}
+}
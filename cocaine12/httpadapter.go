@@ -0,0 +1,199 @@
+package cocaine12
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the maximum size of a chunk read from the body of an HTTP request
+const httpRequestChunkSize = 64 * 1024
+
+// CocaineToHTTP allows to serve HTTP requests by EventHandler,
+// so the same handler can be bound to the worker and to net/http.
+// The body of an HTTP request is passed to the handler as a stream of chunks,
+// headers are available via GetHeaders with lowercase names.
+// Data written to the response are sent as the body of HTTP response,
+// ErrorMsg replies with the HTTP status which corresponds to the error code
+// if nothing has been written yet. Progress is not reported over HTTP.
+// Note that net/http does not allow to read the body of HTTP/1.x request
+// after the response has been written, so a handler should read the request
+// before replying.
+func CocaineToHTTP(h EventHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := attachHeaders(r.Context(), invokeHeadersFromHTTP(r.Header))
+		response := &httpResponseStream{w: w}
+		defer response.Close()
+
+		h(ctx, &httpRequestStream{body: r.Body}, response)
+	}
+}
+
+// invokeHeadersFromHTTP converts HTTP headers
+// to literal invoke headers with lowercase names
+func invokeHeadersFromHTTP(header http.Header) CocaineHeaders {
+	headers := make(CocaineHeaders, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, []interface{}{false, strings.ToLower(name), value})
+		}
+	}
+	return headers
+}
+
+// httpStatusFromErrorCode maps error codes of the worker to HTTP statuses
+func httpStatusFromErrorCode(code int) int {
+	switch code {
+	case ErrorNoEventHandler:
+		return http.StatusNotFound
+	case ErrorTooManyChunks, ErrorPayloadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrorEventDisabled, ErrorWorkerTerminating, ErrorOverloaded:
+		return http.StatusServiceUnavailable
+	case ErrorUnauthorized:
+		return http.StatusUnauthorized
+	case ErrorResponseDeadline, ErrorHandlerTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorRequestIdleTimeout:
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// httpRequestStream reads chunks from the body of an HTTP request
+type httpRequestStream struct {
+	body io.Reader
+	eof  bool
+}
+
+func (r *httpRequestStream) Read(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if r.eof {
+		return nil, ErrStreamIsClosed
+	}
+
+	chunk := make([]byte, httpRequestChunkSize)
+	for {
+		n, err := r.body.Read(chunk)
+		if err == io.EOF {
+			r.eof = true
+			if n == 0 {
+				return nil, ErrStreamIsClosed
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			return chunk[:n], nil
+		}
+	}
+}
+
+func (r *httpRequestStream) RawAndDecode(ctx context.Context, v interface{}) ([]byte, error) {
+	raw, err := r.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return raw, decodeChunk(raw, v)
+}
+
+func (r *httpRequestStream) ReadAll(ctx context.Context, timeout ...time.Duration) ([]byte, error) {
+	return readAll(ctx, r, timeout)
+}
+
+// httpResponseStream writes a reply of a handler as an HTTP response
+type httpResponseStream struct {
+	w http.ResponseWriter
+
+	mu      sync.Mutex
+	closed  bool
+	written bool
+}
+
+func (r *httpResponseStream) Write(data []byte) (int, error) {
+	if err := r.ZeroCopyWrite(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (r *httpResponseStream) ZeroCopyWrite(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+
+	r.written = true
+	_, err := r.w.Write(data)
+	return err
+}
+
+func (r *httpResponseStream) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		// we treat it as a network connection
+		return syscall.EINVAL
+	}
+
+	r.closed = true
+	return nil
+}
+
+func (r *httpResponseStream) ErrorMsg(code int, message string) error {
+	return r.errorMsg(code, message, "")
+}
+
+func (r *httpResponseStream) RetryableError(code int, message string, retryAfter time.Duration) error {
+	return r.errorMsg(code, message, retryAfterSeconds(retryAfter))
+}
+
+// errorMsg replies with an HTTP error.
+// retryAfter is sent as Retry-After header unless it is empty
+func (r *httpResponseStream) errorMsg(code int, message string, retryAfter string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+	r.closed = true
+
+	if r.written {
+		// the status has been already sent,
+		// so a client sees a truncated body
+		return nil
+	}
+
+	if retryAfter != "" {
+		r.w.Header().Set("Retry-After", retryAfter)
+	}
+	http.Error(r.w, message, httpStatusFromErrorCode(code))
+	return nil
+}
+
+func (r *httpResponseStream) SetProgress(pct float64) error {
+	if pct < 0 || pct > 100 {
+		return ErrInvalidProgress
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package cocaine12
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func doTestHTTPRequest(t *testing.T, url, token string, body []byte) (int, string) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(reply)
+}
+
+func TestCocaineToHTTP(t *testing.T) {
+	echo := func(ctx context.Context, req Request, res Response) {
+		var body [][]byte
+		for {
+			chunk, err := req.Read(ctx)
+			if err == ErrStreamIsClosed {
+				break
+			}
+			if err != nil {
+				res.ErrorMsg(ErrorPanicInHandler, err.Error())
+				return
+			}
+			body = append(body, chunk)
+		}
+
+		// the body is read by chunks
+		assert.True(t, len(body) > 1)
+		for _, chunk := range body {
+			res.Write(chunk)
+		}
+		res.Close()
+	}
+
+	verify := func(token string) error {
+		if token != "secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+
+	server := httptest.NewServer(CocaineToHTTP(AuthMiddleware(verify)(echo)))
+	defer server.Close()
+
+	// the body is larger than a chunk
+	body := bytes.Repeat([]byte("body"), httpRequestChunkSize)
+	code, reply := doTestHTTPRequest(t, server.URL, "secret", body)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, string(body), reply)
+
+	code, reply = doTestHTTPRequest(t, server.URL, "", body)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "authorization token is missing\n", reply)
+
+	code, _ = doTestHTTPRequest(t, server.URL, "wrong", body)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestCocaineToHTTPErrorAfterWrite(t *testing.T) {
+	server := httptest.NewServer(CocaineToHTTP(func(ctx context.Context, req Request, res Response) {
+		res.Write([]byte("partial"))
+		assert.NoError(t, res.ErrorMsg(ErrorOverloaded, "overloaded"))
+		assert.Equal(t, io.ErrClosedPipe, res.ErrorMsg(ErrorOverloaded, "overloaded"))
+	}))
+	defer server.Close()
+
+	// the status has been sent along with the data
+	code, reply := doTestHTTPRequest(t, server.URL, "", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "partial", reply)
+}
+
+func TestCocaineToHTTPRetryAfter(t *testing.T) {
+	server := httptest.NewServer(CocaineToHTTP(func(ctx context.Context, req Request, res Response) {
+		res.RetryableError(ErrorOverloaded, "overloaded", 3*time.Second)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("Retry-After"))
+}
+
+func TestHTTPStatusFromErrorCode(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, httpStatusFromErrorCode(ErrorNoEventHandler))
+	assert.Equal(t, http.StatusServiceUnavailable, httpStatusFromErrorCode(ErrorOverloaded))
+	assert.Equal(t, http.StatusGatewayTimeout, httpStatusFromErrorCode(ErrorResponseDeadline))
+	assert.Equal(t, http.StatusInternalServerError, httpStatusFromErrorCode(ErrorPanicInHandler))
+	assert.Equal(t, http.StatusInternalServerError, httpStatusFromErrorCode(42))
+}
@@ -0,0 +1,125 @@
+package cocaine12
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// localSession is the id of a session started by InvokeLocal
+const localSession = 1
+
+// RecordedResponse is a reply of a handler run by Worker.InvokeLocal.
+// cocainetest.RunHandlerWithCancel records handlers into it as well
+type RecordedResponse struct {
+	// Body contains all the written chunks concatenated
+	Body []byte
+	// Err is the error sent by ErrorMsg, if any
+	Err *ErrRequest
+	// RetryAfter is the hint sent by RetryableError, if any
+	RetryAfter time.Duration
+	// Closed reports whether the response has been closed
+	// either by Close or by ErrorMsg
+	Closed bool
+	// Progress contains all reported progress values
+	Progress []float64
+}
+
+// responseRecorder receives messages of a response instead of a connection
+type responseRecorder struct {
+	mu       sync.Mutex
+	recorded RecordedResponse
+}
+
+func (r *responseRecorder) Send(msg *Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch msg.MsgType {
+	case v1Write:
+		if chunk, ok := msg.Payload[0].([]byte); ok {
+			r.recorded.Body = append(r.recorded.Body, chunk...)
+		}
+	case v1Error:
+		perr, err := decodeErrorPayload(msg.Payload)
+		if err != nil {
+			perr = &ErrRequest{Message: err.Error()}
+		}
+		r.recorded.Err = perr
+		r.recorded.RetryAfter, _ = msg.Headers.RetryAfter()
+		r.recorded.Closed = true
+	case v1Close:
+		r.recorded.Closed = true
+	case v1Progress:
+		if pct, ok := msg.Payload[0].(float64); ok {
+			r.recorded.Progress = append(r.recorded.Progress, pct)
+		}
+	}
+
+	if pct, ok := msg.Headers.Progress(); ok {
+		r.recorded.Progress = append(r.recorded.Progress, pct)
+	}
+}
+
+// snapshot returns a copy of the response recorded so far,
+// as a handler might keep replying after it has returned
+func (r *responseRecorder) snapshot() *RecordedResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recorded := r.recorded
+	recorded.Body = append([]byte(nil), r.recorded.Body...)
+	recorded.Progress = append([]float64(nil), r.recorded.Progress...)
+	return &recorded
+}
+
+// InvokeLocal runs the handler of the event in-process with a request
+// of the single chunk body and returns the recorded response.
+// Nothing is sent to cocaine-runtime, but the handler is called like
+// for an invoke: it is wrapped by middlewares and a panic is handled
+// like in a running worker. It is meant for debugging, e.g. to check
+// an event from an admin endpoint. It returns an error if there is
+// no handler for the event.
+func (w *Worker) InvokeLocal(event string, body []byte) (*RecordedResponse, error) {
+	handler, wrapped, ok := w.handlers.lookup(event)
+	if !ok {
+		return nil, fmt.Errorf("there is no handler for an event %s", event)
+	}
+
+	if !wrapped {
+		// the chain is built per call, so middlewares
+		// registered later are applied by Run as well
+		handler = chainMiddlewares(w.middlewares, handler)
+	}
+
+	var (
+		impl     = w.impl
+		recorder = new(responseRecorder)
+	)
+
+	requestStream := newRequest(impl.dispatcher)
+	requestStream.push(impl.dispatcher.newChunk(localSession, body))
+	requestStream.Close()
+	responseStream := newResponse(impl.dispatcher, localSession, recorder, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = attachLogger(ctx, impl.logWithFields(Fields{
+		"event": event,
+		"local": true,
+	}))
+
+	func() {
+		autoClose := impl.autoClose && !impl.keepOpenEvents[event]
+		request, snapshot := impl.newPanicSnapshot(requestStream)
+		report := PanicReport{
+			Event:   event,
+			Session: localSession,
+		}
+		defer trapRecoverAndClose(ctx, report, snapshot, responseStream, impl.onPanic, autoClose)
+		handler(ctx, request, responseStream)
+	}()
+
+	return recorder.snapshot(), nil
+}
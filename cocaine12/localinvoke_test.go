@@ -0,0 +1,92 @@
+package cocaine12
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerInvokeLocal(t *testing.T) {
+	w, _ := newTestWorker(t)
+	defer w.Stop()
+
+	w.Use(func(handler EventHandler) EventHandler {
+		return func(ctx context.Context, req Request, res Response) {
+			res.Write([]byte("mw:"))
+			handler(ctx, req, res)
+		}
+	})
+	w.On("upper", func(ctx context.Context, req Request, res Response) {
+		data, err := req.ReadAll(ctx)
+		if err != nil {
+			res.ErrorMsg(-1, err.Error())
+			return
+		}
+		res.SetProgress(50)
+		res.Write(bytes.ToUpper(data))
+	})
+	w.On("crash", func(ctx context.Context, req Request, res Response) {
+		panic("crash")
+	})
+
+	recorded, err := w.InvokeLocal("upper", []byte("ping"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte("mw:PING"), recorded.Body)
+	assert.Nil(t, recorded.Err)
+	assert.True(t, recorded.Closed)
+	assert.Equal(t, []float64{50}, recorded.Progress)
+
+	recorded, err = w.InvokeLocal("crash", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte("mw:"), recorded.Body)
+	if assert.NotNil(t, recorded.Err) {
+		assert.Equal(t, ErrorPanicInHandler, recorded.Err.Code)
+	}
+	assert.True(t, recorded.Closed)
+
+	_, err = w.InvokeLocal("unknown", nil)
+	assert.Error(t, err)
+}
+
+func TestWorkerInvokeLocalLaterMiddleware(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Write([]byte("pong"))
+	})
+
+	recorded, err := w.InvokeLocal("ping", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte("pong"), recorded.Body)
+
+	// InvokeLocal must not freeze the chain of middlewares
+	w.Use(func(handler EventHandler) EventHandler {
+		return func(ctx context.Context, req Request, res Response) {
+			res.Write([]byte("mw:"))
+			handler(ctx, req, res)
+		}
+	})
+
+	recorded, err = w.InvokeLocal("ping", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte("mw:pong"), recorded.Body)
+
+	runTestWorker(t, w, runtime)
+	runtime.Write() <- newInvokeV1(10, "ping")
+	for _, expected := range []string{"mw:", "pong"} {
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, 10, v1Write)
+		assert.Equal(t, []byte(expected), msg.Payload[0])
+	}
+}
@@ -2,6 +2,8 @@ package cocaine12
 
 import (
 	"context"
+	"net"
+	"strconv"
 	"time"
 )
 
@@ -16,44 +18,53 @@ type locator struct {
 	*Service
 }
 
-// NewLocator creates a new Locator using given endpoints
+// NewLocator creates a new Locator using given endpoints.
+// Endpoints are tried in order until a connection succeeds,
+// otherwise MultiConnectionError describes every failure.
 func NewLocator(endpoints []string) (Locator, error) {
 	if len(endpoints) == 0 {
 		endpoints = append(endpoints, GetDefaults().Locators()...)
 	}
 
-	var (
-		sock socketIO
-		err  error
-	)
-
-	// ToDo: Duplicated code with Service connection
-CONN_LOOP:
+	var mErr = make(MultiConnectionError, 0)
 	for _, endpoint := range endpoints {
-		sock, err = newAsyncConnection("tcp", endpoint, time.Second*1)
+		sock, err := newAsyncConnection("tcp", endpoint, time.Second*1)
 		if err != nil {
+			mErr = append(mErr, ConnectionError{parseEndpoint(endpoint), err})
 			continue
 		}
-		break CONN_LOOP
+
+		service := Service{
+			ServiceInfo: newLocatorServiceInfo(),
+			socketIO:    sock,
+			sessions:    newSessions(),
+			stop:        make(chan struct{}),
+			args:        endpoints,
+			name:        "locator",
+		}
+		go service.loop()
+
+		return &locator{
+			Service: &service,
+		}, nil
 	}
 
+	return nil, mErr
+}
+
+// parseEndpoint splits "host:port" for ConnectionError.
+// A malformed endpoint is kept as is in IP
+func parseEndpoint(endpoint string) EndpointItem {
+	host, port, err := net.SplitHostPort(endpoint)
 	if err != nil {
-		return nil, err
+		return EndpointItem{IP: endpoint}
 	}
 
-	service := Service{
-		ServiceInfo: newLocatorServiceInfo(),
-		socketIO:    sock,
-		sessions:    newSessions(),
-		stop:        make(chan struct{}),
-		args:        endpoints,
-		name:        "locator",
+	number, err := strconv.ParseUint(port, 10, 64)
+	if err != nil {
+		return EndpointItem{IP: endpoint}
 	}
-	go service.loop()
-
-	return &locator{
-		Service: &service,
-	}, nil
+	return EndpointItem{IP: host, Port: number}
 }
 
 func (l *locator) Resolve(ctx context.Context, name string) (*ServiceInfo, error) {
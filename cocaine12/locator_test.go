@@ -0,0 +1,39 @@
+package cocaine12
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func closedEndpoint(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := ln.Addr().String()
+	ln.Close()
+	return endpoint
+}
+
+func TestNewLocatorFailover(t *testing.T) {
+	endpoints := []string{closedEndpoint(t), closedEndpoint(t)}
+
+	_, err := NewLocator(endpoints)
+	merr, ok := err.(MultiConnectionError)
+	if !ok {
+		t.Fatalf("MultiConnectionError is expected, but %v has been returned", err)
+	}
+
+	if assert.Len(t, merr, 2) {
+		assert.Equal(t, endpoints[0], merr[0].String())
+		assert.Equal(t, endpoints[1], merr[1].String())
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	assert.Equal(t, EndpointItem{"127.0.0.1", 10053}, parseEndpoint("127.0.0.1:10053"))
+	assert.Equal(t, EndpointItem{"::1", 10053}, parseEndpoint("[::1]:10053"))
+	assert.Equal(t, EndpointItem{IP: "localhost"}, parseEndpoint("localhost"))
+}
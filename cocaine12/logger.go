@@ -35,6 +35,26 @@ type Logger interface {
 
 var defaultFields = Fields{}
 
+// LoggerValue is the key of the session logger in a handler context
+const LoggerValue = "cocaine.logger"
+
+// GetLogger returns the logger of the session which has started the handler.
+// Its entries carry the session and the event to correlate them
+// with other logs of the session. It returns an entry of the fallback logger
+// if ctx has no logger attached
+func GetLogger(ctx context.Context) *Entry {
+	if entry, ok := ctx.Value(LoggerValue).(*Entry); ok {
+		return entry
+	}
+
+	logger, _ := newFallbackLogger()
+	return logger.WithFields(Fields{})
+}
+
+func attachLogger(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, LoggerValue, entry)
+}
+
 // NewLogger tries to create a cocaine.Logger. It fallbacks to a simple implementation
 // if the cocaine.Logger is unavailable
 func NewLogger(ctx context.Context, endpoints ...string) (Logger, error) {
@@ -2,9 +2,86 @@ package cocaine12
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
+type testLogEntry struct {
+	level  Severity
+	fields Fields
+	msg    string
+}
+
+// testLogger records all log entries to check them in tests
+type testLogger struct {
+	mu      sync.Mutex
+	entries []testLogEntry
+}
+
+func (l *testLogger) log(level Severity, fields Fields, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+
+	l.mu.Lock()
+	l.entries = append(l.entries, testLogEntry{level, fields, msg})
+	l.mu.Unlock()
+}
+
+func (l *testLogger) Entries() []testLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]testLogEntry(nil), l.entries...)
+}
+
+func (l *testLogger) find(msg string) (testLogEntry, bool) {
+	for _, entry := range l.Entries() {
+		if entry.msg == msg {
+			return entry, true
+		}
+	}
+	return testLogEntry{}, false
+}
+
+func (l *testLogger) WithFields(fields Fields) *Entry {
+	return &Entry{Logger: l, Fields: fields}
+}
+
+func (l *testLogger) Verbosity(context.Context) Severity { return DebugLevel }
+func (l *testLogger) V(level Severity) bool              { return true }
+func (l *testLogger) Close()                             {}
+
+func (l *testLogger) Errf(format string, args ...interface{}) {
+	l.log(ErrorLevel, defaultFields, format, args...)
+}
+func (l *testLogger) Err(args ...interface{}) {
+	l.log(ErrorLevel, defaultFields, fmt.Sprint(args...))
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.log(WarnLevel, defaultFields, format, args...)
+}
+func (l *testLogger) Warn(args ...interface{}) {
+	l.log(WarnLevel, defaultFields, fmt.Sprint(args...))
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, defaultFields, format, args...)
+}
+func (l *testLogger) Info(args ...interface{}) {
+	l.log(InfoLevel, defaultFields, fmt.Sprint(args...))
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, defaultFields, format, args...)
+}
+func (l *testLogger) Debug(args ...interface{}) {
+	l.log(DebugLevel, defaultFields, fmt.Sprint(args...))
+}
+
 func TestLogger(t *testing.T) {
 	ctx := context.Background()
 	log, err := NewLogger(ctx)
@@ -29,3 +106,32 @@ func BenchmarkFormatFields5(b *testing.B) {
 		formatFields(fields)
 	}
 }
+
+func TestWorkerSessionLogger(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	logger := new(testLogger)
+	w.SetLogger(logger)
+	w.SetVersion("1.2.3")
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		GetLogger(ctx).Infof("handling %s", "echo")
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "echo")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	entry, ok := logger.find("handling echo")
+	if !assert.True(t, ok) {
+		t.FailNow()
+	}
+	assert.Equal(t, InfoLevel, entry.level)
+	assert.Equal(t, uint64(10), entry.fields["session"])
+	assert.Equal(t, "echo", entry.fields["event"])
+	assert.Equal(t, "1.2.3", entry.fields["version"])
+
+	// a handler can log outside of the worker
+	assert.NotNil(t, GetLogger(context.Background()))
+}
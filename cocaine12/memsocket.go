@@ -0,0 +1,198 @@
+package cocaine12
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const defaultMemorySocketBufferSize = 1024
+
+// MemorySocketOptions describes the link between two ends
+// of an in-memory connection. Options are applied in both directions.
+// Zero value means an ideal link.
+type MemorySocketOptions struct {
+	// Latency delays the delivery of every message
+	Latency time.Duration
+	// Throughput limits the number of messages per second
+	// delivered to a reader. 0 means no limit
+	Throughput int
+	// LossRate is a probability to drop a message in range [0, 1]
+	LossRate float64
+	// BufferSize is the number of messages in flight.
+	// A writer blocks when the buffer is full, so a low Throughput
+	// along with a small BufferSize simulates a slow reader.
+	// 0 means the default size
+	BufferSize int
+}
+
+// MemorySocket is an end of an in-memory connection between the worker
+// and a fake cocaine-runtime. It passes messages without encoding them,
+// so it allows to measure the cost of processing without network noise.
+type MemorySocket struct {
+	in  chan *Message
+	out chan *Message
+
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewMemorySocketPair creates two connected ends of an in-memory connection.
+func NewMemorySocketPair(opts MemorySocketOptions) (*MemorySocket, *MemorySocket) {
+	var (
+		closed    = make(chan struct{})
+		closeOnce = new(sync.Once)
+	)
+
+	newEnd := func() *MemorySocket {
+		return &MemorySocket{
+			in:        make(chan *Message),
+			out:       make(chan *Message),
+			closed:    closed,
+			closeOnce: closeOnce,
+		}
+	}
+
+	a, b := newEnd(), newEnd()
+	go newMemoryLink(opts, a.in, b.out, closed).run()
+	go newMemoryLink(opts, b.in, a.out, closed).run()
+	return a, b
+}
+
+// Send writes a message to the other end.
+// The message is dropped if the connection is closed.
+func (m *MemorySocket) Send(msg *Message) {
+	select {
+	case m.in <- msg:
+	case <-m.closed:
+	}
+}
+
+// Read returns a channel of incoming messages.
+// It is closed when the connection is closed.
+func (m *MemorySocket) Read() chan *Message {
+	return m.out
+}
+
+// Write returns a channel to send messages to the other end.
+// A sender must select on IsClosed along with Write to not block forever.
+func (m *MemorySocket) Write() chan *Message {
+	return m.in
+}
+
+// IsClosed returns a channel which is closed along with the connection.
+func (m *MemorySocket) IsClosed() <-chan struct{} {
+	return m.closed
+}
+
+// Close closes both ends of the connection.
+func (m *MemorySocket) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+}
+
+type memoryPacket struct {
+	msg       *Message
+	deliverAt time.Time
+}
+
+// memoryLink passes messages in one direction
+type memoryLink struct {
+	opts   MemorySocketOptions
+	input  <-chan *Message
+	output chan<- *Message
+	closed <-chan struct{}
+
+	inflight chan memoryPacket
+	random   *rand.Rand
+}
+
+func newMemoryLink(opts MemorySocketOptions, input <-chan *Message, output chan<- *Message, closed <-chan struct{}) *memoryLink {
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultMemorySocketBufferSize
+	}
+
+	return &memoryLink{
+		opts:     opts,
+		input:    input,
+		output:   output,
+		closed:   closed,
+		inflight: make(chan memoryPacket, bufferSize),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (l *memoryLink) run() {
+	go l.deliver()
+
+	for {
+		select {
+		case msg := <-l.input:
+			if l.opts.LossRate > 0 && l.random.Float64() < l.opts.LossRate {
+				continue
+			}
+
+			select {
+			case l.inflight <- memoryPacket{msg, time.Now().Add(l.opts.Latency)}:
+			case <-l.closed:
+				return
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *memoryLink) deliver() {
+	// a reader detects the closed connection this way
+	defer close(l.output)
+
+	var interval time.Duration
+	if l.opts.Throughput > 0 {
+		interval = time.Second / time.Duration(l.opts.Throughput)
+	}
+
+	var lastDelivery time.Time
+	for {
+		select {
+		case packet := <-l.inflight:
+			deliverAt := packet.deliverAt
+			if next := lastDelivery.Add(interval); interval > 0 && next.After(deliverAt) {
+				deliverAt = next
+			}
+
+			if !l.sleepUntil(deliverAt) {
+				return
+			}
+
+			select {
+			case l.output <- packet.msg:
+				lastDelivery = time.Now()
+			case <-l.closed:
+				return
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// sleepUntil returns false if the connection is closed while sleeping
+func (l *memoryLink) sleepUntil(deadline time.Time) bool {
+	delay := deadline.Sub(time.Now())
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
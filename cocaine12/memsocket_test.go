@@ -0,0 +1,52 @@
+package cocaine12
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySocketLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+
+	a, b := NewMemorySocketPair(MemorySocketOptions{Latency: latency})
+	defer a.Close()
+
+	start := time.Now()
+	a.Send(newHeartbeatV1())
+	msg := <-b.Read()
+	checkTypeAndSession(t, msg, v1UtilitySession, v1Heartbeat)
+	assert.True(t, time.Since(start) >= latency)
+
+	b.Write() <- newChokeV1(2)
+	checkTypeAndSession(t, <-a.Read(), 2, v1Close)
+}
+
+func TestMemorySocketLoss(t *testing.T) {
+	a, b := NewMemorySocketPair(MemorySocketOptions{LossRate: 1})
+	defer a.Close()
+
+	a.Send(newHeartbeatV1())
+	select {
+	case <-b.Read():
+		t.Fatal("the message must be lost")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemorySocketClose(t *testing.T) {
+	a, b := NewMemorySocketPair(MemorySocketOptions{})
+	b.Close()
+
+	select {
+	case <-a.IsClosed():
+	default:
+		t.Fatal("both ends must be closed")
+	}
+
+	_, open := <-a.Read()
+	assert.False(t, open)
+	// must not block
+	a.Send(newHeartbeatV1())
+}
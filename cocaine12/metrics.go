@@ -0,0 +1,123 @@
+package cocaine12
+
+import (
+	"time"
+)
+
+const (
+	// AnomalyUnknownSessionChoke means that cocaine-runtime has closed
+	// a session the worker knows nothing about
+	AnomalyUnknownSessionChoke = "choke_unknown_session"
+	// AnomalyMalformedInvoke means that cocaine-runtime has sent
+	// an invoke without an event name
+	AnomalyMalformedInvoke = "malformed_invoke"
+	// AnomalyDuplicateSession means that cocaine-runtime has sent
+	// an invoke with the id of an active session
+	AnomalyDuplicateSession = "duplicate_session"
+)
+
+// Metrics receives notifications about events inside the worker
+// to export them to a monitoring system.
+// Embed NullMetrics to implement only a subset of the methods.
+type Metrics interface {
+	// IncProtocolAnomaly counts unexpected messages from cocaine-runtime
+	IncProtocolAnomaly(kind string)
+	// IncBlockedHeartbeat counts heartbeats which have not been
+	// written to the connection in time
+	IncBlockedHeartbeat()
+	// ObserveSession receives one summary per finished session
+	ObserveSession(SessionMetrics)
+	// IncDeprecatedEvent counts invokes of events
+	// marked by Worker.DeprecateEvent
+	IncDeprecatedEvent(event string)
+	// ObserveQueueWait receives the time an invoke of the event has waited
+	// for a free slot under Worker.SetMaxActiveHandlers or
+	// Worker.SetEventConcurrency in ModeThrottle. It is observed
+	// for every started handler, so admitted at once invokes report zero
+	ObserveQueueWait(event string, d time.Duration)
+}
+
+// ConnectionMetrics receives notifications about connections
+// to cocaine-runtime. It is optional: the worker reports them
+// only if the Metrics set by Worker.SetMetrics implements it as well
+type ConnectionMetrics interface {
+	// IncConnectAttempt counts attempts to connect to cocaine-runtime.
+	// A connection is established once the handshake is sent.
+	// The first connection of the worker is reported by Worker.Run
+	IncConnectAttempt()
+	// IncConnectSuccess counts established connections
+	IncConnectSuccess()
+	// IncConnectFailure counts attempts failed to dial
+	// or to send the handshake
+	IncConnectFailure()
+	// IncReconnect counts connections established by Worker.RunWithReconnect
+	// after the previous one has been lost
+	IncReconnect()
+	// ObserveConnectDuration receives the time it has taken
+	// to establish a connection
+	ObserveConnectDuration(d time.Duration)
+}
+
+// SessionMetrics summarizes a finished session
+type SessionMetrics struct {
+	Event    string
+	Duration time.Duration
+	// BytesIn is the number of bytes received from a client
+	BytesIn int64
+	// BytesOut is the number of bytes sent to a client
+	BytesOut int64
+	// Status is either AccessStatusOK or AccessStatusError
+	Status string
+	// Category and Code describe an error
+	// if the session is finished with an error
+	Category int
+	Code     int
+	// Version is the version of the application set by Worker.SetVersion
+	Version string
+}
+
+func newSessionMetrics(entry AccessLogEntry) SessionMetrics {
+	return SessionMetrics{
+		Event:    entry.Event,
+		Duration: entry.Duration,
+		BytesIn:  entry.BytesIn,
+		BytesOut: entry.BytesOut,
+		Status:   entry.Status,
+		Category: entry.Category,
+		Code:     entry.Code,
+		Version:  entry.Version,
+	}
+}
+
+// NullMetrics ignores all the events
+type NullMetrics struct{}
+
+// IncProtocolAnomaly does nothing
+func (NullMetrics) IncProtocolAnomaly(kind string) {}
+
+// IncBlockedHeartbeat does nothing
+func (NullMetrics) IncBlockedHeartbeat() {}
+
+// ObserveSession does nothing
+func (NullMetrics) ObserveSession(SessionMetrics) {}
+
+// IncDeprecatedEvent does nothing
+func (NullMetrics) IncDeprecatedEvent(event string) {}
+
+// ObserveQueueWait does nothing
+func (NullMetrics) ObserveQueueWait(event string, d time.Duration) {}
+
+// IncConnectAttempt does nothing
+func (NullMetrics) IncConnectAttempt() {}
+
+// IncConnectSuccess does nothing
+func (NullMetrics) IncConnectSuccess() {}
+
+// IncConnectFailure does nothing
+func (NullMetrics) IncConnectFailure() {}
+
+// IncReconnect does nothing
+func (NullMetrics) IncReconnect() {}
+
+// ObserveConnectDuration does nothing
+func (NullMetrics) ObserveConnectDuration(d time.Duration) {}
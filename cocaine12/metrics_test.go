@@ -0,0 +1,401 @@
+package cocaine12
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMetrics records worker's metrics
+type testMetrics struct {
+	NullMetrics
+
+	mu                sync.Mutex
+	anomalies         []string
+	blockedHeartbeats int
+	sessions          []SessionMetrics
+	deprecatedEvents  []string
+	queueWaits        []time.Duration
+
+	connectAttempts, connectSuccesses, connectFailures, reconnects int
+	connectDurations                                               []time.Duration
+}
+
+func (m *testMetrics) IncProtocolAnomaly(kind string) {
+	m.mu.Lock()
+	m.anomalies = append(m.anomalies, kind)
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) Anomalies() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.anomalies...)
+}
+
+func (m *testMetrics) IncConnectAttempt() {
+	m.mu.Lock()
+	m.connectAttempts++
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) IncConnectSuccess() {
+	m.mu.Lock()
+	m.connectSuccesses++
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) IncConnectFailure() {
+	m.mu.Lock()
+	m.connectFailures++
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) IncReconnect() {
+	m.mu.Lock()
+	m.reconnects++
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) ObserveConnectDuration(d time.Duration) {
+	m.mu.Lock()
+	m.connectDurations = append(m.connectDurations, d)
+	m.mu.Unlock()
+}
+
+// sessionMetrics implements Metrics only
+// like implementations written before ConnectionMetrics
+type sessionMetrics struct {
+	sessions chan SessionMetrics
+}
+
+func (sessionMetrics) IncProtocolAnomaly(kind string)                 {}
+func (sessionMetrics) IncBlockedHeartbeat()                           {}
+func (m sessionMetrics) ObserveSession(s SessionMetrics)              { m.sessions <- s }
+func (sessionMetrics) IncDeprecatedEvent(event string)                {}
+func (sessionMetrics) ObserveQueueWait(event string, d time.Duration) {}
+
+func TestWorkerMetricsWithoutConnectionMetrics(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	metrics := sessionMetrics{make(chan SessionMetrics, 1)}
+	w.SetMetrics(metrics)
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+	select {
+	case m := <-metrics.sessions:
+		assert.Equal(t, "ping", m.Event)
+	case <-time.After(time.Second):
+		t.Fatal("the session has not been observed")
+	}
+}
+
+func TestWorkerUnknownSessionChoke(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	metrics := new(testMetrics)
+	w.SetMetrics(metrics)
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		defer res.Close()
+		data, _ := req.Read(ctx)
+		res.Write(data)
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "echo")
+	runtime.Write() <- newChunkV1(10, []byte("Dummy"))
+	runtime.Write() <- newChokeV1(10)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Write)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	// a choke for a rejected session is expected
+	w.DisableEvent("echo")
+	runtime.Write() <- newInvokeV1(11, "echo")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 11, v1Error)
+	runtime.Write() <- newChokeV1(11)
+
+	// there has never been such a session
+	runtime.Write() <- newChokeV1(5)
+
+	deadline := time.After(time.Second)
+	for len(metrics.Anomalies()) == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("the anomaly has not been reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	assert.Equal(t, []string{AnomalyUnknownSessionChoke}, metrics.Anomalies())
+}
+
+func TestWorkerMalformedInvoke(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	metrics := new(testMetrics)
+	w.SetMetrics(metrics)
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	// session ids must grow, so the order matters
+	for i, payload := range [][]interface{}{
+		{},
+		{100500},
+	} {
+		session := uint64(10 + i)
+		runtime.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{session, v1Invoke},
+			Payload:           payload,
+		}
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Error)
+		code, _ := unpackTestError(t, msg)
+		assert.Equal(t, ErrorMalformedInvoke, code)
+
+		// the session is closed by the worker, so a choke is expected
+		runtime.Write() <- newChokeV1(session)
+	}
+	assert.Equal(t, 0, w.ActiveSessions())
+
+	runtime.Write() <- newInvokeV1(12, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 12, v1Close)
+	assert.Equal(t, []string{AnomalyMalformedInvoke, AnomalyMalformedInvoke}, metrics.Anomalies())
+}
+
+func (m *testMetrics) IncBlockedHeartbeat() {
+	m.mu.Lock()
+	m.blockedHeartbeats++
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) BlockedHeartbeats() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.blockedHeartbeats
+}
+
+// stuckSocket accepts the only message and never reads it
+type stuckSocket struct {
+	read, write chan *Message
+	closed      chan struct{}
+}
+
+func newStuckSocket() *stuckSocket {
+	return &stuckSocket{
+		read:   make(chan *Message),
+		write:  make(chan *Message, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *stuckSocket) Send(msg *Message)         { s.write <- msg }
+func (s *stuckSocket) Read() chan *Message       { return s.read }
+func (s *stuckSocket) Write() chan *Message      { return s.write }
+func (s *stuckSocket) IsClosed() <-chan struct{} { return s.closed }
+func (s *stuckSocket) Close()                    {}
+
+func TestWorkerBlockedHeartbeat(t *testing.T) {
+	w, err := newWorker(newStuckSocket(), "uuid", 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+
+	logger, metrics := new(testLogger), new(testMetrics)
+	w.SetLogger(logger)
+	w.SetMetrics(metrics)
+	w.impl.heartbeatWriteTimeout = 10 * time.Millisecond
+	w.impl.disownTimeout = 100 * time.Millisecond
+
+	// the handshake takes the only slot,
+	// so the heartbeat is blocked
+	select {
+	case err := <-runWorker(w):
+		assert.Equal(t, ErrDisowned, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the worker must be disowned")
+	}
+
+	_, ok := logger.find("heartbeat write is blocked")
+	assert.True(t, ok, "a blocked heartbeat must be reported")
+	assert.Equal(t, 1, metrics.BlockedHeartbeats())
+}
+
+func runWorker(w *Worker) <-chan error {
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.Run(nil)
+	}()
+	return onStop
+}
+
+func (m *testMetrics) ObserveSession(session SessionMetrics) {
+	m.mu.Lock()
+	m.sessions = append(m.sessions, session)
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) Sessions() []SessionMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SessionMetrics(nil), m.sessions...)
+}
+
+func TestWorkerObserveSession(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	metrics := new(testMetrics)
+	w.SetMetrics(metrics)
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		data, _ := req.Read(ctx)
+		res.Write(data)
+		res.Close()
+		// the session is reported once
+		res.Close()
+	})
+	w.On("fail", func(ctx context.Context, req Request, res Response) {
+		res.ErrorMsg(100, "failed")
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "echo")
+	runtime.Write() <- newChunkV1(10, []byte("Dummy"))
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Write)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	runtime.Write() <- newInvokeV1(11, "fail")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 11, v1Error)
+
+	// sessions are reported after replies are sent
+	deadline := time.After(time.Second)
+	for len(metrics.Sessions()) < 2 {
+		select {
+		case <-deadline:
+			t.Fatal("sessions have not been reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	sessions := make(map[string]SessionMetrics)
+	for _, session := range metrics.Sessions() {
+		sessions[session.Event] = session
+	}
+	assert.Len(t, sessions, 2)
+
+	assert.Equal(t, int64(5), sessions["echo"].BytesIn)
+	assert.Equal(t, int64(5), sessions["echo"].BytesOut)
+	assert.Equal(t, AccessStatusOK, sessions["echo"].Status)
+	assert.Equal(t, 0, sessions["echo"].Code)
+	assert.Equal(t, AccessStatusError, sessions["fail"].Status)
+	assert.Equal(t, cworkererrorcategory, sessions["fail"].Category)
+	assert.Equal(t, 100, sessions["fail"].Code)
+}
+
+func (m *testMetrics) IncDeprecatedEvent(event string) {
+	m.mu.Lock()
+	m.deprecatedEvents = append(m.deprecatedEvents, event)
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) DeprecatedEvents() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.deprecatedEvents...)
+}
+
+func TestWorkerDeprecateEvent(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	logger, metrics := new(testLogger), new(testMetrics)
+	w.SetLogger(logger)
+	w.SetMetrics(metrics)
+	w.DeprecateEvent("old", "use new instead")
+	w.On("old", func(ctx context.Context, req Request, res Response) {
+		res.Write([]byte("still works"))
+	})
+	runTestWorker(t, w, runtime)
+
+	for session := uint64(10); session < 12; session++ {
+		runtime.Write() <- newInvokeV1(session, "old")
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Write)
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Close)
+	}
+
+	// every invoke is counted, but the warning is rate-limited
+	assert.Equal(t, []string{"old", "old"}, metrics.DeprecatedEvents())
+
+	var warnings []testLogEntry
+	for _, entry := range logger.Entries() {
+		if entry.msg == "deprecated event has been invoked" {
+			warnings = append(warnings, entry)
+		}
+	}
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, WarnLevel, warnings[0].level)
+		assert.Equal(t, "old", warnings[0].fields["event"])
+		assert.Equal(t, "use new instead", warnings[0].fields["message"])
+	}
+}
+
+func (m *testMetrics) ObserveQueueWait(event string, d time.Duration) {
+	m.mu.Lock()
+	m.queueWaits = append(m.queueWaits, d)
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) QueueWaits() []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Duration(nil), m.queueWaits...)
+}
+
+func TestWorkerQueueWait(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		metrics = new(testMetrics)
+		started = make(chan struct{}, 2)
+		release = make(chan struct{})
+	)
+	w.SetMetrics(metrics)
+	w.SetBackpressureMode(ModeThrottle)
+	w.SetEventConcurrency("slow", 1)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		started <- struct{}{}
+		<-release
+		res.Write([]byte("done"))
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "slow")
+	<-started
+	// the second invoke waits for the first handler
+	runtime.Write() <- newInvokeV1(11, "slow")
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for session := uint64(10); session < 12; session++ {
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Write)
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Close)
+	}
+
+	waits := metrics.QueueWaits()
+	if assert.Len(t, waits, 2) {
+		assert.True(t, waits[0] < 50*time.Millisecond, "the first invoke must be admitted at once")
+		assert.True(t, waits[1] >= 50*time.Millisecond, "the queued invoke must report its wait")
+	}
+}
@@ -0,0 +1,63 @@
+package cocaine12
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"runtime"
+)
+
+// AuthHeader is the name of the header which carries an authorization token
+const AuthHeader = "authorization"
+
+// Middleware wraps EventHandler to add logic shared by many events
+type Middleware func(EventHandler) EventHandler
+
+// NamedMiddleware is Middleware with a name,
+// which is reported by Worker.Middlewares
+type NamedMiddleware struct {
+	Name       string
+	Middleware Middleware
+}
+
+// middlewareName names a middleware registered without a name
+// after its function, e.g. "cocaine12.AuthMiddleware.func1"
+func middlewareName(mw Middleware) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(mw).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	return path.Base(fn.Name())
+}
+
+// chainMiddlewares wraps the handler, so the first middleware
+// is called first
+func chainMiddlewares(middlewares []NamedMiddleware, handler EventHandler) EventHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i].Middleware(handler)
+	}
+	return handler
+}
+
+// AuthMiddleware rejects requests without a valid authorization token
+// with ErrorUnauthorized. The token is taken from AuthHeader of the invoke
+// and passed to verify, which returns an error for an invalid token.
+func AuthMiddleware(verify func(token string) error) Middleware {
+	return func(handler EventHandler) EventHandler {
+		return func(ctx context.Context, req Request, res Response) {
+			token, ok := GetHeaders(ctx).Get(AuthHeader)
+			if !ok {
+				res.ErrorMsg(ErrorUnauthorized, "authorization token is missing")
+				return
+			}
+
+			if err := verify(token); err != nil {
+				res.ErrorMsg(ErrorUnauthorized, fmt.Sprintf("authorization failed: %v", err))
+				return
+			}
+
+			handler(ctx, req, res)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package cocaine12
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAuthInvoke(session uint64, event string, token string) *Message {
+	msg := newInvokeV1(session, event)
+	msg.Headers = CocaineHeaders{
+		[]interface{}{false, AuthHeader, []byte(token)},
+	}
+	return msg
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	auth := AuthMiddleware(func(token string) error {
+		if token != "secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	})
+	w.On("test", auth(func(ctx context.Context, req Request, res Response) {
+		res.Write([]byte("hello"))
+	}))
+	runTestWorker(t, w, runtime)
+
+	// missing token
+	runtime.Write() <- newInvokeV1(10, "test")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 10, v1Error)
+	code, message := unpackTestError(t, msg)
+	assert.Equal(t, ErrorUnauthorized, code)
+	assert.Equal(t, "authorization token is missing", message)
+
+	// invalid token
+	runtime.Write() <- newAuthInvoke(11, "test", "guess")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 11, v1Error)
+	code, message = unpackTestError(t, msg)
+	assert.Equal(t, ErrorUnauthorized, code)
+	assert.Equal(t, "authorization failed: invalid token", message)
+
+	// valid token
+	runtime.Write() <- newAuthInvoke(12, "test", "secret")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 12, v1Write)
+	assert.Equal(t, []byte("hello"), msg.Payload[0])
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 12, v1Close)
+}
+
+func TestCocaineHeadersGet(t *testing.T) {
+	headers := CocaineHeaders{
+		// indexed header
+		uint64(80),
+		[]interface{}{false, uint64(81), []byte{1, 2}},
+		[]interface{}{false, []byte("x-name"), "value"},
+	}
+
+	value, ok := headers.Get("x-name")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+
+	_, ok = headers.Get(AuthHeader)
+	assert.False(t, ok)
+
+	_, ok = GetHeaders(context.Background()).Get(AuthHeader)
+	assert.False(t, ok)
+}
+
+func TestWorkerMiddlewares(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var calls []string
+	tracing := func(name string) Middleware {
+		return func(handler EventHandler) EventHandler {
+			return func(ctx context.Context, req Request, res Response) {
+				calls = append(calls, name)
+				handler(ctx, req, res)
+			}
+		}
+	}
+
+	auth := AuthMiddleware(func(token string) error { return nil })
+	w.UseNamed(NamedMiddleware{"first", tracing("first")})
+	w.Use(auth)
+	w.UseNamed(NamedMiddleware{"second", tracing("second")})
+	assert.Equal(t, []string{"first", middlewareName(auth), "second"}, w.Middlewares())
+	assert.Contains(t, w.Middlewares()[1], "AuthMiddleware")
+
+	w.On("test", func(ctx context.Context, req Request, res Response) {
+		calls = append(calls, "handler")
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newAuthInvoke(10, "test", "secret")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+
+	// the fallback handler is wrapped too
+	calls = nil
+	runtime.Write() <- newInvokeV1(11, "unknown")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 11, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorUnauthorized, code)
+	assert.Equal(t, []string{"first"}, calls)
+}
+
+func TestWorkerMiddlewareShortCircuit(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	reject := func(handler EventHandler) EventHandler {
+		return func(ctx context.Context, req Request, res Response) {
+			if _, ok := GetHeaders(ctx).Get("x-reject"); ok {
+				res.ErrorMsg(ErrorUnauthorized, "rejected")
+				return
+			}
+			handler(ctx, req, res)
+		}
+	}
+	crash := func(handler EventHandler) EventHandler {
+		return func(ctx context.Context, req Request, res Response) {
+			if _, ok := GetHeaders(ctx).Get("x-crash"); ok {
+				panic("middleware failed")
+			}
+			handler(ctx, req, res)
+		}
+	}
+
+	called := make(chan struct{}, 1)
+	w.Use(reject, crash)
+	w.On("test", func(ctx context.Context, req Request, res Response) {
+		called <- struct{}{}
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	invoke := func(session uint64, header string) *Message {
+		msg := newInvokeV1(session, "test")
+		msg.Headers = CocaineHeaders{
+			[]interface{}{false, header, []byte("1")},
+		}
+		return msg
+	}
+
+	runtime.Write() <- invoke(10, "x-reject")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 10, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorUnauthorized, code)
+
+	// the panic is caught by the worker
+	runtime.Write() <- invoke(11, "x-crash")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 11, v1Error)
+	code, _ = unpackTestError(t, msg)
+	assert.Equal(t, ErrorPanicInHandler, code)
+
+	select {
+	case <-called:
+		t.Fatal("the handler must not be called")
+	default:
+	}
+
+	runtime.Write() <- invoke(12, "x-pass")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 12, v1Close)
+	<-called
+}
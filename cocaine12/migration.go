@@ -0,0 +1,162 @@
+package cocaine12
+
+import (
+	"fmt"
+)
+
+// migrationRequest is passed by MigrateTo to the loop
+type migrationRequest struct {
+	conn socketIO
+	done chan error
+}
+
+// connMigration describes the connection the worker moves to,
+// while sessions of the old one are draining
+type connMigration struct {
+	conn socketIO
+	// session ids of the new connection may clash with ids of draining
+	// sessions, so the new connection gets its own dispatcher and
+	// its sessions are deferred until the old connection is closed
+	dispatcher protocolDispather
+	deferred   []*Message
+	done       chan error
+}
+
+// MigrateTo moves the worker to another endpoint of cocaine-runtime,
+// e.g. when the locator reports a new preferred one. The worker sends
+// the handshake to the new endpoint and moves heartbeats there.
+// Active sessions of the old connection are drained, while new invokes
+// on it are rejected with ErrorWorkerTerminating. Invokes from the new
+// endpoint are deferred until the old connection is closed.
+// It blocks until the migration is finished, so it must be called
+// after Worker.Run. ErrWorkerStopped is returned if the worker
+// has been stopped or is terminating.
+func (w *WorkerNG) MigrateTo(endpoint string) error {
+	conn, err := newUnixConnection(endpoint, coreConnectionTimeout, w.framer, w.readBufferSize)
+	if err != nil {
+		return fmt.Errorf("unable to connect to Cocaine via %s: %v", endpoint, err)
+	}
+	return w.migrate(conn)
+}
+
+func (w *WorkerNG) migrate(conn socketIO) error {
+	w.setupConn(conn)
+
+	request := migrationRequest{
+		conn: conn,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case w.migrations <- request:
+	case <-w.stopped:
+		conn.Close()
+		return ErrWorkerStopped
+	case <-w.getConn().IsClosed():
+		conn.Close()
+		return ErrWorkerStopped
+	}
+
+	// the loop always replies
+	return <-request.done
+}
+
+// setupConn applies settings of the current connection to a new one
+func (w *WorkerNG) setupConn(conn socketIO) {
+	if w.envelope != nil {
+		if setter, ok := conn.(envelopeSetter); ok {
+			setter.setEnvelope(w.envelope)
+		}
+	}
+
+	if w.onConnError != nil {
+		if notifier, ok := conn.(connErrorNotifier); ok {
+			notifier.setErrorHandler(w.onConnError)
+		}
+	}
+}
+
+func (w *WorkerNG) onMigrate(request migrationRequest) {
+	if w.migration != nil {
+		request.conn.Close()
+		request.done <- ErrMigrationInProgress
+		return
+	}
+
+	if w.terminating {
+		request.conn.Close()
+		request.done <- ErrWorkerStopped
+		return
+	}
+
+	if err := w.sendHandshake(request.conn); err != nil {
+		request.conn.Close()
+		request.done <- err
+		return
+	}
+
+	w.migration = &connMigration{
+		conn:       request.conn,
+		dispatcher: newV1Protocol(),
+		done:       request.done,
+	}
+
+	w.connMu.Lock()
+	w.heartbeatConn = request.conn
+	w.connMu.Unlock()
+
+	if !w.dedicatedHeartbeat {
+		// let the new endpoint know we are ready to work
+		w.onHeartbeatTimeout()
+	}
+}
+
+// onMigratedMessage handles a message from the new connection
+// while the old one is draining
+func (w *WorkerNG) onMigratedMessage(msg *Message) {
+	if msg.Session != v1UtilitySession {
+		w.migration.deferred = append(w.migration.deferred, msg)
+		return
+	}
+
+	// heartbeats must be answered to not be disowned
+	if err := w.migration.dispatcher.onMessage(w, msg); err != nil {
+		fmt.Printf("onMessage returns %v\n", err)
+	}
+}
+
+// finishMigration closes the old connection and
+// starts handling sessions of the new one
+func (w *WorkerNG) finishMigration() {
+	// sessions, which are still waiting for a choke
+	w.terminateAllSessions(ErrorWorkerTerminating, "the worker has moved to another connection")
+	w.abandonedSessions = make(map[uint64]struct{})
+
+	old := w.conn
+	w.connMu.Lock()
+	w.conn = w.migration.conn
+	w.connMu.Unlock()
+	closeConnGracefully(old)
+
+	migration := w.migration
+	w.migration = nil
+	w.dispatcher = migration.dispatcher
+
+	for _, msg := range migration.deferred {
+		if err := w.dispatcher.onMessage(w, msg); err != nil {
+			fmt.Printf("onMessage returns %v\n", err)
+		}
+	}
+	migration.done <- nil
+}
+
+// abortMigration keeps the worker on the old connection
+// if the new one has been lost
+func (w *WorkerNG) abortMigration(err error) {
+	w.connMu.Lock()
+	w.heartbeatConn = w.conn
+	w.connMu.Unlock()
+
+	w.migration.done <- err
+	w.migration = nil
+}
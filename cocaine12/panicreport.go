@@ -0,0 +1,70 @@
+package cocaine12
+
+import (
+	"context"
+	"sync"
+)
+
+// the limit of the request snapshot in a panic report
+const panicSnapshotLimit = 1024
+
+// PanicReport describes a panic recovered from a handler,
+// so it can be reproduced in a post-mortem
+type PanicReport struct {
+	Event   string
+	Session uint64
+	// the value recovered from the panic
+	Recovered interface{}
+	// the stack of the panicked handler
+	Stack []byte
+	// the redacted first chunk read by the handler, if any.
+	// It is set only if Worker.SetPanicRequestSnapshot is enabled
+	FirstChunk []byte
+}
+
+// snapshotRequest keeps a copy of the first chunk read by a handler
+// to report it along with a panic
+type snapshotRequest struct {
+	source Request
+	redact func([]byte) []byte
+
+	mu    sync.Mutex
+	first []byte
+	taken bool
+}
+
+func (r *snapshotRequest) read(ctx context.Context) ([]byte, error) {
+	data, err := r.source.Read(ctx)
+	if err != nil {
+		return data, err
+	}
+
+	r.mu.Lock()
+	if !r.taken {
+		r.taken = true
+		r.first = append([]byte(nil), data...)
+	}
+	r.mu.Unlock()
+	return data, nil
+}
+
+// snapshot returns the redacted first chunk cut to panicSnapshotLimit.
+// It returns nil if the handler has read nothing
+func (r *snapshotRequest) snapshot() []byte {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	first, taken := r.first, r.taken
+	r.mu.Unlock()
+	if !taken {
+		return nil
+	}
+
+	redacted := r.redact(first)
+	if len(redacted) > panicSnapshotLimit {
+		redacted = redacted[:panicSnapshotLimit]
+	}
+	return redacted
+}
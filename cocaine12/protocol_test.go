@@ -177,3 +177,62 @@ func BenchmarkTraceExtract(b *testing.B) {
 		headers.getTraceData()
 	}
 }
+
+func packTestPayload(t *testing.T, payload interface{}) []byte {
+	var buf []byte
+	assert.NoError(t, codec.NewEncoderBytes(&buf, payloadHandler).Encode(payload))
+	return buf
+}
+
+func TestDecodeCocaineError(t *testing.T) {
+	perr, err := DecodeCocaineError(packTestPayload(t, []interface{}{[]int{42, 100}, "error message"}))
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ErrRequest{Message: "error message", Category: 42, Code: 100}, perr)
+	}
+
+	perr, err = DecodeCocaineError(packTestPayload(t, []interface{}{404, "not found"}))
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ErrRequest{Message: "not found", Category: 0, Code: 404}, perr)
+	}
+}
+
+func TestDecodeCocaineErrorMalformed(t *testing.T) {
+	malformed := []interface{}{
+		[]interface{}{},
+		[]interface{}{"error message"},
+		[]interface{}{[]int{42}, "error message"},
+		[]interface{}{[]interface{}{42, "100"}, "error message"},
+		[]interface{}{"100", "error message"},
+		[]interface{}{100, 200},
+		[]interface{}{100, "error message", "extra"},
+	}
+
+	for _, payload := range malformed {
+		_, err := DecodeCocaineError(packTestPayload(t, payload))
+		assert.Equal(t, ErrMalformedErrorMessage, err, "%v", payload)
+	}
+
+	_, err := DecodeCocaineError([]byte{0xc1})
+	assert.Error(t, err)
+}
+
+func TestClientMessageBuilders(t *testing.T) {
+	encode := func(msg *Message) []byte {
+		var buf bytes.Buffer
+		assert.NoError(t, MsgpackCodec{}.NewEncoder(&buf)(msg))
+		return buf.Bytes()
+	}
+
+	// [5, 0, ["ping", "a"], []]
+	assert.Equal(t,
+		[]byte{0x94, 0x05, 0x00, 0x92, 0xa4, 'p', 'i', 'n', 'g', 0xa1, 'a', 0x90},
+		encode(NewInvokeMessage(5, "ping", "a")))
+	// [5, 0, ["hi"], []]
+	assert.Equal(t,
+		[]byte{0x94, 0x05, 0x00, 0x91, 0xa2, 'h', 'i', 0x90},
+		encode(NewChunkMessage(5, []byte("hi"))))
+	// [5, 2, [], []]
+	assert.Equal(t,
+		[]byte{0x94, 0x05, 0x02, 0x90, 0x90},
+		encode(NewChokeMessage(5)))
+}
@@ -0,0 +1,67 @@
+package cocaine12
+
+import (
+	"sync"
+	"time"
+)
+
+// RequestSummary describes a completed request
+type RequestSummary struct {
+	Event   string
+	Session uint64
+	// Status is either AccessStatusOK or AccessStatusError
+	Status string
+	// Code is an error code if the request is finished with an error
+	Code     int
+	Duration time.Duration
+}
+
+func newRequestSummary(entry AccessLogEntry) RequestSummary {
+	return RequestSummary{
+		Event:    entry.Event,
+		Session:  entry.Session,
+		Status:   entry.Status,
+		Code:     entry.Code,
+		Duration: entry.Duration,
+	}
+}
+
+// requestRing keeps a fixed number of the last completed requests
+type requestRing struct {
+	mu      sync.Mutex
+	entries []RequestSummary
+	// the position of the next entry
+	next int
+	full bool
+}
+
+func newRequestRing(size int) *requestRing {
+	return &requestRing{
+		entries: make([]RequestSummary, size),
+	}
+}
+
+func (r *requestRing) add(summary RequestSummary) {
+	r.mu.Lock()
+	r.entries[r.next] = summary
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// list returns entries from the oldest to the newest
+func (r *requestRing) list() []RequestSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]RequestSummary(nil), r.entries[:r.next]...)
+	}
+
+	result := make([]RequestSummary, 0, len(r.entries))
+	result = append(result, r.entries[r.next:]...)
+	return append(result, r.entries[:r.next]...)
+}
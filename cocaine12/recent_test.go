@@ -0,0 +1,75 @@
+package cocaine12
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestRing(t *testing.T) {
+	ring := newRequestRing(3)
+	assert.Empty(t, ring.list())
+
+	for session := uint64(1); session <= 4; session++ {
+		ring.add(RequestSummary{Session: session})
+	}
+
+	var sessions []uint64
+	for _, summary := range ring.list() {
+		sessions = append(sessions, summary.Session)
+	}
+	assert.Equal(t, []uint64{2, 3, 4}, sessions)
+}
+
+func TestWorkerRecentRequests(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	assert.Nil(t, w.RecentRequests())
+
+	w.SetRecentRequestsSize(3)
+	w.On("ok", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	w.On("fail", func(ctx context.Context, req Request, res Response) {
+		res.ErrorMsg(-100, "dummyError")
+	})
+	runTestWorker(t, w, runtime)
+
+	events := []string{"ok", "ok", "fail", "ok", "fail"}
+	for i, event := range events {
+		session := uint64(i + 2)
+		runtime.Write() <- newInvokeV1(session, event)
+		readTestMessage(t, runtime)
+		runtime.Write() <- newChokeV1(session)
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		recent := w.RecentRequests()
+		if len(recent) == 3 && recent[2].Session == 6 {
+			break
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("unexpected recent requests: %v", recent)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	recent := w.RecentRequests()
+	assert.Equal(t, uint64(4), recent[0].Session)
+	assert.Equal(t, "fail", recent[0].Event)
+	assert.Equal(t, AccessStatusError, recent[0].Status)
+	assert.Equal(t, -100, recent[0].Code)
+
+	assert.Equal(t, uint64(5), recent[1].Session)
+	assert.Equal(t, "ok", recent[1].Event)
+	assert.Equal(t, AccessStatusOK, recent[1].Status)
+
+	assert.Equal(t, uint64(6), recent[2].Session)
+	assert.Equal(t, "fail", recent[2].Event)
+}
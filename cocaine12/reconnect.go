@@ -0,0 +1,183 @@
+package cocaine12
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultBackoffInitial = 100 * time.Millisecond
+	defaultBackoffMax     = 10 * time.Second
+	defaultBackoffFactor  = 2
+)
+
+// ErrUnableToReconnect is returned by RunWithReconnect if the worker
+// has been created with a custom connection, so there is nothing to dial
+var ErrUnableToReconnect = errors.New("the worker has no endpoint to reconnect to")
+
+// Backoff bounds delays between attempts to reconnect to cocaine-runtime.
+// The first attempt is made after Initial, then the delay is multiplied
+// by Factor up to Max. Zero values mean defaults: 100ms, 10s and 2.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	// MaxAttempts limits failed attempts in a row,
+	// then the worker is stopped. 0 means no limit
+	MaxAttempts int
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = defaultBackoffInitial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultBackoffMax
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Factor < 1 {
+		b.Factor = defaultBackoffFactor
+	}
+	return b
+}
+
+// delay returns the delay before the attempt numbered from 0
+func (b Backoff) delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 0; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Factor
+	}
+
+	if delay > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(delay)
+}
+
+// RunWithReconnect works like Run, but once the worker is disowned
+// or the connection to cocaine-runtime is lost, it dials the endpoint
+// again with the backoff, sends the handshake and keeps handling requests.
+// Active sessions are cancelled, as their clients are gone with the connection.
+// OnStart and OnStop hooks are called once per run, not per connection.
+// The worker is not reconnected if it has been stopped or terminated
+// by cocaine-runtime. If MaxAttempts of the backoff is exceeded,
+// the worker is stopped and the error, which has broken the connection,
+// is returned. ErrUnableToReconnect is returned if the worker has been
+// created with WithConnection.
+func (w *WorkerNG) RunWithReconnect(handler RequestHandler, terminationHandler TerminationHandler, backoff Backoff) error {
+	if w.dial == nil {
+		return ErrUnableToReconnect
+	}
+
+	backoff = backoff.withDefaults()
+	w.backoff = &backoff
+	return w.Run(handler, terminationHandler)
+}
+
+// shouldReconnect reports whether the loop has returned
+// because of a broken connection, which can be dialed again
+func (w *WorkerNG) shouldReconnect(err error) bool {
+	if w.backoff == nil || w.isStopped() {
+		return false
+	}
+
+	if w.terminating || w.pendingShutdown != nil {
+		return false
+	}
+
+	return err == ErrDisowned || err == ErrConnectionLost
+}
+
+// reconnect dials cocaine-runtime until it succeeds, the limit of attempts
+// is exceeded or the worker is stopped. It returns an error only
+// if the worker has given up
+func (w *WorkerNG) reconnect(cause error) error {
+	w.logWithFields(Fields{
+		"cause": cause.Error(),
+	}).Warnf("reconnecting to cocaine-runtime")
+
+	for attempt := 0; ; attempt++ {
+		if w.backoff.MaxAttempts > 0 && attempt >= w.backoff.MaxAttempts {
+			w.logWithFields(Fields{
+				"attempts": attempt,
+			}).Errf("unable to reconnect to cocaine-runtime, giving up")
+			w.Stop()
+			return cause
+		}
+
+		select {
+		case <-time.After(w.backoff.delay(attempt)):
+		case <-w.stopped:
+			return nil
+		}
+
+		conn, err := w.connect()
+		if err != nil {
+			w.logWithFields(Fields{
+				"attempt": attempt + 1,
+			}).Warnf("unable to reconnect to cocaine-runtime: %v", err)
+			continue
+		}
+
+		w.connMetrics.IncReconnect()
+		w.resume(conn)
+		return nil
+	}
+}
+
+// connect dials cocaine-runtime and sends the handshake
+func (w *WorkerNG) connect() (socketIO, error) {
+	w.connMetrics.IncConnectAttempt()
+	start := time.Now()
+
+	conn, err := w.dial()
+	if err != nil {
+		w.connMetrics.IncConnectFailure()
+		return nil, err
+	}
+
+	w.setupConn(conn)
+	if err := w.sendHandshake(conn); err != nil {
+		conn.Close()
+		w.connMetrics.IncConnectFailure()
+		return nil, err
+	}
+
+	w.connMetrics.IncConnectSuccess()
+	w.connMetrics.ObserveConnectDuration(time.Since(start))
+	return conn, nil
+}
+
+// sendFirstHandshake introduces the worker on the connection
+// of the constructor. The connection is reported to the metrics here,
+// as they are set after the worker has been created
+func (w *WorkerNG) sendFirstHandshake() error {
+	w.connMetrics.IncConnectAttempt()
+	start := time.Now()
+
+	if err := w.sendHandshake(w.conn); err != nil {
+		w.connMetrics.IncConnectFailure()
+		return err
+	}
+
+	w.connMetrics.IncConnectSuccess()
+	w.connMetrics.ObserveConnectDuration(w.dialDuration + time.Since(start))
+	return nil
+}
+
+// resume resets the state tied to the lost connection.
+// Sessions have been terminated by the loop on exit
+func (w *WorkerNG) resume(conn socketIO) {
+	w.connMu.Lock()
+	w.conn = conn
+	w.heartbeatConn = conn
+	w.connMu.Unlock()
+
+	// session ids are assigned by the new connection from scratch
+	w.dispatcher = newV1Protocol()
+	w.abandonedSessions = make(map[uint64]struct{})
+	w.awaitingHeartbeat = false
+	w.migration = nil
+}
@@ -0,0 +1,183 @@
+package cocaine12
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{
+		Initial: 10 * time.Millisecond,
+		Max:     35 * time.Millisecond,
+	}.withDefaults()
+
+	assert.Equal(t, 10*time.Millisecond, backoff.delay(0))
+	assert.Equal(t, 20*time.Millisecond, backoff.delay(1))
+	assert.Equal(t, 35*time.Millisecond, backoff.delay(2))
+	assert.Equal(t, 35*time.Millisecond, backoff.delay(100))
+}
+
+func TestWorkerRunWithReconnect(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	runtimes := make(chan *asyncRWSocket, 1)
+	w.impl.dial = func() (socketIO, error) {
+		in, out := testConn()
+		sock, _ := newAsyncRW(out)
+		runtime, _ := newAsyncRW(in)
+		runtimes <- runtime
+		return sock, nil
+	}
+
+	var (
+		starts, stops int32
+		started       = make(chan struct{})
+		cancelled     = make(chan struct{})
+	)
+	w.OnStart(func() error {
+		atomic.AddInt32(&starts, 1)
+		return nil
+	})
+	w.OnStop(func() {
+		atomic.AddInt32(&stops, 1)
+	})
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.RunWithReconnect(nil, Backoff{Initial: time.Millisecond})
+	}()
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+	runtime.Write() <- newHeartbeatV1()
+
+	runtime.Write() <- newInvokeV1(10, "slow")
+	<-started
+
+	// the connection is lost, so the session is cancelled
+	runtime.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the session has not been cancelled")
+	}
+
+	runtime = <-runtimes
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+	runtime.Write() <- newHeartbeatV1()
+
+	// session ids of the new connection start over
+	runtime.Write() <- newInvokeV1(2, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+
+	w.Stop()
+	select {
+	case err := <-onStop:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the worker has not been stopped")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&starts))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stops))
+}
+
+func TestWorkerRunWithReconnectGivesUp(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var dials int32
+	w.impl.dial = func() (socketIO, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("connection refused")
+	}
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.RunWithReconnect(nil, Backoff{Initial: time.Millisecond, MaxAttempts: 3})
+	}()
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+	runtime.Close()
+
+	select {
+	case err := <-onStop:
+		assert.Equal(t, ErrConnectionLost, err)
+	case <-time.After(time.Second):
+		t.Fatal("the worker has not given up")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+}
+
+func TestWorkerReconnectMetrics(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	metrics := new(testMetrics)
+	w.SetMetrics(metrics)
+
+	var dials int32
+	runtimes := make(chan *asyncRWSocket, 1)
+	w.impl.dial = func() (socketIO, error) {
+		// the first attempt fails
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+
+		in, out := testConn()
+		sock, _ := newAsyncRW(out)
+		runtime, _ := newAsyncRW(in)
+		runtimes <- runtime
+		return sock, nil
+	}
+
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.RunWithReconnect(nil, Backoff{Initial: time.Millisecond})
+	}()
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+	runtime.Close()
+
+	runtime = <-runtimes
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+	w.Stop()
+	select {
+	case <-onStop:
+	case <-time.After(time.Second):
+		t.Fatal("the worker has not been stopped")
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	// the first connection, the failed and the successful reconnects
+	assert.Equal(t, 3, metrics.connectAttempts)
+	assert.Equal(t, 2, metrics.connectSuccesses)
+	assert.Equal(t, 1, metrics.connectFailures)
+	assert.Equal(t, 1, metrics.reconnects)
+	assert.Len(t, metrics.connectDurations, 2)
+}
+
+func TestWorkerRunWithReconnectCustomConnection(t *testing.T) {
+	w, _ := newTestWorker(t)
+	defer w.Stop()
+
+	assert.Equal(t, ErrUnableToReconnect, w.RunWithReconnect(nil, Backoff{}))
+}
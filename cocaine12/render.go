@@ -0,0 +1,120 @@
+package cocaine12
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// AcceptHeader is the name of the header which lists
+// content types a client accepts, like HTTP Accept
+const AcceptHeader = "accept"
+
+// Content types supported by Render
+const (
+	ContentTypeMsgpack = "application/x-msgpack"
+	ContentTypeJSON    = "application/json"
+	ContentTypeRaw     = "application/octet-stream"
+)
+
+// NegotiateContentType chooses a content type supported by Render
+// from AcceptHeader of the invoke. Quality values are respected,
+// ContentTypeMsgpack is used if the header is missing
+// or there is no supported type in it.
+func NegotiateContentType(ctx context.Context) string {
+	accept, ok := GetHeaders(ctx).Get(AcceptHeader)
+	if !ok {
+		return ContentTypeMsgpack
+	}
+
+	var accepted []acceptedType
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		accepted = append(accepted, acceptedType{
+			name:    strings.ToLower(strings.TrimSpace(params[0])),
+			quality: acceptQuality(params[1:]),
+		})
+	}
+	// the order of the header is kept for the same quality
+	sort.Stable(byQuality(accepted))
+
+	for _, item := range accepted {
+		if item.quality <= 0 {
+			break
+		}
+
+		switch item.name {
+		case ContentTypeMsgpack, "application/msgpack", "*/*":
+			return ContentTypeMsgpack
+		case ContentTypeJSON:
+			return ContentTypeJSON
+		case ContentTypeRaw:
+			return ContentTypeRaw
+		}
+	}
+	return ContentTypeMsgpack
+}
+
+// acceptedType is a media range of AcceptHeader
+type acceptedType struct {
+	name    string
+	quality float64
+}
+
+// byQuality sorts accepted types from the most preferred one
+type byQuality []acceptedType
+
+func (a byQuality) Len() int           { return len(a) }
+func (a byQuality) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byQuality) Less(i, j int) bool { return a[i].quality > a[j].quality }
+
+func acceptQuality(params []string) float64 {
+	for _, param := range params {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+
+		if quality, err := strconv.ParseFloat(param[2:], 64); err == nil {
+			return quality
+		}
+	}
+	return 1
+}
+
+// Render sends v to a client as a chunk encoded with the content type
+// chosen by NegotiateContentType. ContentTypeRaw accepts only
+// []byte and string. An encoding error is returned before
+// anything is sent, so a handler is able to reply with ErrorMsg.
+func Render(ctx context.Context, res Response, v interface{}) error {
+	contentType := NegotiateContentType(ctx)
+
+	var body []byte
+	switch contentType {
+	case ContentTypeJSON:
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return err
+		}
+	case ContentTypeRaw:
+		switch raw := v.(type) {
+		case []byte:
+			body = raw
+		case string:
+			body = []byte(raw)
+		default:
+			return fmt.Errorf("unable to render %T as %s", v, contentType)
+		}
+	default:
+		if err := codec.NewEncoderBytes(&body, payloadHandler).Encode(v); err != nil {
+			return err
+		}
+	}
+
+	return res.ZeroCopyWrite(body)
+}
@@ -0,0 +1,84 @@
+package cocaine12
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAcceptInvoke(session uint64, event string, accept string) *Message {
+	msg := newInvokeV1(session, event)
+	msg.Headers = CocaineHeaders{
+		[]interface{}{false, AcceptHeader, []byte(accept)},
+	}
+	return msg
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	negotiate := func(accept string) string {
+		headers := CocaineHeaders{
+			[]interface{}{false, AcceptHeader, accept},
+		}
+		return NegotiateContentType(attachHeaders(context.Background(), headers))
+	}
+
+	assert.Equal(t, ContentTypeMsgpack, NegotiateContentType(context.Background()))
+	assert.Equal(t, ContentTypeJSON, negotiate("application/json"))
+	assert.Equal(t, ContentTypeJSON, negotiate("text/html, application/json"))
+	assert.Equal(t, ContentTypeRaw, negotiate("application/json;q=0.5, application/octet-stream"))
+	assert.Equal(t, ContentTypeMsgpack, negotiate("*/*"))
+	assert.Equal(t, ContentTypeMsgpack, negotiate("text/html"))
+	assert.Equal(t, ContentTypeMsgpack, negotiate("application/json;q=0"))
+}
+
+func TestRender(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	render := func(v interface{}) EventHandler {
+		return func(ctx context.Context, req Request, res Response) {
+			if err := Render(ctx, res, v); err != nil {
+				res.ErrorMsg(ErrorPanicInHandler, err.Error())
+			}
+		}
+	}
+	w.On("item", render(item{1, "first"}))
+	w.On("text", render("hello"))
+	runTestWorker(t, w, runtime)
+
+	// JSON
+	runtime.Write() <- newAcceptInvoke(10, "item", "application/json")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 10, v1Write)
+	assert.Equal(t, []byte(`{"id":1,"name":"first"}`), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	// MessagePack by default
+	runtime.Write() <- newInvokeV1(11, "item")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 11, v1Write)
+	var actual item
+	assert.NoError(t, decodeChunk(msg.Payload[0].([]byte), &actual))
+	assert.Equal(t, item{1, "first"}, actual)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 11, v1Close)
+
+	// raw
+	runtime.Write() <- newAcceptInvoke(12, "text", "application/octet-stream")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 12, v1Write)
+	assert.Equal(t, []byte("hello"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 12, v1Close)
+
+	// a struct can not be sent raw
+	runtime.Write() <- newAcceptInvoke(13, "item", "application/octet-stream")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 13, v1Error)
+	_, message := unpackTestError(t, msg)
+	assert.Equal(t, "unable to render cocaine12.item as application/octet-stream", message)
+}
@@ -120,6 +120,8 @@ type Service struct {
 	socketIO
 	*ServiceInfo
 
+	// ids of outgoing sessions are unique only within the connection
+	// of the service and don't depend on sessions of the worker
 	sessions *sessions
 	stop     chan struct{}
 
@@ -128,10 +130,13 @@ type Service struct {
 
 	epoch uint
 	id    string
+
+	// logs calls which last longer than slowCallThreshold,
+	// both are protected by mutex
+	logger            Logger
+	slowCallThreshold time.Duration
 }
 
-//Creates new service instance with specifed name.
-//Optional parameter is a network endpoint of the locator (default ":10053"). Look at Locator.
 func serviceResolve(ctx context.Context, name string, endpoints []string) (*ServiceInfo, error) {
 	l, err := NewLocator(endpoints)
 	if err != nil {
@@ -161,6 +166,10 @@ func serviceCreateIO(endpoints []EndpointItem) (socketIO, error) {
 	return nil, mErr
 }
 
+// NewService creates new service instance with specifed name.
+// The service is resolved by the locator at endpoints,
+// which default to GetDefaults().Locators(). Look at Locator.
+// A service is safe to call from handlers of a worker in the same process.
 func NewService(ctx context.Context, name string, endpoints []string) (s *Service, err error) {
 	info, err := serviceResolve(ctx, name, endpoints)
 	if err != nil {
@@ -182,6 +191,7 @@ func NewService(ctx context.Context, name string, endpoints []string) (s *Servic
 		epoch:       0,
 		id:          fmt.Sprintf("%x", rand.Int63()),
 	}
+	s.logger, _ = newFallbackLogger()
 	go s.loop()
 	return s, nil
 }
@@ -258,6 +268,8 @@ func (service *Service) call(ctx context.Context, name string, args ...interface
 	service.mutex.RLock()
 	defer service.mutex.RUnlock()
 
+	// SetSlowCallThreshold may be called concurrently
+	threshold := service.slowCallThreshold
 	ctx, traceCall := NewSpan(ctx, "%s %s: calling %s", service.name, service.id, name)
 
 	methodNum, err := service.API.MethodByName(name)
@@ -270,6 +282,7 @@ func (service *Service) call(ctx context.Context, name string, args ...interface
 		headers           = CocaineHeaders{}
 		traceSentCall     = closeDummySpan
 		traceReceivedCall = closeDummySpan
+		traceFailedCall   = func(error) {}
 	)
 
 	if traceInfo := GetTraceInfo(ctx); traceInfo != nil {
@@ -305,13 +318,46 @@ func (service *Service) call(ctx context.Context, name string, args ...interface
 				"RPC":            RPCName,
 			}).Infof("trace received")
 		}
+
+		traceFailedCall = func(err error) {
+			traceInfo.getLog().WithFields(Fields{
+				"trace_id":       traceHex,
+				"span_id":        spanHex,
+				"parent_id":      parentHex,
+				"real_timestamp": time.Now().UnixNano() / 1000,
+				"RPC":            RPCName,
+				"error":          err.Error(),
+			}).Errf("trace failed")
+		}
+	}
+
+	if threshold > 0 {
+		var (
+			startTime = time.Now()
+			closeSpan = traceCall
+		)
+
+		traceCall = func() {
+			closeSpan()
+			if duration := time.Since(startTime); duration > threshold {
+				service.getLogger().WithFields(Fields{
+					"service":  service.name,
+					"method":   name,
+					"duration": duration.Nanoseconds() / 1000,
+				}).Warnf("slow call")
+			}
+		}
 	}
 
 	ch := channel{
 		traceReceived: traceReceivedCall,
 		traceSent:     traceSentCall,
+		traceFinished: traceCall,
+		traceFailed:   traceFailedCall,
+		finished:      make(chan struct{}),
 		rx: rx{
 			pushBuffer: make(chan ServiceResult, 1),
+			cancelled:  make(chan struct{}),
 			rxTree:     service.ServiceInfo.API[methodNum].Upstream,
 			done:       false,
 		},
@@ -338,9 +384,37 @@ func (service *Service) call(ctx context.Context, name string, args ...interface
 	}
 
 	service.sendMsg(msg)
+	ch.watch(ctx)
 	return &ch, nil
 }
 
+// SetLogger sets the logger which is used to report slow calls
+func (service *Service) SetLogger(logger Logger) {
+	service.mutex.Lock()
+	service.logger = logger
+	service.mutex.Unlock()
+}
+
+// SetSlowCallThreshold makes the service log every call which lasts
+// longer than the threshold. The duration is measured until the last
+// frame of the call is read. 0 disables logging.
+func (service *Service) SetSlowCallThreshold(threshold time.Duration) {
+	service.mutex.Lock()
+	service.slowCallThreshold = threshold
+	service.mutex.Unlock()
+}
+
+func (service *Service) getLogger() Logger {
+	service.mutex.RLock()
+	logger := service.logger
+	service.mutex.RUnlock()
+
+	if logger == nil {
+		logger, _ = newFallbackLogger()
+	}
+	return logger
+}
+
 func (service *Service) disconnected() bool {
 	select {
 	case <-service.IsClosed():
@@ -356,7 +430,10 @@ func (service *Service) sendMsg(msg *Message) {
 	service.mutex.RUnlock()
 }
 
-//Calls a remote method by name and pass args
+//Calls a remote method by name and pass args.
+// The call is cancelled by Channel.Close when ctx is done.
+// Calls made with a context of a handler are cancelled as well
+// when the worker terminates active handlers.
 func (service *Service) Call(ctx context.Context, name string, args ...interface{}) (Channel, error) {
 	service.mutex.RLock()
 	disconnected := service.disconnected()
@@ -205,3 +205,331 @@ func TestRxClosedGet(t *testing.T) {
 	_, err = ch.Get(ctx)
 	assert.EqualError(t, err, ErrStreamIsClosed.Error())
 }
+
+// newTestService creates a Service connected to an in-memory peer
+// with a single "ping" method which replies with a value or an error
+func newTestService(name string) (*Service, *asyncRWSocket) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	peer, _ := newAsyncRW(in)
+
+	s := &Service{
+		socketIO: sock,
+		ServiceInfo: &ServiceInfo{
+			API: dispatchMap{
+				0: dispatchItem{
+					Name:       "ping",
+					Downstream: emptyDescription,
+					Upstream: &streamDescription{
+						0: &StreamDescriptionItem{
+							Name:        "value",
+							Description: emptyDescription,
+						},
+						1: &StreamDescriptionItem{
+							Name:        "error",
+							Description: emptyDescription,
+						},
+					},
+				},
+				1: dispatchItem{
+					Name: "stream",
+					Downstream: &streamDescription{
+						0: &StreamDescriptionItem{
+							Name:        "write",
+							Description: nil,
+						},
+						1: &StreamDescriptionItem{
+							Name:        "close",
+							Description: emptyDescription,
+						},
+					},
+					Upstream: &streamDescription{
+						0: &StreamDescriptionItem{
+							Name:        "chunk",
+							Description: nil,
+						},
+						1: &StreamDescriptionItem{
+							Name:        "error",
+							Description: emptyDescription,
+						},
+					},
+				},
+			},
+		},
+		sessions: newSessions(),
+		stop:     make(chan struct{}),
+		name:     name,
+		id:       "test",
+	}
+	go s.loop()
+
+	return s, peer
+}
+
+func TestServiceCallSpan(t *testing.T) {
+	var (
+		log    = new(testLogger)
+		parent = TraceInfo{Trace: 100, Span: 200, Parent: 0}
+	)
+	parent.logger = log
+
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	ctx := AttachTraceInfo(context.Background(), parent)
+	ch, err := s.Call(ctx, "ping", "data")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	msg := <-peer.Read()
+	traceInfo, err := msg.Headers.getTraceData()
+	if !assert.NoError(t, err, "trace headers must be injected") {
+		t.FailNow()
+	}
+	assert.Equal(t, parent.Trace, traceInfo.Trace)
+	assert.Equal(t, parent.Span, traceInfo.Parent)
+	assert.NotEqual(t, parent.Span, traceInfo.Span)
+
+	start, ok := log.find("start")
+	if assert.True(t, ok, "span must be started") {
+		assert.Equal(t, "echo test: calling ping", start.fields["rpc_name"])
+	}
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{msg.Session, 1},
+		Payload:           []interface{}{[2]int{1, 2}, "failed"},
+	}
+
+	_, err = ch.Get(ctx)
+	assert.NoError(t, err)
+
+	failed, ok := log.find("trace failed")
+	if assert.True(t, ok, "an error must be recorded") {
+		assert.Equal(t, "[1] [2] failed", failed.fields["error"])
+	}
+	finish, ok := log.find("finish")
+	if assert.True(t, ok, "span must be finished") {
+		assert.Contains(t, finish.fields, "duration")
+	}
+}
+
+func TestServiceSlowCall(t *testing.T) {
+	log := new(testLogger)
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	s.SetLogger(log)
+	s.SetSlowCallThreshold(10 * time.Millisecond)
+
+	ctx := context.Background()
+	call := func(delay time.Duration) {
+		ch, err := s.Call(ctx, "ping", "data")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		msg := <-peer.Read()
+		// a slow downstream
+		time.Sleep(delay)
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{"pong"},
+		}
+
+		_, err = ch.Get(ctx)
+		assert.NoError(t, err)
+	}
+
+	call(0)
+	_, ok := log.find("slow call")
+	assert.False(t, ok, "a fast call must not be logged")
+
+	call(50 * time.Millisecond)
+	entry, ok := log.find("slow call")
+	if assert.True(t, ok, "a slow call must be logged") {
+		assert.Equal(t, WarnLevel, entry.level)
+		assert.Equal(t, "ping", entry.fields["method"])
+		assert.True(t, entry.fields["duration"].(int64) >= 50000)
+	}
+}
+
+func TestServiceSetSlowCallThresholdConcurrently(t *testing.T) {
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.SetSlowCallThreshold(time.Duration(i) * time.Millisecond)
+		}
+	}()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		_, err := s.Call(ctx, "ping", "data")
+		assert.NoError(t, err)
+		<-peer.Read()
+	}
+	<-done
+}
+
+func TestServiceChannelClose(t *testing.T) {
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	ctx := context.Background()
+	ch, err := s.Call(ctx, "stream")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	invoke := <-peer.Read()
+
+	peer.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{invoke.Session, 0},
+		Payload:           []interface{}{"chunk"},
+	}
+	_, err = ch.Get(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ch.Close())
+	cancel := <-peer.Read()
+	assert.Equal(t, invoke.Session, cancel.Session)
+	assert.Equal(t, uint64(1), cancel.MsgType, "close must be sent")
+
+	_, ok := s.sessions.Get(invoke.Session)
+	assert.False(t, ok, "the session must be detached")
+
+	_, err = ch.Get(ctx)
+	assert.Equal(t, ErrChannelCancelled, err)
+	assert.NoError(t, ch.Close())
+}
+
+func TestWorkerAndServiceSessions(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	// the service replies to the first call
+	go func() {
+		msg := <-peer.Read()
+		assert.Equal(t, uint64(2), msg.Session)
+		peer.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{msg.Session, 0},
+			Payload:           []interface{}{"pong"},
+		}
+	}()
+
+	w.On("proxy", func(ctx context.Context, req Request, res Response) {
+		defer res.Close()
+
+		ch, err := s.Call(ctx, "ping")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		reply, err := ch.Get(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		var pong string
+		assert.NoError(t, reply.Extract(&[]interface{}{&pong}))
+		res.Write([]byte(pong))
+	})
+	runTestWorker(t, w, runtime)
+
+	// the same id as the outgoing session of the service
+	const testSession = 2
+	runtime.Write() <- newInvokeV1(testSession, "proxy")
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Write)
+	assert.Equal(t, []byte("pong"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession, v1Close)
+}
+
+func TestWorkerTerminateCancelsServiceCalls(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	handlerErr := make(chan error, 1)
+	w.On("proxy", func(ctx context.Context, req Request, res Response) {
+		ch, err := s.Call(ctx, "stream")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		_, err = ch.Get(context.Background())
+		handlerErr <- err
+		res.ErrorMsg(ErrorWorkerTerminating, "cancelled")
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "proxy")
+	invoke := <-peer.Read()
+
+	runtime.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{
+			Session: v1UtilitySession,
+			MsgType: v1Terminate,
+		},
+		Payload: []interface{}{100, "TestTermination", 0.3},
+	}
+
+	// the handler may finish the call within the grace period
+	select {
+	case msg := <-peer.Read():
+		t.Fatalf("the call has been cancelled within the grace period: %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the downstream call is closed once the grace period is over
+	cancel := <-peer.Read()
+	assert.Equal(t, invoke.Session, cancel.Session)
+	assert.Equal(t, uint64(1), cancel.MsgType, "close must be sent")
+	assert.Equal(t, ErrChannelCancelled, <-handlerErr)
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+
+	select {
+	case err := <-onStop:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the worker has not been stopped")
+	}
+}
+
+func TestServiceCallCancelledByContext(t *testing.T) {
+	s, peer := newTestService("echo")
+	defer s.Close()
+	defer peer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := s.Call(ctx, "stream")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	invoke := <-peer.Read()
+
+	cancel()
+	msg := <-peer.Read()
+	assert.Equal(t, invoke.Session, msg.Session)
+	assert.Equal(t, uint64(1), msg.MsgType, "close must be sent")
+
+	_, err = ch.Get(context.Background())
+	assert.Equal(t, ErrChannelCancelled, err)
+}
@@ -0,0 +1,95 @@
+package cocaine12
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultStartupProbeDeadline bounds the startup probe
+// if no deadline is given to SetStartupProbe
+const defaultStartupProbeDeadline = time.Minute
+
+// StartupProbeError is returned by Run if the startup probe
+// has not succeeded within the deadline
+type StartupProbeError struct {
+	Attempts int
+	// the error of the last attempt
+	Err error
+}
+
+func (e *StartupProbeError) Error() string {
+	return fmt.Sprintf("the startup probe has failed %d times, the last error: %v", e.Attempts, e.Err)
+}
+
+// SetStartupProbe sets the function, which checks dependencies
+// of the application, e.g. a DB or a cache, once OnStart has succeeded,
+// so a broken worker does not handle requests. The worker keeps sending
+// heartbeats while the probe runs, and requests received meanwhile wait
+// for it. The readiness notify is called once the probe has passed.
+// A failed probe is retried with the default Backoff until it succeeds
+// or the deadline expires. In the latter case the worker is stopped,
+// waiting requests are replied with an error and Run returns StartupProbeError.
+// ctx is done once the deadline expires. 0 deadline means one minute.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetStartupProbe(probe func(ctx context.Context) error, deadline time.Duration) {
+	if deadline <= 0 {
+		deadline = defaultStartupProbeDeadline
+	}
+	w.startupProbe = probe
+	w.startupProbeDeadline = deadline
+}
+
+// startStartupProbe runs the probe in a separate goroutine,
+// so the loop keeps handling heartbeats. The result is passed over probeDone
+func (w *WorkerNG) startStartupProbe() {
+	done := make(chan error, 1)
+	w.probeDone = done
+	go func() {
+		done <- w.runStartupProbe()
+	}()
+}
+
+// onStartupProbePassed starts handlers which have been waiting for the probe
+func (w *WorkerNG) onStartupProbePassed() {
+	w.probeDone = nil
+	pending := w.probePending
+	w.probePending = nil
+	for _, admit := range pending {
+		admit()
+	}
+
+	if w.readinessNotify != nil {
+		w.readinessNotify()
+	}
+}
+
+// runStartupProbe returns once the probe succeeds,
+// the deadline expires or the worker is stopped
+func (w *WorkerNG) runStartupProbe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.startupProbeDeadline)
+	defer cancel()
+
+	backoff := Backoff{}.withDefaults()
+	for attempt := 0; ; attempt++ {
+		err := w.startupProbe(ctx)
+		if err == nil {
+			return nil
+		}
+
+		w.logWithFields(Fields{
+			"attempt": attempt + 1,
+		}).Warnf("the startup probe has failed: %v", err)
+
+		select {
+		case <-time.After(backoff.delay(attempt)):
+		case <-ctx.Done():
+			return &StartupProbeError{
+				Attempts: attempt + 1,
+				Err:      err,
+			}
+		case <-w.stopped:
+			return ErrWorkerStopped
+		}
+	}
+}
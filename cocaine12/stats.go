@@ -0,0 +1,55 @@
+package cocaine12
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WorkerStats is a snapshot of counters of the worker
+type WorkerStats struct {
+	// Invokes is the number of invokes received from cocaine-runtime,
+	// including rejected ones
+	Invokes int64
+	// ActiveSessions is the number of sessions, which have been
+	// invoked, but not closed by a client yet
+	ActiveSessions int
+	// HeartbeatsSent is the number of heartbeats written to the connection
+	HeartbeatsSent int64
+	// Disowns is the number of expired disown timeouts.
+	// The worker is stopped once it is disowned
+	Disowns int64
+	// Panics is the number of panics recovered from handlers
+	Panics int64
+	// SinceHeartbeatReply is the time since the last reply to a heartbeat.
+	// It grows up to the disown timeout before the worker is disowned.
+	// It is 0 if there has been no reply yet
+	SinceHeartbeatReply time.Duration
+}
+
+// workerCounters are updated by the loop and handlers,
+// so they must be accessed atomically
+type workerCounters struct {
+	invokes        int64
+	heartbeatsSent int64
+	disowns        int64
+	panics         int64
+	// UnixNano of the last heartbeat reply
+	lastHeartbeatReply int64
+}
+
+// Stats returns a snapshot of counters of the worker.
+// It is safe to call it concurrently with the running worker
+func (w *WorkerNG) Stats() WorkerStats {
+	stats := WorkerStats{
+		Invokes:        atomic.LoadInt64(&w.counters.invokes),
+		ActiveSessions: w.ActiveSessions(),
+		HeartbeatsSent: atomic.LoadInt64(&w.counters.heartbeatsSent),
+		Disowns:        atomic.LoadInt64(&w.counters.disowns),
+		Panics:         atomic.LoadInt64(&w.counters.panics),
+	}
+
+	if last := atomic.LoadInt64(&w.counters.lastHeartbeatReply); last > 0 {
+		stats.SinceHeartbeatReply = time.Since(time.Unix(0, last))
+	}
+	return stats
+}
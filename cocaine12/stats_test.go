@@ -0,0 +1,56 @@
+package cocaine12
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerStats(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	w.On("crash", func(ctx context.Context, req Request, res Response) {
+		panic("crash")
+	})
+	assert.Equal(t, WorkerStats{}, w.Stats())
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+	runtime.Write() <- newInvokeV1(11, "crash")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 11, v1Error)
+
+	stats := w.Stats()
+	assert.Equal(t, int64(2), stats.Invokes)
+	assert.Equal(t, 2, stats.ActiveSessions)
+	assert.Equal(t, int64(1), stats.HeartbeatsSent)
+	assert.Equal(t, int64(0), stats.Disowns)
+	assert.Equal(t, int64(1), stats.Panics)
+	assert.True(t, stats.SinceHeartbeatReply > 0)
+	assert.True(t, stats.SinceHeartbeatReply < time.Second)
+}
+
+func TestWorkerStatsDisown(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.impl.disownTimeout = 50 * time.Millisecond
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.Run(nil)
+	}()
+	checkTypeAndSession(t, <-runtime.Read(), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, <-runtime.Read(), v1UtilitySession, v1Heartbeat)
+
+	// no reply to the heartbeat
+	assert.Equal(t, ErrDisowned, <-onStop)
+	stats := w.Stats()
+	assert.Equal(t, int64(1), stats.Disowns)
+	assert.Equal(t, time.Duration(0), stats.SinceHeartbeatReply)
+}
@@ -0,0 +1,91 @@
+package cocaine12
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ugorji/go/codec"
+)
+
+// StatusResponse adds HTTP-like status semantics to Response
+// for REST-over-cocaine applications. The status is sent as the first chunk
+// in the same format as WriteHead, so cocaine HTTP proxies understand it,
+// and the body follows it as the second chunk.
+type StatusResponse struct {
+	res           Response
+	status        int
+	errorOnStatus bool
+}
+
+// NewStatusResponse wraps the response. The status is 200 by default.
+func NewStatusResponse(res Response) *StatusResponse {
+	return &StatusResponse{res: res, status: http.StatusOK}
+}
+
+// SetErrorOnStatus makes 4xx and 5xx statuses be sent as an error frame
+// with the status as the code and the body as the message,
+// so clients which are not aware of statuses see a failed request.
+func (r *StatusResponse) SetErrorOnStatus(enable bool) {
+	r.errorOnStatus = enable
+}
+
+// Status sets the status sent by Body
+func (r *StatusResponse) Status(code int) {
+	r.status = code
+}
+
+// Body sends the status and v, then closes the response.
+// []byte and string are sent as is, other values are encoded with MessagePack.
+func (r *StatusResponse) Body(v interface{}) error {
+	if r.errorOnStatus && r.status >= http.StatusBadRequest {
+		return r.res.ErrorMsg(r.status, statusMessage(r.status, v))
+	}
+
+	body, err := encodeStatusBody(v)
+	if err != nil {
+		return err
+	}
+
+	if err := r.res.ZeroCopyWrite(WriteHead(r.status, Headers{})); err != nil {
+		return err
+	}
+
+	if body != nil {
+		if err := r.res.ZeroCopyWrite(body); err != nil {
+			return err
+		}
+	}
+
+	return r.res.Close()
+}
+
+func encodeStatusBody(v interface{}) ([]byte, error) {
+	switch body := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return body, nil
+	case string:
+		return []byte(body), nil
+	default:
+		var out []byte
+		if err := codec.NewEncoderBytes(&out, payloadHandler).Encode(body); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+}
+
+// statusMessage describes a failed request for an error frame
+func statusMessage(status int, v interface{}) string {
+	switch body := v.(type) {
+	case nil:
+		return http.StatusText(status)
+	case []byte:
+		return string(body)
+	case string:
+		return body
+	default:
+		return fmt.Sprint(body)
+	}
+}
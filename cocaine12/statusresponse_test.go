@@ -0,0 +1,72 @@
+package cocaine12
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusResponse(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	type item struct {
+		ID   int
+		Name string
+	}
+
+	w.On("get", func(ctx context.Context, req Request, res Response) {
+		NewStatusResponse(res).Body(item{1, "first"})
+	})
+	w.On("missing", func(ctx context.Context, req Request, res Response) {
+		sres := NewStatusResponse(res)
+		sres.Status(http.StatusNotFound)
+		sres.Body("no such item")
+	})
+	w.On("strict", func(ctx context.Context, req Request, res Response) {
+		sres := NewStatusResponse(res)
+		sres.SetErrorOnStatus(true)
+		sres.Status(http.StatusServiceUnavailable)
+		sres.Body(nil)
+	})
+	runTestWorker(t, w, runtime)
+
+	readHead := func(session uint64) (int, []byte) {
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Write)
+		var head struct {
+			Code    int
+			Headers Headers
+		}
+		assert.NoError(t, decodeChunk(msg.Payload[0].([]byte), &head))
+
+		msg = readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, session, v1Write)
+		return head.Code, msg.Payload[0].([]byte)
+	}
+
+	runtime.Write() <- newInvokeV1(10, "get")
+	code, body := readHead(10)
+	assert.Equal(t, http.StatusOK, code)
+	var got item
+	assert.NoError(t, decodeChunk(body, &got))
+	assert.Equal(t, item{1, "first"}, got)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	// 4xx is sent as a regular response by default
+	runtime.Write() <- newInvokeV1(11, "missing")
+	code, body = readHead(11)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "no such item", string(body))
+	checkTypeAndSession(t, readTestMessage(t, runtime), 11, v1Close)
+
+	// and as an error frame if configured
+	runtime.Write() <- newInvokeV1(12, "strict")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 12, v1Error)
+	errCode, message := unpackTestError(t, msg)
+	assert.Equal(t, http.StatusServiceUnavailable, errCode)
+	assert.Equal(t, "Service Unavailable", message)
+}
@@ -3,7 +3,9 @@ package cocaine12
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/ugorji/go/codec"
 )
@@ -24,6 +26,94 @@ func convertPayload(in interface{}, out interface{}) error {
 	return nil
 }
 
+// decodeChunk decodes MessagePack encoded data
+func decodeChunk(raw []byte, v interface{}) error {
+	return codec.NewDecoderBytes(raw, payloadHandler).Decode(v)
+}
+
+// readHookRequest replaces Read of the wrapped request.
+// RawAndDecode and ReadAll are built on top of the replaced Read,
+// so they see the same chunks
+type readHookRequest struct {
+	Request
+	read func(ctx context.Context) ([]byte, error)
+}
+
+// hookRead wraps the request, so every chunk is read by read
+func hookRead(req Request, read func(ctx context.Context) ([]byte, error)) Request {
+	return &readHookRequest{
+		Request: req,
+		read:    read,
+	}
+}
+
+func (r *readHookRequest) Read(ctx context.Context) ([]byte, error) {
+	return r.read(ctx)
+}
+
+func (r *readHookRequest) RawAndDecode(ctx context.Context, v interface{}) ([]byte, error) {
+	raw, err := r.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return raw, decodeChunk(raw, v)
+}
+
+func (r *readHookRequest) ReadAll(ctx context.Context, timeout ...time.Duration) ([]byte, error) {
+	return readAll(ctx, r, timeout)
+}
+
+// readAll concatenates chunks of the request until the stream is closed.
+// The timeout, if any, is applied to the whole reading.
+func readAll(ctx context.Context, req Request, timeout []time.Duration) ([]byte, error) {
+	if len(timeout) > 0 && timeout[0] > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout[0])
+		defer cancel()
+	}
+
+	var data []byte
+	for {
+		chunk, err := req.Read(ctx)
+		switch err {
+		case nil:
+			data = append(data, chunk...)
+		case ErrStreamIsClosed:
+			return data, nil
+		default:
+			return data, err
+		}
+	}
+}
+
+// Unpack reads the next chunk of the request and decodes it
+// as MessagePack into v. A decoding error describes the chunk and v,
+// so a handler can reply with it as is.
+func Unpack(ctx context.Context, req Request, v interface{}) error {
+	raw, err := req.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return unpackPayload(raw, v)
+}
+
+// UnpackAll reads the whole request like Request.ReadAll
+// and decodes the concatenated chunks as MessagePack into v.
+func UnpackAll(ctx context.Context, req Request, v interface{}) error {
+	raw, err := req.ReadAll(ctx)
+	if err != nil {
+		return err
+	}
+	return unpackPayload(raw, v)
+}
+
+func unpackPayload(raw []byte, v interface{}) error {
+	if err := decodeChunk(raw, v); err != nil {
+		return fmt.Errorf("unable to unpack %d bytes into %T: %v", len(raw), v, err)
+	}
+	return nil
+}
+
 type ReaderWithContext interface {
 	io.Reader
 	SetContext(ctx context.Context)
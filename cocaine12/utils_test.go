@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
 )
 
 func TestRequestReaderEOF(t *testing.T) {
@@ -93,3 +95,96 @@ func TestServiceResult(t *testing.T) {
 	assert.Equal(t, "A", s)
 	assert.Equal(t, 100, i)
 }
+
+func TestRequestRawAndDecode(t *testing.T) {
+	type tStruct struct {
+		L string
+		N int
+	}
+
+	var (
+		ctx      = context.Background()
+		expected = tStruct{"A", 100}
+		raw      []byte
+	)
+	assert.NoError(t, codec.NewEncoderBytes(&raw, payloadHandler).Encode(expected))
+
+	req := newRequest(newV1Protocol())
+	req.push(newChunkV1(2, raw))
+	req.push(newChunkV1(2, []byte{0xc1}))
+
+	var actual tStruct
+	chunk, err := req.RawAndDecode(ctx, &actual)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, chunk)
+	assert.Equal(t, expected, actual)
+
+	// the raw chunk is available even if it is malformed
+	chunk, err = req.RawAndDecode(ctx, &actual)
+	assert.Error(t, err)
+	assert.Equal(t, []byte{0xc1}, chunk)
+}
+
+func TestRequestReadAll(t *testing.T) {
+	ctx := context.Background()
+
+	req := newRequest(newV1Protocol())
+	req.push(newChunkV1(2, []byte("A")))
+	req.push(newChunkV1(2, []byte("BC")))
+	req.Close()
+
+	data, err := req.ReadAll(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ABC"), data)
+
+	// the stream is not closed, so the partial data is returned
+	req = newRequest(newV1Protocol())
+	req.push(newChunkV1(2, []byte("A")))
+	data, err = req.ReadAll(ctx, 50*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, []byte("A"), data)
+
+	req = newRequest(newV1Protocol())
+	req.push(newChunkV1(2, []byte("A")))
+	req.push(newErrorV1(2, 100, 200, "error"))
+	data, err = req.ReadAll(ctx)
+	assert.EqualError(t, err, (&ErrRequest{"error", 100, 200}).Error())
+	assert.Equal(t, []byte("A"), data)
+}
+
+func TestUnpack(t *testing.T) {
+	type tStruct struct {
+		L string
+		N int
+	}
+
+	var (
+		ctx      = context.Background()
+		expected = tStruct{"A", 100}
+		raw      []byte
+	)
+	assert.NoError(t, codec.NewEncoderBytes(&raw, payloadHandler).Encode(expected))
+
+	req := newRequest(newV1Protocol())
+	req.push(newChunkV1(2, raw))
+	req.push(newChunkV1(2, []byte{0xc1}))
+	// a body split into chunks
+	req.push(newChunkV1(2, raw[:3]))
+	req.push(newChunkV1(2, raw[3:]))
+	req.Close()
+
+	var actual tStruct
+	assert.NoError(t, Unpack(ctx, req, &actual))
+	assert.Equal(t, expected, actual)
+
+	err := Unpack(ctx, req, &actual)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to unpack 1 bytes into *cocaine12.tStruct")
+	}
+
+	actual = tStruct{}
+	assert.NoError(t, UnpackAll(ctx, req, &actual))
+	assert.Equal(t, expected, actual)
+
+	assert.Equal(t, ErrStreamIsClosed, Unpack(ctx, req, &actual))
+}
@@ -1,5 +1,12 @@
 package cocaine12
 
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
 // Worker performs IO operations between an application
 // and cocaine-runtime, dispatches incoming messages
 // This is an adapter to WorkerNG
@@ -7,15 +14,85 @@ type Worker struct {
 	impl               *WorkerNG
 	handlers           *EventHandlers
 	terminationHandler TerminationHandler
+	middlewares        []NamedMiddleware
+	// responses of idempotent events set by SetEventCache.
+	// Handlers look them up, so they are protected by cachesMu
+	cachesMu sync.RWMutex
+	caches   map[string]*eventCache
+	// refuse to run without handlers
+	strict bool
+}
+
+// HandlerOptions tune handling of a particular event
+type HandlerOptions struct {
+	// Timeout limits the time from an invoke to the close of the response,
+	// see OnWithTimeout. 0 means no timeout.
+	Timeout time.Duration
+	// KeepOpenAfterReturn makes the worker leave the response open
+	// when the handler returns, so it can be closed later
+	// by a background goroutine. Other events are still closed automatically.
+	KeepOpenAfterReturn bool
+	// MaxConcurrency limits the number of concurrently running handlers
+	// of the event, see SetEventConcurrency. 0 means no limit.
+	MaxConcurrency int
 }
 
-// NewWorker connects to the cocaine-runtime and create WorkerNG on top of this connection
+// ErrNoHandlers is returned by Worker.Run in the strict mode
+// if there are neither event handlers nor a fallback handler
+var ErrNoHandlers = errors.New("the worker has no handlers")
+
+// NewWorker connects to the cocaine-runtime and create WorkerNG on top of this connection.
+// The configuration is parsed from the command line by LoadWorkerConfig.
+// A dedicated FlagSet is used, so flag.CommandLine of the application
+// is neither parsed nor modified. NewWorkerWithOptions skips parsing at all.
 func NewWorker() (*Worker, error) {
-	impl, err := NewWorkerNG()
+	config, err := LoadWorkerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewWorkerWithOptions(WithConfig(config))
+}
+
+// NewWorkerWithOptions creates a worker configured by opts only,
+// without parsing the command line, e.g. to embed the worker
+// into a binary with its own flags or to run it in tests:
+//
+//	w, err := NewWorkerWithOptions(WithEndpoint(endpoint), WithUUID(uuid))
+func NewWorkerWithOptions(opts ...WorkerOption) (*Worker, error) {
+	impl, err := NewWorkerNGWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newWorkerWithImpl(impl), nil
+}
+
+// NewWorkerWithFramer works like NewWorker, but wraps messages
+// to cocaine-runtime into frames of a non-standard transport.
+// nil framer means the default framing.
+func NewWorkerWithFramer(framer Framer) (*Worker, error) {
+	impl, err := NewWorkerNGWithFramer(framer)
 	if err != nil {
 		return nil, err
 	}
-	return &Worker{impl, NewEventHandlers(), nil}, nil
+	return newWorkerWithImpl(impl), nil
+}
+
+// NewWorkerWithConfig works like NewWorker, but takes
+// the configuration from config instead of GetDefaults().
+func NewWorkerWithConfig(config WorkerConfig) (*Worker, error) {
+	impl, err := NewWorkerNGWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return newWorkerWithImpl(impl), nil
+}
+
+// newWorkerWithImpl wraps impl into the adapter without handlers
+func newWorkerWithImpl(impl *WorkerNG) *Worker {
+	return &Worker{
+		impl:     impl,
+		handlers: NewEventHandlers(),
+	}
 }
 
 // Used in tests only
@@ -24,7 +101,7 @@ func newWorker(conn socketIO, id string, protoVersion int, debug bool) (*Worker,
 	if err != nil {
 		return nil, err
 	}
-	return &Worker{impl, NewEventHandlers(), nil}, nil
+	return newWorkerWithImpl(impl), nil
 }
 
 // SetDebug enables debug mode of the Worker.
@@ -40,6 +117,371 @@ func (w *Worker) EnableStackSignal(enable bool) {
 	w.impl.EnableStackSignal(enable)
 }
 
+// SetOnConnError attaches the handler which is called
+// when the connection to cocaine-runtime fails to read or write.
+// It is not called when the connection is closed by the worker.
+func (w *Worker) SetOnConnError(handler ConnErrorHandler) {
+	w.impl.SetOnConnError(handler)
+}
+
+// SetLogger sets the logger which is used by the worker
+// to report abnormal situations
+func (w *Worker) SetLogger(logger Logger) {
+	w.impl.SetLogger(logger)
+}
+
+// SetMetrics sets the receiver of the worker's metrics
+func (w *Worker) SetMetrics(metrics Metrics) {
+	w.impl.SetMetrics(metrics)
+}
+
+// AdvanceClock moves the time of the fake clock set by WithClock forward,
+// so timers of the worker fire without sleeping.
+// It is intended for tests only and returns ErrNoFakeClock if there is no fake clock.
+func (w *Worker) AdvanceClock(d time.Duration) error {
+	return w.impl.AdvanceClock(d)
+}
+
+// SetMaxChunksPerSession limits the number of chunks a client is allowed
+// to send in a single session. If a client exceeds the limit,
+// the session is terminated with ErrorTooManyChunks. 0 means no limit.
+func (w *Worker) SetMaxChunksPerSession(n int) {
+	w.impl.SetMaxChunksPerSession(n)
+}
+
+// SetChunkReassembly makes the worker join parts of a message
+// split by a client with ChunkContinuedHeader, so Read returns
+// the whole message at once.
+func (w *Worker) SetChunkReassembly(enable bool) {
+	w.impl.SetChunkReassembly(enable)
+}
+
+// SetFlowControlWindow bounds the number of bytes of a response queued
+// for the connection. Once the window is full, Response.Write blocks
+// until the connection drains. 0 means no limit.
+func (w *Worker) SetFlowControlWindow(window int) {
+	w.impl.SetFlowControlWindow(window)
+}
+
+// SetRequestIDEcho makes the worker attach RequestIDHeader
+// to the first frame of every response.
+func (w *Worker) SetRequestIDEcho(enable bool) {
+	w.impl.SetRequestIDEcho(enable)
+}
+
+// SetProgressFrames makes Response.SetProgress send dedicated frames,
+// which need a patched cocaine-runtime.
+func (w *Worker) SetProgressFrames(enable bool) {
+	w.impl.SetProgressFrames(enable)
+}
+
+// SetMaxPayload limits the number of bytes a client is allowed to send
+// in a single session as well as the number of bytes a handler
+// is allowed to reply. If a client exceeds the limit, the session
+// is terminated with ErrorPayloadTooLarge. A write of a handler
+// over the limit fails with ErrPayloadTooLarge. 0 means no limit.
+func (w *Worker) SetMaxPayload(bytes int) {
+	w.impl.SetMaxPayload(bytes)
+}
+
+// SetEventMaxPayload overrides SetMaxPayload for sessions of the event,
+// 0 removes the override.
+func (w *Worker) SetEventMaxPayload(event string, bytes int) {
+	w.impl.SetEventMaxPayload(event, bytes)
+}
+
+// SetResponseDeadline bounds the time from an invoke to the close
+// of the response. If a handler has not closed the response in time,
+// the worker replies with ErrorResponseDeadline and cancels the context
+// of the handler. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetResponseDeadline(d time.Duration) {
+	w.impl.SetResponseDeadline(d)
+}
+
+// UpdateTimeouts changes timeouts of the running worker.
+// The next heartbeat is sent after the new interval,
+// session timeouts are applied to new sessions and chunks.
+// It blocks until the loop of the worker applies the values,
+// so it must be called after Worker.Run.
+// ErrWorkerStopped is returned if the worker has been stopped.
+func (w *Worker) UpdateTimeouts(cfg TimeoutConfig) error {
+	return w.impl.UpdateTimeouts(cfg)
+}
+
+// SetRequestIdleTimeout limits the time between chunks of a request.
+// If a client sends neither a chunk nor a choke in time,
+// Read of the handler returns ErrRequest with ErrorRequestIdleTimeout
+// and the session is closed with the same error. 0 means no limit.
+func (w *Worker) SetRequestIdleTimeout(d time.Duration) {
+	w.impl.SetRequestIdleTimeout(d)
+}
+
+// SetMaxActiveHandlers limits the number of concurrently running handlers.
+// The behavior of the worker under the limit is defined by SetBackpressureMode.
+// 0 means no limit.
+func (w *Worker) SetMaxActiveHandlers(n int) {
+	w.impl.SetMaxActiveHandlers(n)
+}
+
+// SetMaxConcurrentSessions limits the number of sessions, which have been
+// invoked, but not closed by a client yet. If the limit is reached,
+// new invokes are rejected with ErrorOverloaded. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetMaxConcurrentSessions(n int) {
+	w.impl.SetMaxConcurrentSessions(n)
+}
+
+// Stats returns a snapshot of counters of the worker,
+// e.g. to publish them to a monitoring system.
+func (w *Worker) Stats() WorkerStats {
+	return w.impl.Stats()
+}
+
+// SetOverloadRetryAfter sets the hint sent with ErrorOverloaded rejections,
+// so clients know when to retry. 0 means no hint.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetOverloadRetryAfter(retryAfter time.Duration) {
+	w.impl.SetOverloadRetryAfter(retryAfter)
+}
+
+// ActiveSessions returns the number of sessions, which have been
+// invoked, but not closed by a client yet.
+func (w *Worker) ActiveSessions() int {
+	return w.impl.ActiveSessions()
+}
+
+// SetBackpressureMode defines how the worker behaves when
+// the limit of active handlers is reached.
+// In ModeThrottle the worker defers an invoke and stops reading
+// until a handler finishes. Heartbeats keep flowing,
+// so a throttled worker is not disowned.
+func (w *Worker) SetBackpressureMode(mode BackpressureMode) {
+	w.impl.SetBackpressureMode(mode)
+}
+
+// SetDuplicateSessionPolicy defines how the worker behaves when
+// cocaine-runtime sends an invoke with the id of an active session.
+func (w *Worker) SetDuplicateSessionPolicy(policy DuplicateSessionPolicy) {
+	w.impl.SetDuplicateSessionPolicy(policy)
+}
+
+// SetEventConcurrency limits the number of concurrently running handlers
+// of the event, so a heavy event can not take all the capacity of the worker.
+// The behavior under the limit is defined by SetBackpressureMode.
+// 0 removes the limit.
+func (w *Worker) SetEventConcurrency(event string, max int) {
+	w.impl.SetEventConcurrency(event, max)
+}
+
+// SetRecentRequestsSize makes the worker keep summaries
+// of the last n completed requests. 0 disables it.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetRecentRequestsSize(n int) {
+	w.impl.SetRecentRequestsSize(n)
+}
+
+// RecentRequests returns summaries of the last completed requests
+// from the oldest to the newest. Use SetRecentRequestsSize to enable it.
+func (w *Worker) RecentRequests() []RequestSummary {
+	return w.impl.RecentRequests()
+}
+
+// SetAutoClose defines whether the worker closes a response
+// when a handler returns without closing it. It's enabled by default.
+// Disable it if handlers keep replying from other goroutines after return.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetAutoClose(autoClose bool) {
+	w.impl.SetAutoClose(autoClose)
+}
+
+// SetRecoverMapper sets the function which converts a panic
+// in a handler to an error sent to a client.
+// By default every panic is reported as ErrorPanicInHandler.
+func (w *Worker) SetRecoverMapper(mapper RecoverMapper) {
+	w.impl.SetRecoverMapper(mapper)
+}
+
+// SetPanicHandler replaces the default handling of a panic in a handler,
+// e.g. to report panics to an alerting system. By default the worker
+// logs the panic with the stack and replies with ErrorPanicInHandler.
+// The handler must reply to the response itself.
+func (w *Worker) SetPanicHandler(handler PanicHandler) {
+	w.impl.SetPanicHandler(handler)
+}
+
+// SetPanicReportHandler works like SetPanicHandler, but the handler
+// receives the session id and the request snapshot as well.
+func (w *Worker) SetPanicReportHandler(handler PanicReportHandler) {
+	w.impl.SetPanicReportHandler(handler)
+}
+
+// SetPanicRequestSnapshot makes the worker report the first chunk
+// read by a handler along with a panic. The chunk is passed through
+// redact and cut to 1KB. It is disabled by default for privacy.
+func (w *Worker) SetPanicRequestSnapshot(redact func(chunk []byte) []byte) {
+	w.impl.SetPanicRequestSnapshot(redact)
+}
+
+// OnStart sets the function which is called once the worker is ready
+// to handle requests, e.g. to open a DB pool. If it returns an error,
+// the worker is stopped and Run returns the error.
+func (w *Worker) OnStart(hook func() error) {
+	w.impl.OnStart(hook)
+}
+
+// SetStartupProbe sets the function, which checks dependencies
+// of the application once OnStart has succeeded. Requests wait
+// for the probe, while heartbeats are kept sent. A failed probe is retried
+// with backoff until the deadline expires, then Run returns StartupProbeError.
+func (w *Worker) SetStartupProbe(probe func(ctx context.Context) error, deadline time.Duration) {
+	w.impl.SetStartupProbe(probe, deadline)
+}
+
+// OnStop sets the function which is called right before Run returns,
+// e.g. to close resources opened by OnStart.
+func (w *Worker) OnStop(hook func()) {
+	w.impl.OnStop(hook)
+}
+
+// SetVersion sets the version of the application.
+// It is attached to the worker's logs, access log entries and session metrics
+// to correlate the behavior with deploys. It is empty by default.
+func (w *Worker) SetVersion(version string) {
+	w.impl.SetVersion(version)
+}
+
+// Version returns the version of the application set by SetVersion
+func (w *Worker) Version() string {
+	return w.impl.Version()
+}
+
+// SetAccessLogger sets the logger which receives an AccessLogEntry
+// for every finished session.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetAccessLogger(logger AccessLogger) {
+	w.impl.SetAccessLogger(logger)
+}
+
+// SetAccessLogService makes the worker emit access log entries
+// in batches to a cocaine logging service.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetAccessLogService(service *Service) {
+	w.impl.SetAccessLogService(service)
+}
+
+// DisableEvent makes the worker reject new requests for the event
+// with ErrorEventDisabled until EnableEvent is called.
+// It is safe to call it while the worker is running.
+func (w *Worker) DisableEvent(event string) {
+	w.impl.DisableEvent(event)
+}
+
+// DeprecateEvent marks the event as deprecated. Requests for the event
+// are still handled, but every invoke is counted by Metrics.IncDeprecatedEvent
+// and the worker logs a warning with the message once per minute.
+// It is safe to call it while the worker is running.
+func (w *Worker) DeprecateEvent(event string, message string) {
+	w.impl.DeprecateEvent(event, message)
+}
+
+// EnableEvent restores handling of the event disabled by DisableEvent
+func (w *Worker) EnableEvent(event string) {
+	w.impl.EnableEvent(event)
+}
+
+// SetDedicatedHeartbeat makes the worker send heartbeats from
+// a separate goroutine, so they are not delayed by message processing.
+// The tradeoff is that cocaine-runtime keeps receiving heartbeats
+// even if the worker is not able to handle messages anymore.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetDedicatedHeartbeat(dedicated bool) {
+	w.impl.SetDedicatedHeartbeat(dedicated)
+}
+
+// SetHandshakeBuilder replaces the builder of the handshake message,
+// which is sent to cocaine-runtime when the worker starts.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetHandshakeBuilder(builder HandshakeBuilder) {
+	w.impl.SetHandshakeBuilder(builder)
+}
+
+// SetReadinessNotify sets the function which is called once
+// the worker is ready to handle requests. It must not block.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetReadinessNotify(notify func()) {
+	w.impl.SetReadinessNotify(notify)
+}
+
+// SetHeartbeatBuilder replaces the builder of heartbeat messages.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetHeartbeatBuilder(builder HeartbeatBuilder) {
+	w.impl.SetHeartbeatBuilder(builder)
+}
+
+// SetStrictMode makes Worker.Run return ErrNoHandlers instead of
+// a warning if neither event handlers nor a fallback handler are set.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetStrictMode(strict bool) {
+	w.strict = strict
+}
+
+// ReplayResponse sends frames of a response, which has been recorded
+// before, to the session. The frames are copied with the session id replaced,
+// so they can be replayed more than once. It returns ErrWorkerClosed
+// if the worker has been stopped or disowned.
+func (w *Worker) ReplayResponse(session uint64, frames []*Message) error {
+	return w.impl.ReplayResponse(session, frames)
+}
+
+// SetEnvelopeCodec replaces MessagePack as the envelope of messages
+// exchanged with cocaine-runtime, including the handshake and heartbeats.
+// It is intended for experimental runtimes only, as cocaine-runtime
+// must expect the same envelope. Payloads of chunks are not affected.
+// This function must be called before Worker.Run to take effect.
+func (w *Worker) SetEnvelopeCodec(codec Codec) {
+	w.impl.SetEnvelopeCodec(codec)
+}
+
+// Shutdown stops the worker gracefully. New invokes are rejected
+// with ErrorWorkerTerminating, while active handlers are allowed
+// to finish until ctx is done. Then remaining handlers are cancelled,
+// pending replies are flushed and the worker is stopped.
+// It returns ctx.Err() if handlers have not finished in time
+// and ErrWorkerStopped if the worker is stopped or terminated
+// by cocaine-runtime meanwhile. It must be called after Worker.Run.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	return w.impl.Shutdown(ctx)
+}
+
+// MigrateTo moves the worker to another endpoint of cocaine-runtime.
+// Active sessions are drained on the old connection, which is closed then.
+// Invokes from the new endpoint are handled after that.
+// It blocks until the migration is finished, so it must be called
+// after Worker.Run.
+func (w *Worker) MigrateTo(endpoint string) error {
+	return w.impl.MigrateTo(endpoint)
+}
+
+// Sessions returns active sessions of the worker.
+// It must be called after Worker.Run.
+func (w *Worker) Sessions() []SessionInfo {
+	return w.impl.Sessions()
+}
+
+// CancelAllSessions cancels all active sessions and returns them,
+// e.g. to drop stuck requests from an admin endpoint.
+// It must be called after Worker.Run.
+func (w *Worker) CancelAllSessions() []SessionInfo {
+	return w.impl.CancelAllSessions()
+}
+
+// Transport returns the network of the connection to cocaine-runtime,
+// e.g. "unix" or "tcp". It is empty if the transport is unknown.
+func (w *Worker) Transport() string {
+	return w.impl.Transport()
+}
+
 // Token returns the most recently viewed version of the authorization token.
 func (w *Worker) Token() Token {
 	return w.impl.Token()
@@ -51,9 +493,113 @@ func (w *Worker) SetTerminationHandler(handler TerminationHandler) {
 	w.terminationHandler = handler
 }
 
-// On binds the handler for a given event
+// On binds the handler for a given event.
+// It is safe to call it concurrently, including while the worker is running:
+// invokes which arrive after On returns are handled by the new handler.
 func (w *Worker) On(event string, handler EventHandler) {
-	w.handlers.On(event, handler)
+	w.handlers.On(event, w.withCache(event, handler))
+}
+
+// SetEventCache caches responses of an idempotent event for ttl,
+// so a request with the same key is served without running the handler.
+// keyFn calculates the key of a request. Chunks it reads are read
+// by the handler again. An empty key means the request is not cached.
+// Only responses closed by the handler without an error are cached,
+// so a response closed by the worker after the handler returns is not.
+// The cache is applied inside middlewares, so they run on every request.
+// 0 ttl disables the cache.
+// Like On it is safe to call it while the worker is running:
+// invokes which arrive after it returns use the new cache.
+func (w *Worker) SetEventCache(event string, keyFn func(Request) string, ttl time.Duration) {
+	w.cachesMu.Lock()
+	defer w.cachesMu.Unlock()
+
+	if ttl <= 0 {
+		delete(w.caches, event)
+		return
+	}
+
+	if w.caches == nil {
+		w.caches = make(map[string]*eventCache)
+	}
+	w.caches[event] = newEventCache(keyFn, ttl, w.impl.clock)
+}
+
+// withCache serves the event from its cache if SetEventCache
+// has been called for it either before or after On
+func (w *Worker) withCache(event string, handler EventHandler) EventHandler {
+	return func(ctx context.Context, req Request, res Response) {
+		w.cachesMu.RLock()
+		cache, ok := w.caches[event]
+		w.cachesMu.RUnlock()
+		if !ok {
+			handler(ctx, req, res)
+			return
+		}
+		cache.serve(ctx, req, res, handler)
+	}
+}
+
+// Off unbinds the handler of a given event, so next invokes of the event
+// are handled by the fallback handler. Running handlers are not affected.
+// Options of the event set by OnWithOptions are kept.
+// Like On it is safe to call it while the worker is running.
+func (w *Worker) Off(event string) {
+	w.handlers.Off(event)
+}
+
+// OnWithTimeout works like On, but limits the time from an invoke
+// of the event to the close of the response. If the handler has not closed
+// the response in time, the worker replies with ErrorHandlerTimeout
+// and cancels the context of the handler.
+func (w *Worker) OnWithTimeout(event string, handler EventHandler, timeout time.Duration) {
+	w.OnWithOptions(event, handler, HandlerOptions{Timeout: timeout})
+}
+
+// OnWithOptions binds the handler for a given event
+// with the options of handling. Unlike On, it must be called
+// before Worker.Run, as the options are not synchronized with the worker.
+func (w *Worker) OnWithOptions(event string, handler EventHandler, opts HandlerOptions) {
+	w.On(event, handler)
+	w.impl.SetEventTimeout(event, opts.Timeout)
+	w.impl.SetEventKeepOpen(event, opts.KeepOpenAfterReturn)
+	w.impl.SetEventConcurrency(event, opts.MaxConcurrency)
+}
+
+// OnWithConcurrency works like On, but limits the number of concurrently
+// running handlers of the event. Invokes beyond the limit are rejected
+// with ErrorOverloaded or deferred depending on SetBackpressureMode.
+func (w *Worker) OnWithConcurrency(event string, handler EventHandler, maxInflight int) {
+	w.OnWithOptions(event, handler, HandlerOptions{MaxConcurrency: maxInflight})
+}
+
+// Use wraps every handler bound by On and the fallback handler
+// by the middlewares. Middlewares are called in the order of registration.
+// A middleware can reply with an error instead of calling the next handler.
+// A panic in a middleware is recovered like a panic in a handler.
+// This function must be called before Worker.Run and Worker.InvokeLocal
+// to take effect.
+func (w *Worker) Use(middlewares ...Middleware) {
+	for _, mw := range middlewares {
+		w.middlewares = append(w.middlewares, NamedMiddleware{middlewareName(mw), mw})
+	}
+}
+
+// UseNamed works like Use, but keeps the given names of middlewares
+// to be reported by Middlewares.
+func (w *Worker) UseNamed(middlewares ...NamedMiddleware) {
+	w.middlewares = append(w.middlewares, middlewares...)
+}
+
+// Middlewares returns names of registered middlewares in the order
+// they are called. A middleware registered by Use is named
+// after its function.
+func (w *Worker) Middlewares() []string {
+	names := make([]string, 0, len(w.middlewares))
+	for _, mw := range w.middlewares {
+		names = append(names, mw.Name)
+	}
+	return names
 }
 
 // SetFallbackHandler sets the handler to be a fallback handler
@@ -62,13 +608,41 @@ func (w *Worker) SetFallbackHandler(handler FallbackEventHandler) {
 }
 
 func (w *Worker) Run(handlers map[string]EventHandler) error {
+	if err := w.prepare(handlers); err != nil {
+		return err
+	}
+	return w.impl.Run(w.handlers.Call, w.terminationHandler)
+}
+
+// RunWithReconnect works like Run, but dials cocaine-runtime again
+// with the backoff once the worker is disowned or the connection is lost.
+// Active sessions are cancelled on a reconnection.
+// It requires the worker to be created with an endpoint.
+func (w *Worker) RunWithReconnect(handlers map[string]EventHandler, backoff Backoff) error {
+	if err := w.prepare(handlers); err != nil {
+		return err
+	}
+	return w.impl.RunWithReconnect(w.handlers.Call, w.terminationHandler, backoff)
+}
+
+func (w *Worker) prepare(handlers map[string]EventHandler) error {
 	for event, handler := range handlers {
 		w.On(event, handler)
 	}
-	return w.impl.Run(w.handlers.Call, w.terminationHandler)
+
+	if w.handlers.isEmpty() {
+		if w.strict {
+			return ErrNoHandlers
+		}
+		w.impl.logWithFields(Fields{}).Warnf("the worker has no handlers, so every event is rejected")
+	}
+
+	w.handlers.use(w.middlewares)
+	return nil
 }
 
-// Stop makes the Worker stop handling requests
+// Stop makes the Worker stop handling requests.
+// The worker can not be run again after Stop, Run returns ErrWorkerStopped
 func (w *Worker) Stop() {
 	w.impl.Stop()
 }
@@ -2,7 +2,10 @@ package cocaine12
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"sync"
 )
 
 // EventHandler represents a type of handler
@@ -11,33 +14,102 @@ type EventHandler func(context.Context, Request, Response)
 // RequestHandler represents a type of handler
 type RequestHandler func(context.Context, string, Request, Response)
 
-// TerminationHandler invokes when termination message is received
+// TerminationHandler invokes when termination message is received.
+// If cocaine-runtime grants a grace period, the context expires
+// when it is over. Otherwise it expires in 5 seconds
 type TerminationHandler func(context.Context)
 
+// ConnErrorHandler is called when the connection to cocaine-runtime
+// fails to read or write. op is either "read" or "write"
+type ConnErrorHandler func(op string, err error)
+
+// RecoverMapper converts a value recovered from a panic in a handler
+// of the event to an error for a client. Only Code and Message are sent.
+// If it returns nil, the panic is reported as ErrorPanicInHandler
+type RecoverMapper func(event string, recovered interface{}) *ErrRequest
+
+// PanicHandler handles a value recovered from a panic in a handler
+// of the event. stack is the stack of the panicked handler.
+// It must reply to the response
+type PanicHandler func(event string, recovered interface{}, stack []byte, response Response)
+
+// PanicReportHandler handles a panic in a handler like PanicHandler,
+// but receives the session and the request snapshot as well.
+// It must reply to the response
+type PanicReportHandler func(report PanicReport, response Response)
+
+// HandshakeBuilder builds the handshake message for a worker with the given id
+type HandshakeBuilder func(id string) *Message
+
+// HeartbeatBuilder builds a heartbeat message
+type HeartbeatBuilder func() *Message
+
 // FallbackEventHandler handles an event if there is no other handler
 // for the given event
 type FallbackEventHandler RequestHandler
 
+// EventHandlers maps events to handlers.
+// It is safe to bind and unbind handlers while the worker is running
 type EventHandlers struct {
+	mu       sync.RWMutex
 	fallback RequestHandler
 	handlers map[string]EventHandler
+	// set if the fallback is not DefaultFallbackHandler
+	customFallback bool
+	// wrap handlers bound after use is called
+	middlewares []NamedMiddleware
 }
 
 func NewEventHandlersFromMap(handlers map[string]EventHandler) *EventHandlers {
-	return &EventHandlers{DefaultFallbackHandler, handlers}
+	return &EventHandlers{
+		fallback: DefaultFallbackHandler,
+		handlers: handlers,
+	}
 }
 
 func NewEventHandlers() *EventHandlers {
 	return NewEventHandlersFromMap(make(map[string]EventHandler))
 }
 
+// On binds the handler for a given event.
+// It can be called concurrently with Call
 func (e *EventHandlers) On(name string, handler EventHandler) {
-	e.handlers[name] = handler
+	e.mu.Lock()
+	e.handlers[name] = chainMiddlewares(e.middlewares, handler)
+	e.mu.Unlock()
+}
+
+// Off unbinds the handler of a given event, so the event
+// is handled by the fallback handler. It can be called concurrently with Call
+func (e *EventHandlers) Off(name string) {
+	e.mu.Lock()
+	delete(e.handlers, name)
+	e.mu.Unlock()
 }
 
 // SetFallbackHandler sets the handler to be a fallback handler
 func (e *EventHandlers) SetFallbackHandler(handler RequestHandler) {
-	e.fallback = handler
+	e.mu.Lock()
+	e.fallback = wrapFallback(e.middlewares, handler)
+	e.customFallback = true
+	e.mu.Unlock()
+}
+
+// lookup returns the handler bound for the event. wrapped reports
+// whether it has been already wrapped by middlewares passed to use
+func (e *EventHandlers) lookup(name string) (handler EventHandler, wrapped bool, ok bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	handler, ok = e.handlers[name]
+	return handler, e.middlewares != nil, ok
+}
+
+// isEmpty reports whether every event is rejected
+// by DefaultFallbackHandler
+func (e *EventHandlers) isEmpty() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.handlers) == 0 && !e.customFallback
 }
 
 // DefaultFallbackHandler sends an error message if a client requests
@@ -47,10 +119,89 @@ func DefaultFallbackHandler(ctx context.Context, event string, request Request,
 	response.ErrorMsg(ErrorNoEventHandler, errMsg)
 }
 
+// LoggingFallbackHandler returns a fallback handler which reads the whole request
+// and logs its size and SHA1 hash before replying like DefaultFallbackHandler.
+// The content of the request is not logged.
+// It helps to find out what clients send to unknown events.
+func LoggingFallbackHandler(logger Logger) FallbackEventHandler {
+	return func(ctx context.Context, event string, request Request, response Response) {
+		var (
+			hash   = sha1.New()
+			size   int
+			chunks int
+			err    error
+		)
+
+		for {
+			var chunk []byte
+			if chunk, err = request.Read(ctx); err != nil {
+				break
+			}
+
+			hash.Write(chunk)
+			size += len(chunk)
+			chunks++
+		}
+
+		fields := Fields{
+			"event":  event,
+			"chunks": chunks,
+			"size":   size,
+			"sha1":   hex.EncodeToString(hash.Sum(nil)),
+		}
+		if err != ErrStreamIsClosed {
+			fields["error"] = err.Error()
+		}
+		logger.WithFields(fields).Warnf("request to an unhandled event")
+
+		DefaultFallbackHandler(ctx, event, request, response)
+	}
+}
+
+// use wraps the bound handlers, including the fallback handler,
+// and handlers bound later by the middlewares.
+// Only the first call with middlewares takes effect
+func (e *EventHandlers) use(middlewares []NamedMiddleware) {
+	if len(middlewares) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.middlewares != nil {
+		// already wrapped
+		return
+	}
+
+	e.middlewares = middlewares
+	for name, handler := range e.handlers {
+		e.handlers[name] = chainMiddlewares(middlewares, handler)
+	}
+	e.fallback = wrapFallback(middlewares, e.fallback)
+}
+
+// wrapFallback wraps the fallback handler by the middlewares
+func wrapFallback(middlewares []NamedMiddleware, fallback RequestHandler) RequestHandler {
+	if len(middlewares) == 0 {
+		return fallback
+	}
+
+	return func(ctx context.Context, event string, request Request, response Response) {
+		handler := func(ctx context.Context, request Request, response Response) {
+			fallback(ctx, event, request, response)
+		}
+		chainMiddlewares(middlewares, handler)(ctx, request, response)
+	}
+}
+
 func (e *EventHandlers) Call(ctx context.Context, event string, request Request, response Response) {
-	handler := e.handlers[event]
+	e.mu.RLock()
+	handler, fallback := e.handlers[event], e.fallback
+	e.mu.RUnlock()
+
 	if handler == nil {
-		e.fallback(ctx, event, request, response)
+		fallback(ctx, event, request, response)
 		return
 	}
 	handler(ctx, request, response)
@@ -2,6 +2,9 @@ package cocaine12
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/ugorji/go/codec"
 )
 
 const (
@@ -18,6 +21,97 @@ func (e *ErrRequest) Error() string {
 	return fmt.Sprintf("[%d] [%d] %s", e.Category, e.Code, e.Message)
 }
 
+// DecodeCocaineError decodes the msgpacked payload of an error frame.
+// Both [[category, code], message] and the older [code, message]
+// shapes are supported. The category of the latter is 0.
+func DecodeCocaineError(payload []byte) (*ErrRequest, error) {
+	var tuple []interface{}
+	if err := codec.NewDecoderBytes(payload, payloadHandler).Decode(&tuple); err != nil {
+		return nil, err
+	}
+	return decodeErrorTuple(tuple)
+}
+
+func decodeErrorPayload(payload []interface{}) (*ErrRequest, error) {
+	// payload may be built in place, so its values
+	// are normalized to decoded msgpack types
+	var tuple []interface{}
+	if err := convertPayload(payload, &tuple); err != nil {
+		return nil, err
+	}
+	return decodeErrorTuple(tuple)
+}
+
+func decodeErrorTuple(tuple []interface{}) (*ErrRequest, error) {
+	if len(tuple) != 2 {
+		return nil, ErrMalformedErrorMessage
+	}
+
+	var perr ErrRequest
+	switch codeInfo := tuple[0].(type) {
+	case []interface{}:
+		if len(codeInfo) != 2 {
+			return nil, ErrMalformedErrorMessage
+		}
+
+		var okCategory, okCode bool
+		perr.Category, okCategory = payloadToInt(codeInfo[0])
+		perr.Code, okCode = payloadToInt(codeInfo[1])
+		if !okCategory || !okCode {
+			return nil, ErrMalformedErrorMessage
+		}
+	default:
+		var ok bool
+		if perr.Code, ok = payloadToInt(codeInfo); !ok {
+			return nil, ErrMalformedErrorMessage
+		}
+	}
+
+	switch message := tuple[1].(type) {
+	case string:
+		perr.Message = message
+	case []byte:
+		perr.Message = string(message)
+	default:
+		return nil, ErrMalformedErrorMessage
+	}
+
+	return &perr, nil
+}
+
+func payloadToInt(value interface{}) (int, bool) {
+	switch number := value.(type) {
+	case int64:
+		return int(number), true
+	case uint64:
+		return int(number), true
+	case int:
+		return number, true
+	}
+	return 0, false
+}
+
+// terminateGrace returns the time granted by cocaine-runtime
+// to finish active sessions. It is passed in seconds
+// as an optional third element of the terminate payload
+func terminateGrace(payload []interface{}) time.Duration {
+	if len(payload) < 3 {
+		return 0
+	}
+
+	switch seconds := payload[2].(type) {
+	case float64:
+		return time.Duration(seconds * float64(time.Second))
+	case float32:
+		return time.Duration(float64(seconds) * float64(time.Second))
+	default:
+		if n, ok := payloadToInt(seconds); ok {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return 0
+}
+
 type messageTypeDetector interface {
 	isChunk(msg *Message) bool
 }
@@ -41,6 +135,7 @@ type handlerProtocolGenerator interface {
 	newChoke(session uint64) *Message
 	newChunk(session uint64, data []byte) *Message
 	newError(session uint64, category, code int, message string) *Message
+	newProgress(session uint64, pct float64) *Message
 }
 
 type protocolDispather interface {
@@ -50,6 +145,10 @@ type protocolDispather interface {
 }
 
 func getEventName(msg *Message) (string, bool) {
+	if len(msg.Payload) == 0 {
+		return "", false
+	}
+
 	switch event := msg.Payload[0].(type) {
 	case string:
 		return event, true
@@ -0,0 +1,105 @@
+package cocaine12
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// workerSession keeps the state of a session
+// opened by cocaine-runtime
+type workerSession struct {
+	requestStream
+	response *response
+	// cancels the context of the handler
+	cancel context.CancelFunc
+	// fires when the response deadline is exceeded, nil if disabled
+	deadline Timer
+	// fires when a client sends no chunks for a while, nil if disabled.
+	// It is owned by the loop as well as lastChunk
+	idle      Timer
+	lastChunk time.Time
+
+	id        uint64
+	event     string
+	startTime time.Time
+	// number of chunks received from a client
+	chunks int
+	// number of bytes received from a client.
+	// It must be accessed atomically
+	bytesIn int64
+	// the limit of bytesIn, 0 means no limit
+	maxPayload int64
+	// parts of a message being reassembled, see SetChunkReassembly.
+	// continued is set after a part with ChunkContinuedHeader
+	partial   []byte
+	continued bool
+}
+
+func newWorkerSession(id uint64, event string, request requestStream, response *response, cancel context.CancelFunc) *workerSession {
+	return &workerSession{
+		requestStream: request,
+		response:      response,
+		cancel:        cancel,
+		id:            id,
+		event:         event,
+		startTime:     time.Now(),
+		chunks:        0,
+	}
+}
+
+// stopDeadline stops the timer of the response deadline if any
+func (s *workerSession) stopDeadline() {
+	if s.deadline != nil {
+		s.deadline.Stop()
+	}
+}
+
+// stopIdle stops the timer of the request idle timeout if any
+func (s *workerSession) stopIdle() {
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+}
+
+// reassemble buffers a part of a message followed by another one.
+// It reports whether msg should be delivered to the handler.
+// The payload of the last part is replaced by the whole message
+func (s *workerSession) reassemble(msg *Message) bool {
+	if len(msg.Payload) == 0 {
+		return true
+	}
+
+	data, ok := msg.Payload[0].([]byte)
+	if !ok {
+		// let Read report ErrBadPayload
+		return true
+	}
+
+	if msg.Headers.ChunkContinued() {
+		s.partial = append(s.partial, data...)
+		s.continued = true
+		return false
+	}
+
+	if s.continued {
+		whole := append(s.flushPartial(), data...)
+		msg.Payload = []interface{}{whole}
+	}
+	return true
+}
+
+// flushPartial returns buffered parts of a message and resets them
+func (s *workerSession) flushPartial() []byte {
+	partial := s.partial
+	s.partial, s.continued = nil, false
+	return partial
+}
+
+func (s *workerSession) addBytesIn(n int) {
+	atomic.AddInt64(&s.bytesIn, int64(n))
+}
+
+func (s *workerSession) getBytesIn() int64 {
+	return atomic.LoadInt64(&s.bytesIn)
+}
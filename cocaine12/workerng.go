@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -18,11 +20,52 @@ const (
 	disownTimeout         = time.Second * 5
 	coreConnectionTimeout = time.Second * 5
 	terminationTimeout    = time.Second * 5
+	heartbeatWriteTimeout = time.Second
+	// the time to flush replies before the connection is closed
+	flushTimeout = time.Second
+
+	// a warning about a deprecated event is logged once per the interval
+	deprecationWarningInterval = time.Minute
 
 	// ErrorNoEventHandler returns when there is no handler for a given event
 	ErrorNoEventHandler = 200
 	// ErrorPanicInHandler returns when a handler is recovered from panic
 	ErrorPanicInHandler = 100
+	// ErrorTooManyChunks returns when a client sends more chunks
+	// than it is allowed by Worker.SetMaxChunksPerSession
+	ErrorTooManyChunks = 300
+	// ErrorEventDisabled returns when an event is disabled by
+	// Worker.DisableEvent. A client may retry the request later
+	ErrorEventDisabled = 301
+	// ErrorWorkerTerminating returns when a session is cancelled
+	// because the worker is being terminated by cocaine-runtime
+	ErrorWorkerTerminating = 302
+	// ErrorOverloaded returns when the limit of active handlers
+	// set by Worker.SetMaxActiveHandlers or the limit of sessions
+	// set by Worker.SetMaxConcurrentSessions is reached
+	ErrorOverloaded = 303
+	// ErrorUnauthorized returns when AuthMiddleware rejects a request
+	ErrorUnauthorized = 304
+	// ErrorResponseDeadline returns when a handler has not closed
+	// a response within Worker.SetResponseDeadline
+	ErrorResponseDeadline = 305
+	// ErrorRequestIdleTimeout returns when a client has sent no chunks
+	// within Worker.SetRequestIdleTimeout
+	ErrorRequestIdleTimeout = 306
+	// ErrorHandlerTimeout returns when a handler has not closed
+	// a response within the timeout of its event set by Worker.OnWithTimeout
+	ErrorHandlerTimeout = 307
+	// ErrorPayloadTooLarge returns when a client has sent more bytes
+	// than it is allowed by Worker.SetMaxPayload or Worker.SetEventMaxPayload
+	ErrorPayloadTooLarge = 308
+	// ErrorMalformedInvoke returns when an invoke has no event name
+	ErrorMalformedInvoke = 309
+	// ErrorSessionCancelled returns when a session is cancelled
+	// by Worker.CancelAllSessions
+	ErrorSessionCancelled = 310
+	// ErrorDuplicateSession returns when cocaine-runtime reuses
+	// the id of an active session, see Worker.SetDuplicateSessionPolicy
+	ErrorDuplicateSession = 311
 )
 
 var (
@@ -35,8 +78,44 @@ var (
 	// ErrConnectionLost means that the connection between the worker and
 	// runtime has been lost
 	ErrConnectionLost = errors.New("the connection to runtime has been lost")
+	// ErrWorkerStopped is returned by Run if the worker has been stopped.
+	// A stopped worker can not be run again
+	ErrWorkerStopped = errors.New("the worker has been stopped")
+	// ErrMigrationInProgress is returned by MigrateTo
+	// if the previous migration has not finished yet
+	ErrMigrationInProgress = errors.New("the worker is already migrating")
+
+	// ErrWorkerNotRunning is returned by requests to the loop of the worker,
+	// which is not running, e.g. before Run
+	ErrWorkerNotRunning = errors.New("the worker is not running")
+	// ErrNoFakeClock is returned by AdvanceClock
+	// if the worker has not been created WithClock(NewFakeClock())
+	ErrNoFakeClock = errors.New("the worker has no fake clock")
+	// ErrInvalidTimeouts is returned by UpdateTimeouts
+	// if TimeoutConfig contains an unacceptable value
+	ErrInvalidTimeouts = errors.New("heartbeat and disown timeouts must be positive, others must not be negative")
 )
 
+// TimeoutConfig describes timeouts of the running worker
+// which are changed by Worker.UpdateTimeouts
+type TimeoutConfig struct {
+	// Heartbeat is the interval between heartbeats
+	Heartbeat time.Duration
+	// Disown is the time to wait for a heartbeat reply
+	Disown time.Duration
+	// ResponseDeadline is applied to new sessions as Worker.SetResponseDeadline
+	ResponseDeadline time.Duration
+	// RequestIdle is applied to new chunks as Worker.SetRequestIdleTimeout
+	RequestIdle time.Duration
+}
+
+func (c TimeoutConfig) validate() error {
+	if c.Heartbeat <= 0 || c.Disown <= 0 || c.ResponseDeadline < 0 || c.RequestIdle < 0 {
+		return ErrInvalidTimeouts
+	}
+	return nil
+}
+
 type requestStream interface {
 	push(*Message)
 	Close()
@@ -45,6 +124,14 @@ type requestStream interface {
 // Request provides an interface for a handler to get data
 type Request interface {
 	Read(ctx context.Context) ([]byte, error)
+	// RawAndDecode reads the next chunk and decodes it as MessagePack into v.
+	// The raw chunk is returned even if it can not be decoded
+	RawAndDecode(ctx context.Context, v interface{}) ([]byte, error)
+	// ReadAll reads chunks until the stream is closed and returns them
+	// concatenated. The optional timeout bounds the whole reading.
+	// On an error, including the expired timeout, the data read so far
+	// is returned along with the error
+	ReadAll(ctx context.Context, timeout ...time.Duration) ([]byte, error)
 }
 
 // ResponseStream provides an interface for a handler to reply
@@ -54,29 +141,55 @@ type ResponseStream interface {
 	// Response takes the ownership of the buffer, so provided buffer must not be edited.
 	ZeroCopyWrite(data []byte) error
 	ErrorMsg(code int, message string) error
+	// SetProgress reports the progress of a long request in percents.
+	// The value is carried by ProgressHeader of the next frame,
+	// so clients which are not aware of it see only data.
+	// See Worker.SetProgressFrames to send it at once.
+	SetProgress(pct float64) error
+	// RetryableError works like ErrorMsg, but lets a client know
+	// when to retry the request by RetryAfterHeader of the error frame.
+	// Clients which ignore headers see an ordinary error.
+	RetryableError(code int, message string, retryAfter time.Duration) error
 }
 
 // Response provides an interface for a handler to reply
 type Response ResponseStream
 
-func trapRecoverAndClose(ctx context.Context, event string, response Response, printStack bool) {
-	if recoverInfo := recover(); recoverInfo != nil {
-		var stack []byte
+// TerminatingValue is the key of the channel in a handler context,
+// which is closed when the worker terminates active handlers
+const TerminatingValue = "cocaine.terminating"
+
+// WorkerTerminating returns a channel which is closed when the worker
+// terminates active handlers: the grace period of the terminate message
+// or the time of Shutdown is over. A handler, which has outlived
+// its session, may use it to abort a long work.
+// It returns nil if ctx has no channel attached
+func WorkerTerminating(ctx context.Context) <-chan struct{} {
+	if ch, ok := ctx.Value(TerminatingValue).(<-chan struct{}); ok {
+		return ch
+	}
+	return nil
+}
 
-		if printStack {
-			stack = make([]byte, 4096)
-			stackSize := runtime.Stack(stack, false)
-			stack = stack[:stackSize]
-		}
+func attachTerminating(ctx context.Context, terminating <-chan struct{}) context.Context {
+	return context.WithValue(ctx, TerminatingValue, terminating)
+}
 
-		response.ErrorMsg(
-			ErrorPanicInHandler,
-			fmt.Sprintf("Event: '%s', recover: %s, stack: \n%s\n", event, recoverInfo, stack),
-		)
+// trapRecoverAndClose completes the report of the session with
+// the recovered panic and the request snapshot, which may be nil
+func trapRecoverAndClose(ctx context.Context, report PanicReport, snapshot *snapshotRequest,
+	response Response, onPanic func(PanicReport, Response), autoClose bool) {
+	if recoverInfo := recover(); recoverInfo != nil {
+		report.Recovered = recoverInfo
+		report.Stack = debug.Stack()
+		report.FirstChunk = snapshot.snapshot()
+		onPanic(report, response)
 		return
 	}
 
-	response.Close()
+	if autoClose {
+		response.Close()
+	}
 }
 
 // WorkerNG performs IO operations between an application
@@ -84,22 +197,165 @@ func trapRecoverAndClose(ctx context.Context, event string, response Response, p
 type WorkerNG struct {
 	// Connection to cocaine-runtime
 	conn socketIO
+	// the connection which receives heartbeats,
+	// it differs from conn while the worker is migrating
+	heartbeatConn socketIO
+	// guards conn and heartbeatConn, which are replaced by the loop
+	// on a migration. The loop itself reads them without the lock
+	connMu sync.RWMutex
+	// parameters to dial another endpoint on a migration
+	framer         Framer
+	readBufferSize int
+	envelope       Codec
+	onConnError    ConnErrorHandler
+	// receives requests of MigrateTo
+	migrations chan migrationRequest
+	// the migration, while sessions of the old connection are draining
+	migration *connMigration
 	// Id to introduce myself to cocaine-runtime
 	id string
+	// creates heartbeatTimer and disownTimer
+	clock Clock
 	// Each tick we shoud send a heartbeat as keep-alive
-	heartbeatTimer *time.Timer
+	heartbeatTimer Timer
 	// Timeout to receive a heartbeat reply
-	disownTimer *time.Timer
+	disownTimer Timer
+	// Interval between heartbeats
+	heartbeatTimeout time.Duration
+	// Time to wait for a heartbeat reply
+	disownTimeout time.Duration
+	// Time after which a pending heartbeat write is reported as blocked
+	heartbeatWriteTimeout time.Duration
+	// set while a heartbeat reply is expected
+	awaitingHeartbeat bool
+	// send heartbeats from a separate goroutine
+	dedicatedHeartbeat bool
+	// notifies the loop that heartbeatLoop has sent a heartbeat
+	heartbeatSent chan struct{}
+	// passes new timeouts to the loop
+	timeoutUpdates chan TimeoutConfig
+	// passes new timeouts from the loop to heartbeatLoop
+	heartbeatUpdates chan TimeoutConfig
+	// builders of control messages
+	newHandshake HandshakeBuilder
+	newHeartbeat HeartbeatBuilder
+	// called once the worker is ready to handle requests
+	readinessNotify func()
+	// open and close resources tied to the lifetime of the worker
+	startHook func() error
+	stopHook  func()
+	// checks dependencies after startHook, nil means no check
+	startupProbe         func(ctx context.Context) error
+	startupProbeDeadline time.Duration
+	// receives the result of the running probe, nil otherwise.
+	// Handlers invoked meanwhile wait in probePending
+	probeDone    chan error
+	probePending []func()
+	// set once startHook has succeeded, so hooks
+	// are not called again on a reconnection
+	started bool
+	// dials the endpoint again, nil if the worker
+	// has been created with a custom connection
+	dial func() (socketIO, error)
+	// the time the constructor has spent on dialing,
+	// it is reported along with the first handshake
+	dialDuration time.Duration
+	// set by RunWithReconnect, nil means to return from Run
+	// once the worker is disowned or the connection is lost
+	backoff *Backoff
 	// Token manager
 	tokenManager TokenManager
-	// Map handlers to sessions
-	sessions map[uint64]requestStream
+	// Map handlers to sessions.
+	// Session ids are assigned by cocaine-runtime and belong to
+	// the connection to it, so they never clash with ids of
+	// outgoing calls, which are counted by each Service separately
+	sessions map[uint64]*workerSession
+	// sessions closed by the worker, which still
+	// wait for a choke from cocaine-runtime
+	abandonedSessions map[uint64]struct{}
+	// the maximum number of sessions, 0 means no limit
+	maxSessions int
+	// the size of sessions, which is read outside of the loop
+	activeSessions int64
+	// the hint sent with ErrorOverloaded, 0 means no hint
+	overloadRetryAfter time.Duration
+	// reported by Stats
+	counters workerCounters
+	// the maximum number of chunks in a session, 0 means no limit
+	maxChunksPerSession int
+	// join chunks split by ChunkContinuedHeader
+	chunkReassembly bool
+	// attach RequestIDHeader to the first frame of a response
+	requestIDEcho bool
+	// send progress of responses by dedicated frames
+	progressFrames bool
+	// what to do with an invoke for an active session
+	duplicateSessionPolicy DuplicateSessionPolicy
+	// the limit of bytes of a response queued for the connection,
+	// 0 means no limit
+	flowControlWindow int
+	// the maximum number of bytes in each direction of a session,
+	// 0 means no limit
+	maxPayload int
+	// override maxPayload for particular events
+	eventMaxPayloads map[string]int
+	// bounds the lifetime of a response, 0 means no limit
+	responseDeadline time.Duration
+	// override responseDeadline for particular events
+	eventTimeouts map[string]time.Duration
+	// events which handlers keep responses open after return
+	keepOpenEvents map[string]bool
+	// receives ids of sessions which have exceeded responseDeadline
+	expiredSessions chan uint64
+	// the maximum time between chunks of a request, 0 means no limit
+	requestIdleTimeout time.Duration
+	// receives ids of sessions which may have exceeded requestIdleTimeout
+	idleSessions chan uint64
+	// limits active handlers
+	overload overloadState
+	// events which are temporary rejected
+	muDisabledEvents sync.RWMutex
+	disabledEvents   map[string]struct{}
+	// events which are going to be removed
+	muDeprecatedEvents sync.RWMutex
+	deprecatedEvents   map[string]*deprecation
+	// set when cocaine-runtime has asked the worker to terminate
+	terminating bool
+	// closed when the worker stops waiting for active handlers
+	// after the terminate message to cancel their downstream calls
+	terminateRequested chan struct{}
+	// the terminate message, while active handlers
+	// are finishing within the grace period
+	pendingTerminate *Message
+	graceDeadline    time.Time
+	graceExpired     <-chan time.Time
+	// receives requests of Shutdown
+	shutdownRequests chan shutdownRequest
+	// receives requests of Sessions and CancelAllSessions
+	sessionsRequests chan sessionsRequest
+	// the request of Shutdown, while active handlers are finishing
+	pendingShutdown *shutdownRequest
 	// handler
 	handler RequestHandler
 	// Notify Run about stop
 	stopped chan struct{}
+	// set while Run is handling messages, so requests
+	// to the loop don't block before Run
+	running int32
+	// Stop can be called concurrently by a user and the loop
+	stopOnce sync.Once
 	// if set recoverTrap sends Stack
 	debug bool
+	// converts a recovered panic to an error for a client
+	recoverMapper RecoverMapper
+	// replace the default handling of a panic, if set
+	panicHandler       PanicHandler
+	panicReportHandler PanicReportHandler
+	// redacts the first chunk for a panic report,
+	// nil means the report has no snapshot
+	panicRedactor func([]byte) []byte
+	// close a response when a handler returns
+	autoClose bool
 	// allow the worker to handle SIGUSR1 to print all goroutines stacks
 	stackSignalEnabled bool
 	// protocol version id
@@ -108,49 +364,131 @@ type WorkerNG struct {
 	dispatcher protocolDispather
 	// temination handler
 	terminationHandler TerminationHandler
+	// logger for worker's own messages
+	logger Logger
+	// the version of the application, attached to logs and metrics
+	version string
+	// receives an entry for every finished session
+	accessLogger AccessLogger
+	// emits access log entries to a logging service, nil if disabled
+	accessLogService *serviceAccessLogger
+	// the last completed requests, nil if disabled
+	recentRequests *requestRing
+	// worker's metrics
+	metrics Metrics
+	// the same metrics if they implement ConnectionMetrics
+	connMetrics ConnectionMetrics
 }
 
-// NewWorkerNG connects to the cocaine-runtime and create WorkerNG on top of this connection
+// NewWorkerNG connects to the cocaine-runtime and create WorkerNG on top of this connection.
+// The configuration is parsed from the command line by LoadWorkerConfig.
 func NewWorkerNG() (*WorkerNG, error) {
-	workerID := GetDefaults().UUID()
+	config, err := LoadWorkerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewWorkerNGWithOptions(WithConfig(config))
+}
+
+// NewWorkerNGWithFramer works like NewWorkerNG, but wraps messages
+// to cocaine-runtime into frames of a non-standard transport.
+// nil framer means the default framing.
+func NewWorkerNGWithFramer(framer Framer) (*WorkerNG, error) {
+	config, err := LoadWorkerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewWorkerNGWithOptions(WithConfig(config), WithFramer(framer))
+}
 
-	unixSocketEndpoint := GetDefaults().Endpoint()
-	if unixSocketEndpoint == "" {
+// NewWorkerNGWithConfig works like NewWorkerNG, but takes
+// the configuration from config instead of GetDefaults().
+func NewWorkerNGWithConfig(config WorkerConfig) (*WorkerNG, error) {
+	return NewWorkerNGWithOptions(WithConfig(config))
+}
+
+// newWorkerNGWithConfig dials config.Endpoint unless conn is provided
+func newWorkerNGWithConfig(config WorkerConfig, framer Framer, conn socketIO) (*WorkerNG, error) {
+	if conn == nil && config.Endpoint == "" {
 		return nil, ErrNoCocaineEndpoint
 	}
 
-	tokenManager, err := NewTokenManager(GetDefaults().ApplicationName(), GetDefaults().Token())
+	tokenManager, err := NewTokenManager(config.ApplicationName, config.Token)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create token manager: %v", err)
 	}
 
-	// Connect to cocaine-runtime over a unix socket
-	sock, err := newUnixConnection(unixSocketEndpoint, coreConnectionTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to Cocaine via %s: %v",
-			unixSocketEndpoint, err)
+	var (
+		dial         func() (socketIO, error)
+		dialDuration time.Duration
+	)
+	if conn == nil {
+		dial = func() (socketIO, error) {
+			return newUnixConnection(config.Endpoint, coreConnectionTimeout, framer, config.ReadBufferSize)
+		}
+
+		// Connect to cocaine-runtime over a unix socket
+		start := time.Now()
+		sock, err := dial()
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Cocaine via %s: %v",
+				config.Endpoint, err)
+		}
+		dialDuration = time.Since(start)
+		conn = sock
 	}
 
-	return newWorkerNG(sock, workerID,
-		GetDefaults().Protocol(),
-		GetDefaults().Debug(),
+	w, err := newWorkerNG(conn, config.UUID,
+		config.Protocol,
+		config.Debug,
 		tokenManager)
+	if err != nil {
+		return nil, err
+	}
+
+	w.framer = framer
+	w.readBufferSize = config.ReadBufferSize
+	w.dial = dial
+	w.dialDuration = dialDuration
+	return w, nil
 }
 
 func newWorkerNG(conn socketIO, id string, protoVersion int, debug bool, tokenManager TokenManager) (*WorkerNG, error) {
 	w := &WorkerNG{
-		conn: conn,
-		id:   id,
-
-		heartbeatTimer: time.NewTimer(heartbeatTimeout),
-		disownTimer:    time.NewTimer(disownTimeout),
-		tokenManager:   tokenManager,
-
-		sessions: make(map[uint64]requestStream),
-
-		stopped: make(chan struct{}),
+		conn:          conn,
+		heartbeatConn: conn,
+		id:            id,
+
+		heartbeatTimeout: heartbeatTimeout,
+		disownTimeout:    disownTimeout,
+		tokenManager:     tokenManager,
+
+		heartbeatWriteTimeout: heartbeatWriteTimeout,
+		heartbeatSent:         make(chan struct{}, 1),
+		timeoutUpdates:        make(chan TimeoutConfig),
+		shutdownRequests:      make(chan shutdownRequest),
+		migrations:            make(chan migrationRequest),
+		sessionsRequests:      make(chan sessionsRequest),
+		heartbeatUpdates:      make(chan TimeoutConfig, 1),
+
+		sessions:          make(map[uint64]*workerSession),
+		abandonedSessions: make(map[uint64]struct{}),
+		expiredSessions:   make(chan uint64),
+		eventTimeouts:     make(map[string]time.Duration),
+		keepOpenEvents:    make(map[string]bool),
+		eventMaxPayloads:  make(map[string]int),
+		idleSessions:      make(chan uint64),
+		disabledEvents:    make(map[string]struct{}),
+		deprecatedEvents:  make(map[string]*deprecation),
+		overload:          newOverloadState(),
+		metrics:           NullMetrics{},
+		connMetrics:       NullMetrics{},
+
+		stopped:            make(chan struct{}),
+		terminateRequested: make(chan struct{}),
 
 		debug:              debug,
+		autoClose:          true,
 		stackSignalEnabled: true,
 
 		protoVersion:       protoVersion,
@@ -158,6 +496,8 @@ func newWorkerNG(conn socketIO, id string, protoVersion int, debug bool, tokenMa
 		terminationHandler: nil,
 	}
 
+	w.logger, _ = newFallbackLogger()
+
 	switch w.protoVersion {
 	case v1:
 		w.dispatcher = newV1Protocol()
@@ -165,6 +505,20 @@ func newWorkerNG(conn socketIO, id string, protoVersion int, debug bool, tokenMa
 		return nil, fmt.Errorf("unsupported protocol version %d", w.protoVersion)
 	}
 
+	w.newHandshake = w.dispatcher.newHandshake
+	w.newHeartbeat = w.dispatcher.newHeartbeat
+	w.setClock(realClock{})
+
+	return w, nil
+}
+
+// setClock creates the timers by the clock.
+// It must be called before Worker.Run
+func (w *WorkerNG) setClock(clock Clock) {
+	w.clock = clock
+	w.heartbeatTimer = clock.NewTimer(w.heartbeatTimeout)
+	w.disownTimer = clock.NewTimer(w.disownTimeout)
+
 	// NewTimer launches timer
 	// but it should be started after
 	// we send heartbeat message
@@ -172,14 +526,19 @@ func newWorkerNG(conn socketIO, id string, protoVersion int, debug bool, tokenMa
 	// It will be reset in onHeartbeat()
 	// after worker runs
 	w.heartbeatTimer.Stop()
+}
 
-	// Send handshake to notify cocaine-runtime
-	// that we have started
-	if err := w.sendHandshake(); err != nil {
-		return nil, err
+// AdvanceClock moves the time of FakeClock set by WithClock forward,
+// so timers of the worker fire without waiting.
+// It is intended for tests only and returns ErrNoFakeClock
+// if the worker uses the real clock.
+func (w *WorkerNG) AdvanceClock(d time.Duration) error {
+	clock, ok := w.clock.(*FakeClock)
+	if !ok {
+		return ErrNoFakeClock
 	}
-
-	return w, nil
+	clock.Advance(d)
+	return nil
 }
 
 // SetDebug enables debug mode of the Worker.
@@ -195,222 +554,1579 @@ func (w *WorkerNG) EnableStackSignal(enable bool) {
 	w.stackSignalEnabled = enable
 }
 
-// Token returns the most recently viewed version of the authorization token.
-func (w *WorkerNG) Token() Token {
-	return w.tokenManager.Token()
+// SetOnConnError attaches the handler which is called
+// when the connection to cocaine-runtime fails to read or write.
+// It is not called when the connection is closed by the worker.
+func (w *WorkerNG) SetOnConnError(handler ConnErrorHandler) {
+	w.onConnError = handler
+	if notifier, ok := w.conn.(connErrorNotifier); ok {
+		notifier.setErrorHandler(handler)
+	}
 }
 
-// Run makes the worker anounce itself to a cocaine-runtime
-// as being ready to hadnle incoming requests and hablde them
-// terminationHandler allows to attach handler which will be called
-// when SIGTERM arrives
-func (w *WorkerNG) Run(handler RequestHandler, terminationHandler TerminationHandler) error {
-	w.handler = handler
-	w.terminationHandler = terminationHandler
-	return w.loop()
+// SetLogger sets the logger which is used by the worker
+// to report abnormal situations. By default messages are
+// written using the standard log package.
+func (w *WorkerNG) SetLogger(logger Logger) {
+	w.logger = logger
 }
 
-// Stop makes the Worker stop handling requests
-func (w *WorkerNG) Stop() {
-	if w.isStopped() {
-		return
-	}
+// SetVersion sets the version of the application.
+// It is attached to the worker's logs, access log entries and session metrics
+// to correlate the behavior with deploys. It is empty by default.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetVersion(version string) {
+	w.version = version
+}
 
-	w.tokenManager.Stop()
-	close(w.stopped)
-	w.conn.Close()
+// Version returns the version of the application set by SetVersion
+func (w *WorkerNG) Version() string {
+	return w.version
 }
 
-func (w *WorkerNG) isStopped() bool {
-	select {
-	case <-w.stopped:
-		return true
-	default:
+// SetMetrics sets the receiver of the worker's metrics.
+// Connections are reported if metrics implement ConnectionMetrics as well.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetMetrics(metrics Metrics) {
+	w.metrics = metrics
+	w.connMetrics = NullMetrics{}
+	if connMetrics, ok := metrics.(ConnectionMetrics); ok {
+		w.connMetrics = connMetrics
 	}
-	return false
 }
 
-func (w *WorkerNG) loop() error {
-	// Send heartbeat to notify cocaine-runtime
-	// we are ready to work
-	w.onHeartbeatTimeout()
-
-	var stackSignal chan os.Signal
+// SetMaxChunksPerSession limits the number of chunks a client is allowed
+// to send in a single session. If a client exceeds the limit,
+// the session is terminated with ErrorTooManyChunks. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetMaxChunksPerSession(n int) {
+	w.maxChunksPerSession = n
+}
 
-	if w.stackSignalEnabled {
-		stackSignal = make(chan os.Signal, 1)
-		signal.Notify(stackSignal, syscall.SIGUSR1)
-		defer signal.Stop(stackSignal)
-	}
+// SetChunkReassembly makes the worker join parts of a message
+// split by a client across several chunks. A chunk with
+// ChunkContinuedHeader set to true is buffered until a chunk without it
+// arrives, then Read of the handler returns the whole message at once.
+// Parts buffered before a choke are delivered as the last message,
+// while an error from a client drops them.
+// Limits of chunks and bytes are applied to every part.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetChunkReassembly(enable bool) {
+	w.chunkReassembly = enable
+}
 
-	for {
-		select {
-		case msg, ok := <-w.conn.Read():
-			if !ok {
-				// either the connection is lost
-				// or the worker was stopped
-				select {
-				case <-w.stopped:
-					return nil
-				default:
-					return ErrConnectionLost
-				}
-			}
+// SetFlowControlWindow bounds the number of bytes of a response, which
+// have been written by a handler, but are not written to the connection
+// to cocaine-runtime yet. Once the window is full, Response.Write blocks
+// until the connection drains, so a handler streaming a large response
+// holds bounded memory instead of queueing every chunk. A single chunk
+// larger than the window is passed as a whole. Write returns
+// ErrWorkerClosed if the worker is closed while waiting.
+// The limit applies to connections dialed by the worker, but not
+// to NewMemorySocketPair. 0 means no limit, which is the default.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetFlowControlWindow(window int) {
+	w.flowControlWindow = window
+}
 
-			// non-blocking
-			if err := w.dispatcher.onMessage(w, msg); err != nil {
-				fmt.Printf("onMessage returns %v\n", err)
-			}
+// SetRequestIDEcho makes the worker attach RequestIDHeader to the first
+// frame of every response, so a client can correlate it with the request.
+// The id is taken from RequestIDHeader of the invoke, from the trace id
+// if the request is traced, or generated by the worker.
+// A handler gets the same id by GetRequestID regardless of the setting.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetRequestIDEcho(enable bool) {
+	w.requestIDEcho = enable
+}
 
-		case <-w.heartbeatTimer.C:
-			// Reset (start) disown & heartbeat timers
-			// Send a heartbeat message to cocaine-runtime
-			w.onHeartbeatTimeout() // non-blocking
+// SetProgressFrames makes Response.SetProgress send a dedicated frame
+// at once instead of ProgressHeader of the next frame. The frame type is
+// an extension of the protocol, which a stock cocaine-runtime treats
+// as a protocol error, so it must be enabled only along with a runtime
+// patched to pass progress frames to clients.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetProgressFrames(enable bool) {
+	w.progressFrames = enable
+}
 
-		case <-w.disownTimer.C:
-			w.onDisownTimeout() // non-blocking
-			return ErrDisowned
+// SetMaxPayload limits the number of bytes a client is allowed to send
+// in a single session as well as the number of bytes a handler
+// is allowed to reply. If a client exceeds the limit, the session
+// is terminated with ErrorPayloadTooLarge. A write of a handler
+// over the limit fails with ErrPayloadTooLarge. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetMaxPayload(bytes int) {
+	w.maxPayload = bytes
+}
 
-		case <-w.stopped:
-			return nil
+// SetEventMaxPayload works like SetMaxPayload, but limits sessions
+// of the event only. It overrides SetMaxPayload for the event,
+// 0 removes the override.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetEventMaxPayload(event string, bytes int) {
+	if bytes <= 0 {
+		delete(w.eventMaxPayloads, event)
+		return
+	}
+	w.eventMaxPayloads[event] = bytes
+}
 
-		case <-stackSignal:
-			w.printAllStacks()
-		}
+// payloadLimit returns the limit of bytes for sessions of the event
+func (w *WorkerNG) payloadLimit(event string) int64 {
+	if limit, ok := w.eventMaxPayloads[event]; ok {
+		return int64(limit)
 	}
+	return int64(w.maxPayload)
 }
 
-// printAllStacks prints all stacks to stderr and writes to a file
-func (w *WorkerNG) printAllStacks() {
-	stackTrace := dumpStack()
-	// print to stdout to have it in the logs
-	fmt.Printf("=== START STACKTRACE ===\n%s\n=== END STACKTRACE ===", stackTrace)
-	// to debug blocked workers. It will be removed somewhen
-	filename := fmt.Sprintf("%s-%d", GetDefaults().ApplicationName(), os.Getpid())
-	if err := ioutil.WriteFile(filename, stackTrace, 0660); err != nil {
-		fmt.Printf("unable to create the file with stacktraces %s: %v\n", filename, err)
+// SetResponseDeadline bounds the time from an invoke to the close
+// of the response. If a handler has not closed the response in time,
+// the worker replies with ErrorResponseDeadline and cancels the context
+// of the handler. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetResponseDeadline(d time.Duration) {
+	w.responseDeadline = d
+}
+
+// SetEventTimeout bounds the time from an invoke of the event
+// to the close of the response. If a handler has not closed the response
+// in time, the worker replies with ErrorHandlerTimeout and cancels
+// the context of the handler. It overrides SetResponseDeadline
+// for the event. 0 removes the timeout.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetEventTimeout(event string, timeout time.Duration) {
+	if timeout <= 0 {
+		delete(w.eventTimeouts, event)
+		return
 	}
+	w.eventTimeouts[event] = timeout
 }
 
-// A reply to heartbeat is not arrived during disownTimeout,
-// so it seems cocaine-runtime has died
-func (w *WorkerNG) onDisownTimeout() {
-	w.Stop()
+// SetRequestIdleTimeout limits the time between chunks of a request.
+// If a client sends neither a chunk nor a choke in time,
+// Read of the handler returns ErrRequest with ErrorRequestIdleTimeout
+// and the session is closed with the same error. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetRequestIdleTimeout(d time.Duration) {
+	w.requestIdleTimeout = d
 }
 
-func (w *WorkerNG) onHeartbeatTimeout() {
-	// Wait for the reply until disown timeout comes
-	w.disownTimer.Reset(disownTimeout)
-	// Send next heartbeat over heartbeatTimeout
-	w.heartbeatTimer.Reset(heartbeatTimeout)
+// UpdateTimeouts changes timeouts of the running worker.
+// The next heartbeat is sent after the new interval,
+// session timeouts are applied to new sessions and chunks.
+// RequestIdle 0 disables the limit for active sessions as well.
+// It blocks until the loop of the worker applies the values,
+// so it must be called after Worker.Run, otherwise ErrWorkerNotRunning
+// is returned. ErrWorkerStopped is returned if the worker has been stopped.
+func (w *WorkerNG) UpdateTimeouts(cfg TimeoutConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
 
-	select {
-	case w.conn.Write() <- w.dispatcher.newHeartbeat():
-	case <-w.conn.IsClosed():
-	case <-time.After(disownTimeout):
+	if w.isStopped() {
+		return ErrWorkerStopped
+	}
+
+	if atomic.LoadInt32(&w.running) == 0 {
+		return ErrWorkerNotRunning
 	}
-}
 
-// Send handshake message to cocaine-runtime
-// It is needed to be called only once on a startup
-// to notify runtime that we have started
-func (w *WorkerNG) sendHandshake() error {
 	select {
-	case w.conn.Write() <- w.dispatcher.newHandshake(w.id):
-	case <-w.conn.IsClosed():
-	case <-time.After(disownTimeout):
-		return fmt.Errorf("unable to send a handshake for a long time")
+	case w.timeoutUpdates <- cfg:
+		return nil
+	case <-w.stopped:
+		return ErrWorkerStopped
+	case <-w.getConn().IsClosed():
+		// the loop has exited
+		return ErrWorkerNotRunning
 	}
-	return nil
 }
 
-// Message handlers
+// SetMaxActiveHandlers limits the number of concurrently running handlers.
+// The behavior of the worker under the limit is defined by SetBackpressureMode.
+// 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetMaxActiveHandlers(n int) {
+	w.overload.maxActiveHandlers = n
+}
 
-func (w *WorkerNG) onChoke(msg *Message) {
-	if reqStream, ok := w.sessions[msg.Session]; ok {
-		reqStream.Close()
-		delete(w.sessions, msg.Session)
-	}
+// SetMaxConcurrentSessions limits the number of sessions, which have been
+// invoked, but not closed by a client yet. A session may outlive its handler,
+// so the limit bounds memory rather than goroutines. If the limit is reached,
+// new invokes are rejected with ErrorOverloaded. 0 means no limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetMaxConcurrentSessions(n int) {
+	w.maxSessions = n
 }
 
-func (w *WorkerNG) onChunk(msg *Message) {
-	if reqStream, ok := w.sessions[msg.Session]; ok {
-		reqStream.push(msg)
-	}
+// SetOverloadRetryAfter sets the hint sent with ErrorOverloaded
+// rejections, so clients know when to retry like after
+// Response.RetryableError. 0 means no hint.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetOverloadRetryAfter(retryAfter time.Duration) {
+	w.overloadRetryAfter = retryAfter
 }
 
-func (w *WorkerNG) onError(msg *Message) {
-	if reqStream, ok := w.sessions[msg.Session]; ok {
-		reqStream.push(msg)
+// ActiveSessions returns the number of sessions,
+// which have been invoked, but not closed by a client yet.
+// It is safe to call it while the worker is running.
+func (w *WorkerNG) ActiveSessions() int {
+	return int(atomic.LoadInt64(&w.activeSessions))
+}
+
+// SetBackpressureMode defines how the worker behaves when
+// the limit of active handlers is reached. ModeReject is used by default.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetBackpressureMode(mode BackpressureMode) {
+	w.overload.mode = mode
+}
+
+// SetDuplicateSessionPolicy defines how the worker behaves when
+// cocaine-runtime sends an invoke with the id of an active session.
+// The anomaly is logged and counted by Metrics.IncProtocolAnomaly
+// in any case. DuplicateReject is used by default.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetDuplicateSessionPolicy(policy DuplicateSessionPolicy) {
+	w.duplicateSessionPolicy = policy
+}
+
+// SetEventConcurrency limits the number of concurrently running handlers
+// of the event. The behavior of the worker under the limit is defined
+// by SetBackpressureMode, but deferred invokes of the event
+// don't stop the worker from reading. 0 removes the limit.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetEventConcurrency(event string, max int) {
+	if max <= 0 {
+		delete(w.overload.eventLimits, event)
+		return
 	}
+	w.overload.eventLimits[event] = &eventLimit{max: max}
 }
 
-func (w *WorkerNG) onInvoke(msg *Message) error {
-	event, ok := getEventName(msg)
-	if !ok {
-		// corrupted message
-		return fmt.Errorf("unable to get an event name from %s", msg.String())
+// SetRecentRequestsSize makes the worker keep summaries
+// of the last n completed requests. 0 disables it.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetRecentRequestsSize(n int) {
+	if n <= 0 {
+		w.recentRequests = nil
+		return
 	}
+	w.recentRequests = newRequestRing(n)
+}
 
-	var (
-		currentSession = msg.Session
-		ctx            context.Context
-	)
+// RecentRequests returns summaries of the last completed requests
+// from the oldest to the newest.
+func (w *WorkerNG) RecentRequests() []RequestSummary {
+	if w.recentRequests == nil {
+		return nil
+	}
+	return w.recentRequests.list()
+}
 
-	ctx = context.Background()
+// SetAutoClose defines whether the worker closes a response
+// when a handler returns without closing it. It's enabled by default.
+// Disable it if handlers keep replying from other goroutines after return.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetAutoClose(autoClose bool) {
+	w.autoClose = autoClose
+}
 
-	if traceInfo, err := msg.Headers.getTraceData(); err == nil {
-		ctx = AttachTraceInfo(ctx, traceInfo)
+// SetEventKeepOpen makes the worker leave a response of the event open
+// when the handler returns, even if SetAutoClose is enabled.
+// Such a handler must close the response itself, e.g. from a goroutine
+// which streams the reply.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetEventKeepOpen(event string, keepOpen bool) {
+	if !keepOpen {
+		delete(w.keepOpenEvents, event)
+		return
 	}
+	w.keepOpenEvents[event] = true
+}
 
-	responseStream := newResponse(w.dispatcher, currentSession, w.conn)
-	requestStream := newRequest(w.dispatcher)
-	w.sessions[currentSession] = requestStream
+// SetRecoverMapper sets the function which converts a panic
+// in a handler to an error sent to a client.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetRecoverMapper(mapper RecoverMapper) {
+	w.recoverMapper = mapper
+}
 
-	go func() {
-		// this trap catches a panic from a handler
-		// and checks if the response is closed.
-		defer trapRecoverAndClose(ctx, event, responseStream, w.debug)
+// SetPanicHandler replaces the default handling of a panic in a handler.
+// By default the worker logs the panic with the stack and replies
+// with an error produced by RecoverMapper or with ErrorPanicInHandler.
+// The stack is sent to a client in the debug mode only.
+// The handler must reply to the response itself.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetPanicHandler(handler PanicHandler) {
+	w.panicHandler = handler
+}
 
-		ctx, closeHandlerSpan := NewSpan(ctx, event)
-		defer closeHandlerSpan()
+// SetPanicReportHandler works like SetPanicHandler, but the handler
+// receives PanicReport with the session id and the request snapshot
+// enabled by SetPanicRequestSnapshot. It takes precedence over PanicHandler.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetPanicReportHandler(handler PanicReportHandler) {
+	w.panicReportHandler = handler
+}
 
-		w.handler(ctx, event, requestStream, responseStream)
-	}()
-	return nil
+// SetPanicRequestSnapshot makes the worker keep a copy of the first chunk
+// read by a handler and report it along with a panic. The chunk is passed
+// through redact, e.g. to mask credentials, and cut to 1KB. The snapshot
+// is logged by the default panic handling and is set to PanicReport.FirstChunk.
+// Requests may contain private data, so it is disabled by default.
+// Pass nil to disable it again.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetPanicRequestSnapshot(redact func(chunk []byte) []byte) {
+	w.panicRedactor = redact
 }
 
-func (w *WorkerNG) onHeartbeat(msg *Message) {
-	// Reply to a heartbeat has been received,
-	// so we are not disowned & disownTimer must be stopped
-	// It will be launched when the next heartbeat is sent
-	w.disownTimer.Stop()
+// newPanicSnapshot wraps the request to keep its first chunk
+// if SetPanicRequestSnapshot is enabled. Otherwise the snapshot is nil
+func (w *WorkerNG) newPanicSnapshot(req Request) (Request, *snapshotRequest) {
+	if w.panicRedactor == nil {
+		return req, nil
+	}
+
+	snapshot := &snapshotRequest{
+		source: req,
+		redact: w.panicRedactor,
+	}
+	return hookRead(req, snapshot.read), snapshot
 }
 
-func (w *WorkerNG) onTerminate(msg *Message) {
-	if w.terminationHandler != nil {
-		ctx, cancelTimeout := context.WithTimeout(context.Background(), terminationTimeout)
-		onDone := make(chan struct{})
-		go func() {
-			w.terminationHandler(ctx)
-			close(onDone)
-		}()
+// onPanic handles a panic recovered from a handler
+func (w *WorkerNG) onPanic(report PanicReport, response Response) {
+	atomic.AddInt64(&w.counters.panics, 1)
 
-		select {
-		case <-onDone:
-			cancelTimeout()
-		case <-ctx.Done():
-			fmt.Printf("terminationHandler timeouted: %v\n", ctx.Err())
+	if w.panicReportHandler != nil {
+		w.panicReportHandler(report, response)
+		return
+	}
+
+	event, recovered, stack := report.Event, report.Recovered, report.Stack
+	if w.panicHandler != nil {
+		w.panicHandler(event, recovered, stack, response)
+		return
+	}
+
+	fields := Fields{
+		"event":   event,
+		"session": report.Session,
+	}
+	if report.FirstChunk != nil {
+		fields["first_chunk"] = fmt.Sprintf("%q", report.FirstChunk)
+	}
+	w.logWithFields(fields).Errf("handler has panicked: %v\n%s", recovered, stack)
+
+	if w.recoverMapper != nil {
+		if perr := w.recoverMapper(event, recovered); perr != nil {
+			response.ErrorMsg(perr.Code, perr.Message)
+			return
 		}
 	}
 
-	// According to spec we have time
-	// to prepare for being killed by cocaine-runtime
-	select {
-	case w.conn.Write() <- msg:
-		// reply with the same termination message
-	case <-w.conn.IsClosed():
-	case <-time.After(disownTimeout):
+	if !w.debug {
+		stack = nil
 	}
-	w.Stop()
+
+	response.ErrorMsg(
+		ErrorPanicInHandler,
+		fmt.Sprintf("Event: '%s', recover: %s, stack: \n%s\n", event, recovered, stack),
+	)
+}
+
+// SetAccessLogger sets the logger which receives an AccessLogEntry
+// for every finished session.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetAccessLogger(logger AccessLogger) {
+	w.accessLogger = logger
+}
+
+// SetAccessLogService makes the worker emit access log entries
+// to a cocaine logging service, e.g. one created by
+// NewService(ctx, "logging", nil). Entries are sent in batches
+// as JSON objects separated by a newline. They are written to the local
+// logger if the service is down. It works along with SetAccessLogger.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetAccessLogService(service *Service) {
+	w.accessLogService = newServiceAccessLogger(service)
+}
+
+// DisableEvent makes the worker reject new requests for the event
+// with ErrorEventDisabled until EnableEvent is called.
+// Sessions which have been already started are not affected.
+// It is safe to call it while the worker is running.
+func (w *WorkerNG) DisableEvent(event string) {
+	w.muDisabledEvents.Lock()
+	w.disabledEvents[event] = struct{}{}
+	w.muDisabledEvents.Unlock()
+}
+
+// EnableEvent restores handling of the event disabled by DisableEvent
+func (w *WorkerNG) EnableEvent(event string) {
+	w.muDisabledEvents.Lock()
+	delete(w.disabledEvents, event)
+	w.muDisabledEvents.Unlock()
+}
+
+func (w *WorkerNG) isEventDisabled(event string) bool {
+	w.muDisabledEvents.RLock()
+	_, disabled := w.disabledEvents[event]
+	w.muDisabledEvents.RUnlock()
+	return disabled
+}
+
+// deprecation describes a deprecated event
+type deprecation struct {
+	message string
+	// it is owned by the loop
+	lastWarning time.Time
+}
+
+// DeprecateEvent marks the event as deprecated. Requests for the event
+// are still handled, but every invoke is counted by Metrics.IncDeprecatedEvent
+// and the worker logs a warning with the message once per minute.
+// It is safe to call it while the worker is running.
+func (w *WorkerNG) DeprecateEvent(event string, message string) {
+	w.muDeprecatedEvents.Lock()
+	w.deprecatedEvents[event] = &deprecation{message: message}
+	w.muDeprecatedEvents.Unlock()
+}
+
+// reportDeprecated reports an invoke of the event if it is deprecated
+func (w *WorkerNG) reportDeprecated(event string) {
+	w.muDeprecatedEvents.RLock()
+	d, deprecated := w.deprecatedEvents[event]
+	w.muDeprecatedEvents.RUnlock()
+	if !deprecated {
+		return
+	}
+
+	w.metrics.IncDeprecatedEvent(event)
+	if time.Since(d.lastWarning) < deprecationWarningInterval {
+		return
+	}
+
+	d.lastWarning = time.Now()
+	w.logWithFields(Fields{
+		"event":   event,
+		"message": d.message,
+	}).Warnf("deprecated event has been invoked")
+}
+
+// SetDedicatedHeartbeat makes the worker send heartbeats from
+// a separate goroutine, so they are not delayed by message processing.
+// The tradeoff is that cocaine-runtime keeps receiving heartbeats
+// even if the worker is not able to handle messages anymore.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetDedicatedHeartbeat(dedicated bool) {
+	w.dedicatedHeartbeat = dedicated
+}
+
+// SetHandshakeBuilder replaces the builder of the handshake message,
+// which is sent to cocaine-runtime when the worker starts.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetHandshakeBuilder(builder HandshakeBuilder) {
+	w.newHandshake = builder
+}
+
+// SetReadinessNotify sets the function which is called once
+// the worker has sent the handshake and the first heartbeat,
+// OnStart and the startup probe have succeeded, and it starts handling
+// requests. It allows to notify a process supervisor, which does not watch
+// heartbeats, e.g. by writing to a file descriptor.
+// The function is called from the loop of the worker, so it must not block.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetReadinessNotify(notify func()) {
+	w.readinessNotify = notify
+}
+
+// OnStart sets the function which is called once the worker has sent
+// the first heartbeat, before it starts handling requests.
+// It allows to open resources tied to the lifetime of the worker.
+// If it returns an error, the worker is stopped and Run returns the error.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) OnStart(hook func() error) {
+	w.startHook = hook
+}
+
+// OnStop sets the function which is called right before Run returns,
+// if the worker has been started. Handlers might not have finished yet,
+// as their contexts are cancelled only.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) OnStop(hook func()) {
+	w.stopHook = hook
+}
+
+// SetHeartbeatBuilder replaces the builder of heartbeat messages.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetHeartbeatBuilder(builder HeartbeatBuilder) {
+	w.newHeartbeat = builder
+}
+
+// ReplayResponse sends frames of a response, which has been recorded
+// before, to the session. The frames are copied with the session id replaced,
+// so they can be replayed more than once. It returns ErrWorkerClosed
+// if the worker has been stopped or disowned.
+// It is safe to call ReplayResponse from any goroutine.
+func (w *WorkerNG) ReplayResponse(session uint64, frames []*Message) error {
+	conn := w.getConn()
+	for _, frame := range frames {
+		if frame == nil {
+			continue
+		}
+
+		select {
+		case <-conn.IsClosed():
+			return ErrWorkerClosed
+		default:
+		}
+
+		replayed := *frame
+		replayed.Session = session
+
+		select {
+		case conn.Write() <- &replayed:
+		case <-conn.IsClosed():
+			return ErrWorkerClosed
+		}
+	}
+	return nil
+}
+
+// SetEnvelopeCodec replaces MessagePack as the envelope of messages
+// exchanged with cocaine-runtime, including the handshake and heartbeats.
+// It is intended for experimental runtimes only, as cocaine-runtime
+// must expect the same envelope. Payloads of chunks are not affected.
+// This function must be called before Worker.Run to take effect.
+func (w *WorkerNG) SetEnvelopeCodec(codec Codec) {
+	w.envelope = codec
+	if setter, ok := w.conn.(envelopeSetter); ok {
+		setter.setEnvelope(codec)
+	}
+}
+
+// Transport returns the network of the connection to cocaine-runtime,
+// e.g. "unix" or "tcp". It is empty if the transport is unknown.
+func (w *WorkerNG) Transport() string {
+	if t, ok := w.getConn().(transporter); ok {
+		return t.Transport()
+	}
+	return ""
+}
+
+// Token returns the most recently viewed version of the authorization token.
+func (w *WorkerNG) Token() Token {
+	return w.tokenManager.Token()
+}
+
+// Run makes the worker anounce itself to a cocaine-runtime
+// as being ready to hadnle incoming requests and hablde them
+// terminationHandler allows to attach handler which will be called
+// when SIGTERM arrives
+func (w *WorkerNG) Run(handler RequestHandler, terminationHandler TerminationHandler) error {
+	if w.isStopped() {
+		return ErrWorkerStopped
+	}
+
+	w.handler = handler
+	w.terminationHandler = terminationHandler
+
+	// Send handshake to notify cocaine-runtime
+	// that we have started
+	if err := w.sendFirstHandshake(); err != nil {
+		return err
+	}
+
+	defer func() {
+		// the last deferred call to run right before Run returns
+		if w.started && w.stopHook != nil {
+			w.stopHook()
+		}
+	}()
+
+	if w.accessLogService != nil {
+		go w.accessLogService.run()
+		defer w.accessLogService.close()
+	}
+
+	atomic.StoreInt32(&w.running, 1)
+	defer atomic.StoreInt32(&w.running, 0)
+
+	for {
+		err := w.loop()
+		if !w.shouldReconnect(err) {
+			return err
+		}
+
+		if err := w.reconnect(err); err != nil {
+			return err
+		}
+
+		if w.isStopped() {
+			// Stop might have missed the new connection
+			w.getConn().Close()
+			return nil
+		}
+	}
+}
+
+// Stop makes the Worker stop handling requests.
+// The worker can not be run again after Stop
+func (w *WorkerNG) Stop() {
+	w.stopOnce.Do(func() {
+		w.tokenManager.Stop()
+		close(w.stopped)
+		w.stopTimers()
+		w.getConn().Close()
+	})
+}
+
+// stopGracefully works like Stop, but flushes pending replies
+// before closing the connection
+func (w *WorkerNG) stopGracefully() {
+	w.stopOnce.Do(func() {
+		w.tokenManager.Stop()
+		close(w.stopped)
+		w.stopTimers()
+		closeConnGracefully(w.getConn())
+	})
+}
+
+// stopTimers stops the heartbeat and disown timers,
+// so they don't fire after the worker is stopped.
+// The loop stops them again on exit, as it might have reset them meanwhile
+func (w *WorkerNG) stopTimers() {
+	w.heartbeatTimer.Stop()
+	w.disownTimer.Stop()
+}
+
+// closeConnGracefully closes the connection
+// flushing pending replies if possible
+func closeConnGracefully(conn socketIO) {
+	if closer, ok := conn.(gracefulCloser); ok {
+		closer.closeGracefully(flushTimeout)
+	} else {
+		conn.Close()
+	}
+}
+
+// getConn returns the connection to cocaine-runtime.
+// It must be used outside of the loop
+func (w *WorkerNG) getConn() socketIO {
+	w.connMu.RLock()
+	defer w.connMu.RUnlock()
+	return w.conn
+}
+
+func (w *WorkerNG) getHeartbeatConn() socketIO {
+	w.connMu.RLock()
+	defer w.connMu.RUnlock()
+	return w.heartbeatConn
+}
+
+// shutdownRequest is passed by Shutdown to the loop
+type shutdownRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+// Shutdown stops the worker gracefully. New invokes are rejected
+// with ErrorWorkerTerminating, while active handlers are allowed
+// to finish until ctx is done. Then remaining handlers are cancelled,
+// pending replies are flushed and the worker is stopped.
+// It returns ctx.Err() if handlers have not finished in time
+// and ErrWorkerStopped if the worker is stopped or terminated
+// by cocaine-runtime meanwhile. It must be called after Worker.Run.
+func (w *WorkerNG) Shutdown(ctx context.Context) error {
+	request := shutdownRequest{
+		ctx:  ctx,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case w.shutdownRequests <- request:
+	case <-w.stopped:
+		return ErrWorkerStopped
+	case <-w.getConn().IsClosed():
+		return ErrWorkerStopped
+	}
+
+	// the loop always replies
+	return <-request.done
+}
+
+func (w *WorkerNG) onShutdown(request shutdownRequest) {
+	if w.terminating {
+		// cocaine-runtime is already terminating the worker
+		// or Shutdown has been called
+		request.done <- ErrWorkerStopped
+		return
+	}
+	w.terminating = true
+
+	if w.overload.isIdle() {
+		w.finishShutdown(request, nil)
+		return
+	}
+	w.pendingShutdown = &request
+}
+
+func (w *WorkerNG) finishShutdown(request shutdownRequest, err error) {
+	w.pendingShutdown = nil
+	w.closeTerminating()
+	w.terminateAllSessions(ErrorWorkerTerminating, "the worker is shutting down")
+	w.stopGracefully()
+	request.done <- err
+}
+
+func (w *WorkerNG) isStopped() bool {
+	select {
+	case <-w.stopped:
+		return true
+	default:
+	}
+	return false
+}
+
+func (w *WorkerNG) loop() error {
+	// handlers must not outlive the connection
+	defer w.terminateAllSessions(ErrorWorkerTerminating, "the worker has been stopped")
+	defer w.stopTimers()
+	defer func() {
+		// sessions waiting for the startup probe are terminated
+		w.probePending = nil
+		// the worker has been stopped while handlers were finishing
+		if w.pendingShutdown != nil {
+			w.pendingShutdown.done <- ErrWorkerStopped
+		}
+		if w.migration != nil {
+			w.migration.conn.Close()
+			w.migration.done <- ErrWorkerStopped
+		}
+		if w.isStopped() {
+			// Stop might have closed the connection replaced by a migration
+			w.conn.Close()
+		}
+	}()
+
+	if w.dedicatedHeartbeat {
+		heartbeatDone := make(chan struct{})
+		defer close(heartbeatDone)
+		go w.heartbeatLoop(heartbeatDone, w.heartbeatTimeout, w.disownTimeout)
+	} else {
+		// Send heartbeat to notify cocaine-runtime
+		// we are ready to work
+		w.onHeartbeatTimeout()
+	}
+
+	var stackSignal chan os.Signal
+
+	if w.stackSignalEnabled {
+		stackSignal = make(chan os.Signal, 1)
+		signal.Notify(stackSignal, syscall.SIGUSR1)
+		defer signal.Stop(stackSignal)
+	}
+
+	if !w.started {
+		if w.startHook != nil {
+			if err := w.startHook(); err != nil {
+				w.Stop()
+				return err
+			}
+		}
+		w.started = true
+
+		if w.startupProbe != nil {
+			// heartbeats are kept sent while the probe runs
+			w.startStartupProbe()
+		} else if w.readinessNotify != nil {
+			w.readinessNotify()
+		}
+	}
+
+	for {
+		incoming := w.conn.Read()
+		if w.isThrottled() {
+			// stop reading until deferred handlers are started
+			incoming = nil
+		}
+
+		var migrated <-chan *Message
+		if w.migration != nil {
+			migrated = w.migration.conn.Read()
+		}
+
+		select {
+		case msg, ok := <-incoming:
+			if !ok {
+				// either the connection is lost
+				// or the worker was stopped
+				select {
+				case <-w.stopped:
+					return nil
+				default:
+				}
+
+				if w.migration == nil {
+					return ErrConnectionLost
+				}
+				// sessions of the old connection can not be drained anymore
+				w.finishMigration()
+				continue
+			}
+
+			// non-blocking
+			if err := w.dispatcher.onMessage(w, msg); err != nil {
+				fmt.Printf("onMessage returns %v\n", err)
+			}
+
+		case <-w.overload.handlerFinished:
+			w.overload.startPending()
+			if w.pendingTerminate != nil && w.overload.isIdle() {
+				w.finishTermination()
+			}
+			if w.pendingShutdown != nil && w.overload.isIdle() {
+				w.finishShutdown(*w.pendingShutdown, nil)
+			}
+
+		case request := <-w.shutdownRequests:
+			w.onShutdown(request)
+
+		case request := <-w.migrations:
+			w.onMigrate(request)
+
+		case request := <-w.sessionsRequests:
+			w.onSessionsRequest(request)
+
+		case msg, ok := <-migrated:
+			if !ok {
+				w.abortMigration(ErrConnectionLost)
+				continue
+			}
+			w.onMigratedMessage(msg)
+
+		case <-w.shutdownExpired():
+			w.finishShutdown(*w.pendingShutdown, w.pendingShutdown.ctx.Err())
+
+		case <-w.graceExpired:
+			w.finishTermination()
+
+		case err := <-w.probeDone:
+			if err != nil {
+				// waiting clients are replied before the connection is closed
+				w.terminateAllSessions(ErrorWorkerTerminating, "the startup probe has failed")
+				w.stopGracefully()
+				return err
+			}
+			w.onStartupProbePassed()
+
+		case id := <-w.expiredSessions:
+			w.onResponseDeadline(id)
+
+		case id := <-w.idleSessions:
+			w.onRequestIdle(id)
+
+		case <-w.heartbeatTimer.C():
+			// Reset (start) disown & heartbeat timers
+			// Send a heartbeat message to cocaine-runtime
+			w.onHeartbeatTimeout() // non-blocking
+
+		case cfg := <-w.timeoutUpdates:
+			w.onTimeoutsUpdate(cfg)
+
+		case <-w.heartbeatSent:
+			// a heartbeat has been sent by heartbeatLoop
+			w.awaitingHeartbeat = true
+			w.disownTimer.Reset(w.disownTimeout)
+
+		case <-w.disownTimer.C():
+			w.onDisownTimeout() // non-blocking
+			return ErrDisowned
+
+		case <-w.stopped:
+			return nil
+
+		case <-stackSignal:
+			w.printAllStacks()
+		}
+
+		if w.migration != nil && w.overload.isIdle() {
+			w.finishMigration()
+		}
+	}
+}
+
+// logWithFields returns an entry of the worker's logger
+// with the version of the application attached to fields
+func (w *WorkerNG) logWithFields(fields Fields) *Entry {
+	if w.version != "" {
+		fields["version"] = w.version
+	}
+	return w.logger.WithFields(fields)
+}
+
+// printAllStacks prints all stacks to stderr and writes to a file
+func (w *WorkerNG) printAllStacks() {
+	stackTrace := dumpStack()
+	// print to stdout to have it in the logs
+	fmt.Printf("=== START STACKTRACE ===\n%s\n=== END STACKTRACE ===", stackTrace)
+	// to debug blocked workers. It will be removed somewhen
+	filename := fmt.Sprintf("%s-%d", GetDefaults().ApplicationName(), os.Getpid())
+	if err := ioutil.WriteFile(filename, stackTrace, 0660); err != nil {
+		fmt.Printf("unable to create the file with stacktraces %s: %v\n", filename, err)
+	}
+}
+
+// A reply to heartbeat is not arrived during disownTimeout,
+// so it seems cocaine-runtime has died
+func (w *WorkerNG) onDisownTimeout() {
+	atomic.AddInt64(&w.counters.disowns, 1)
+	if w.backoff != nil {
+		// RunWithReconnect dials cocaine-runtime again
+		w.conn.Close()
+		return
+	}
+	w.Stop()
+}
+
+// isThrottled reports whether the loop must not read from the connection.
+// Reading is not paused while a heartbeat reply is expected
+// to not be disowned by cocaine-runtime.
+func (w *WorkerNG) isThrottled() bool {
+	return w.overload.mode == ModeThrottle &&
+		!w.awaitingHeartbeat &&
+		len(w.overload.pending) > 0
+}
+
+func (w *WorkerNG) onHeartbeatTimeout() {
+	if w.isStopped() {
+		// the timer has fired along with Stop
+		return
+	}
+
+	w.awaitingHeartbeat = true
+	// Wait for the reply until disown timeout comes
+	w.disownTimer.Reset(w.disownTimeout)
+	// Send next heartbeat over heartbeatTimeout
+	w.heartbeatTimer.Reset(w.heartbeatTimeout)
+
+	w.sendHeartbeat(w.disownTimeout)
+}
+
+func (w *WorkerNG) onTimeoutsUpdate(cfg TimeoutConfig) {
+	w.heartbeatTimeout = cfg.Heartbeat
+	w.disownTimeout = cfg.Disown
+	w.responseDeadline = cfg.ResponseDeadline
+	w.requestIdleTimeout = cfg.RequestIdle
+
+	if w.requestIdleTimeout == 0 {
+		// 0 means no limit, so timers of active sessions must not fire
+		for _, session := range w.sessions {
+			session.stopIdle()
+			session.idle = nil
+		}
+	}
+
+	if w.dedicatedHeartbeat {
+		// replace an update which has not been received yet.
+		// The loop is the only sender, so it never blocks
+		select {
+		case <-w.heartbeatUpdates:
+		default:
+		}
+		w.heartbeatUpdates <- cfg
+		return
+	}
+
+	// the running disown timer keeps the old timeout
+	if !w.heartbeatTimer.Stop() {
+		select {
+		case <-w.heartbeatTimer.C():
+		default:
+		}
+	}
+	w.heartbeatTimer.Reset(w.heartbeatTimeout)
+}
+
+// heartbeatLoop sends heartbeats regardless of the load of the main loop.
+// The main loop is notified to start the disown timer.
+// Timeouts are copied, as they are changed by the main loop
+func (w *WorkerNG) heartbeatLoop(done <-chan struct{}, heartbeatTimeout, disownTimeout time.Duration) {
+	ticker := w.clock.NewTimer(heartbeatTimeout)
+	defer func() {
+		ticker.Stop()
+	}()
+
+	for {
+		w.sendHeartbeat(disownTimeout)
+		select {
+		case w.heartbeatSent <- struct{}{}:
+		default:
+			// the main loop has not handled the previous one yet
+		}
+
+		for ticked := false; !ticked; {
+			select {
+			case <-ticker.C():
+				ticked = true
+				ticker.Reset(heartbeatTimeout)
+			case cfg := <-w.heartbeatUpdates:
+				// the next heartbeat is sent after the new interval
+				if !ticker.Stop() {
+					<-ticker.C()
+				}
+				heartbeatTimeout = cfg.Heartbeat
+				ticker.Reset(heartbeatTimeout)
+				disownTimeout = cfg.Disown
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (w *WorkerNG) sendHeartbeat(disownTimeout time.Duration) {
+	var (
+		conn        = w.getHeartbeatConn()
+		heartbeat   = w.newHeartbeat()
+		giveUp      = w.clock.NewTimer(disownTimeout)
+		blockedWarn = w.clock.NewTimer(w.heartbeatWriteTimeout)
+		warned      = blockedWarn.C()
+	)
+	defer giveUp.Stop()
+	defer blockedWarn.Stop()
+
+	for {
+		select {
+		case conn.Write() <- heartbeat:
+			atomic.AddInt64(&w.counters.heartbeatsSent, 1)
+			return
+		case <-conn.IsClosed():
+			return
+		case <-warned:
+			// keep waiting, but let know that the loop is stuck
+			w.logWithFields(Fields{
+				"timeout": w.heartbeatWriteTimeout.String(),
+			}).Warnf("heartbeat write is blocked")
+			w.metrics.IncBlockedHeartbeat()
+			warned = nil
+		case <-giveUp.C():
+			return
+		}
+	}
+}
+
+// Send handshake message to cocaine-runtime
+// It is needed to be called once on a startup and on a migration
+// to notify runtime that we have started
+func (w *WorkerNG) sendHandshake(conn socketIO) error {
+	timeout := w.clock.NewTimer(w.disownTimeout)
+	defer timeout.Stop()
+
+	select {
+	case conn.Write() <- w.newHandshake(w.id):
+	case <-conn.IsClosed():
+	case <-timeout.C():
+		return fmt.Errorf("unable to send a handshake for a long time")
+	}
+	return nil
+}
+
+// Message handlers
+
+func (w *WorkerNG) onChoke(msg *Message) {
+	if session, ok := w.sessions[msg.Session]; ok {
+		if session.continued {
+			session.push(w.dispatcher.newChunk(msg.Session, session.flushPartial()))
+		}
+		session.Close()
+		session.stopIdle()
+		w.removeSession(msg.Session)
+		return
+	}
+
+	if _, ok := w.abandonedSessions[msg.Session]; ok {
+		// the session has been closed by the worker,
+		// so it is an expected choke
+		delete(w.abandonedSessions, msg.Session)
+		return
+	}
+
+	w.logWithFields(Fields{
+		"session": msg.Session,
+	}).Warnf("choke for an unknown session")
+	w.metrics.IncProtocolAnomaly(AnomalyUnknownSessionChoke)
+}
+
+func (w *WorkerNG) onChunk(msg *Message) {
+	session, ok := w.sessions[msg.Session]
+	if !ok {
+		if _, ok := w.abandonedSessions[msg.Session]; !ok {
+			// the request stream has been closed by cocaine-runtime
+			w.logWithFields(Fields{
+				"session": msg.Session,
+			}).Warnf("chunk for a closed session has been dropped")
+		}
+		return
+	}
+
+	session.chunks++
+	if session.idle != nil {
+		session.lastChunk = w.clock.Now()
+		session.idle.Reset(w.requestIdleTimeout)
+	}
+
+	if len(msg.Payload) > 0 {
+		if data, ok := msg.Payload[0].([]byte); ok {
+			session.addBytesIn(len(data))
+		}
+	}
+
+	if w.maxChunksPerSession > 0 && session.chunks > w.maxChunksPerSession {
+		w.logWithFields(Fields{
+			"session": msg.Session,
+			"limit":   w.maxChunksPerSession,
+		}).Errf("session has been terminated: too many chunks")
+		w.terminateSession(msg.Session, ErrorTooManyChunks,
+			fmt.Sprintf("the limit of %d chunks per session is exceeded", w.maxChunksPerSession))
+		return
+	}
+
+	if session.maxPayload > 0 && session.getBytesIn() > session.maxPayload {
+		w.logWithFields(Fields{
+			"session": msg.Session,
+			"limit":   session.maxPayload,
+		}).Errf("session has been terminated: payload is too large")
+		w.terminateSession(msg.Session, ErrorPayloadTooLarge,
+			fmt.Sprintf("the limit of %d bytes per session is exceeded", session.maxPayload))
+		return
+	}
+
+	if w.chunkReassembly && !session.reassemble(msg) {
+		return
+	}
+
+	session.push(msg)
+}
+
+func (w *WorkerNG) onError(msg *Message) {
+	if session, ok := w.sessions[msg.Session]; ok {
+		session.flushPartial()
+		session.push(msg)
+	}
+}
+
+// terminateSession replies with an error to a client
+// and closes the request stream of the session
+func (w *WorkerNG) terminateSession(id uint64, code int, message string) {
+	w.terminateRequest(id, code, message, false)
+}
+
+// terminateRequest is terminateSession, which also passes the error
+// to the handler if notifyHandler is set. The client is replied first,
+// otherwise the handler may close the response before the error is sent
+func (w *WorkerNG) terminateRequest(id uint64, code int, message string, notifyHandler bool) {
+	session, ok := w.sessions[id]
+	if !ok {
+		return
+	}
+
+	session.response.ErrorMsg(code, message)
+	if notifyHandler {
+		session.push(w.dispatcher.newError(id, cworkererrorcategory, code, message))
+	}
+	session.Close()
+	session.stopIdle()
+	w.removeSession(id)
+	w.abandonedSessions[id] = struct{}{}
+}
+
+func (w *WorkerNG) addSession(id uint64, session *workerSession) {
+	w.sessions[id] = session
+	atomic.StoreInt64(&w.activeSessions, int64(len(w.sessions)))
+}
+
+func (w *WorkerNG) removeSession(id uint64) {
+	delete(w.sessions, id)
+	atomic.StoreInt64(&w.activeSessions, int64(len(w.sessions)))
+}
+
+// terminateAllSessions cancels contexts of every active session
+// and replies with an error to their clients
+func (w *WorkerNG) terminateAllSessions(code int, message string) {
+	for id, session := range w.sessions {
+		w.terminateSession(id, code, message)
+		session.cancel()
+	}
+}
+
+// newSessionTimer starts a timer which passes
+// the id of the session to the loop over ch
+func (w *WorkerNG) newSessionTimer(d time.Duration, ch chan<- uint64, id uint64) Timer {
+	closed := w.conn.IsClosed()
+	return w.clock.AfterFunc(d, func() {
+		select {
+		case ch <- id:
+		case <-closed:
+		case <-w.stopped:
+		}
+	})
+}
+
+// onRequestIdle terminates a session if a client
+// has sent no chunks within requestIdleTimeout
+func (w *WorkerNG) onRequestIdle(id uint64) {
+	session, ok := w.sessions[id]
+	if !ok || session.idle == nil {
+		// the limit has been disabled after the timer had fired
+		return
+	}
+
+	if w.clock.Now().Sub(session.lastChunk) < w.requestIdleTimeout {
+		// a chunk has arrived after the timer had fired,
+		// the timer has been already restarted
+		return
+	}
+
+	message := fmt.Sprintf("no data has been received for %v", w.requestIdleTimeout)
+	// let the handler know why the request is over
+	w.terminateRequest(id, ErrorRequestIdleTimeout, message, true)
+}
+
+// onResponseDeadline terminates a session which
+// has not been closed by a handler in time
+func (w *WorkerNG) onResponseDeadline(id uint64) {
+	session, ok := w.sessions[id]
+	if !ok {
+		return
+	}
+
+	if timeout, ok := w.eventTimeouts[session.event]; ok {
+		w.terminateSession(id, ErrorHandlerTimeout,
+			fmt.Sprintf("the timeout %v of the event %s is exceeded", timeout, session.event))
+	} else {
+		w.terminateSession(id, ErrorResponseDeadline,
+			fmt.Sprintf("the response deadline %v is exceeded", w.responseDeadline))
+	}
+	session.cancel()
+}
+
+func (w *WorkerNG) onInvoke(msg *Message) error {
+	atomic.AddInt64(&w.counters.invokes, 1)
+
+	if _, ok := w.sessions[msg.Session]; ok && !w.onDuplicateInvoke(msg) {
+		return nil
+	}
+
+	event, ok := getEventName(msg)
+	if !ok {
+		// corrupted message, but the client must not hang
+		w.logWithFields(Fields{
+			"session": msg.Session,
+		}).Warnf("invoke without an event name: %s", msg.String())
+		w.metrics.IncProtocolAnomaly(AnomalyMalformedInvoke)
+		w.rejectInvoke(msg.Session, event, ErrorMalformedInvoke, "unable to get an event name from the invoke")
+		return nil
+	}
+
+	if w.isEventDisabled(event) {
+		w.rejectInvoke(msg.Session, event, ErrorEventDisabled,
+			fmt.Sprintf("the event %s is temporary disabled", event))
+		return nil
+	}
+
+	if w.terminating || w.isStopped() {
+		// the invoke has raced with a termination
+		w.rejectInvoke(msg.Session, event, ErrorWorkerTerminating, "the worker is terminating")
+		return nil
+	}
+
+	if w.migration != nil {
+		// the old connection is draining
+		w.rejectInvoke(msg.Session, event, ErrorWorkerTerminating, "the worker is moving to another connection")
+		return nil
+	}
+
+	if w.maxSessions > 0 && len(w.sessions) >= w.maxSessions {
+		w.rejectInvoke(msg.Session, event, ErrorOverloaded,
+			fmt.Sprintf("the limit of %d concurrent sessions is reached", w.maxSessions))
+		return nil
+	}
+
+	if w.overload.mode == ModeReject && w.overload.isOverloaded() {
+		w.rejectInvoke(msg.Session, event, ErrorOverloaded,
+			fmt.Sprintf("the limit of %d active handlers is reached", w.overload.maxActiveHandlers))
+		return nil
+	}
+
+	limit := w.overload.eventLimits[event]
+	if limit != nil && w.overload.mode == ModeReject && limit.isFull() {
+		w.rejectInvoke(msg.Session, event, ErrorOverloaded,
+			fmt.Sprintf("the limit of %d active handlers of the event %s is reached", limit.max, event))
+		return nil
+	}
+
+	w.reportDeprecated(event)
+
+	var (
+		currentSession = msg.Session
+		ctx            context.Context
+		cancel         context.CancelFunc
+	)
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	if traceInfo, err := msg.Headers.getTraceData(); err == nil {
+		ctx = AttachTraceInfo(ctx, traceInfo)
+	}
+
+	if len(msg.Headers) > 0 {
+		ctx = attachHeaders(ctx, msg.Headers)
+	}
+
+	requestID := newRequestID(msg.Headers)
+	ctx = attachRequestID(ctx, requestID)
+
+	ctx = attachLogger(ctx, w.logWithFields(Fields{
+		"session": currentSession,
+		"event":   event,
+	}))
+	ctx = attachTerminating(ctx, w.terminateRequested)
+
+	responseStream := newResponse(w.dispatcher, currentSession, w.conn, w.conn.IsClosed())
+	if w.requestIDEcho {
+		responseStream.headers = requestIDHeaders(requestID.String())
+	}
+	responseStream.progressFrames = w.progressFrames
+	if sender, ok := w.conn.(trackedSender); ok && w.flowControlWindow > 0 {
+		responseStream.flow = newFlowControl(sender, w.flowControlWindow)
+	}
+	requestStream := newRequest(w.dispatcher)
+	session := newWorkerSession(currentSession, event, requestStream, responseStream, cancel)
+	session.maxPayload = w.payloadLimit(event)
+	responseStream.maxPayload = session.maxPayload
+	responseStream.onClose = func(summary responseSummary) {
+		w.onSessionClosed(session, summary)
+	}
+	w.addSession(currentSession, session)
+
+	if timeout, ok := w.eventTimeouts[event]; ok {
+		session.deadline = w.newSessionTimer(timeout, w.expiredSessions, currentSession)
+	} else if w.responseDeadline > 0 {
+		session.deadline = w.newSessionTimer(w.responseDeadline, w.expiredSessions, currentSession)
+	}
+
+	if w.requestIdleTimeout > 0 {
+		session.lastChunk = w.clock.Now()
+		session.idle = w.newSessionTimer(w.requestIdleTimeout, w.idleSessions, currentSession)
+	}
+
+	autoClose := w.autoClose && !w.keepOpenEvents[event]
+	queuedAt := time.Now()
+	startHandler := func() {
+		w.metrics.ObserveQueueWait(event, time.Since(queuedAt))
+		w.overload.onHandlerStarted()
+		go func() {
+			defer w.overload.onHandlerFinished()
+			if limit != nil {
+				// the slot must be free when the loop is notified
+				defer limit.release()
+			}
+			defer cancel()
+			// this trap catches a panic from a handler
+			// and checks if the response is closed.
+			request, snapshot := w.newPanicSnapshot(requestStream)
+			report := PanicReport{
+				Event:   event,
+				Session: currentSession,
+			}
+			defer trapRecoverAndClose(ctx, report, snapshot, responseStream, w.onPanic, autoClose)
+
+			ctx, closeHandlerSpan := NewSpan(ctx, event)
+			defer closeHandlerSpan()
+
+			w.handler(ctx, event, request, responseStream)
+		}()
+	}
+
+	scheduleHandler := func() {
+		if limit != nil {
+			limit.acquire()
+		}
+
+		if w.overload.mode == ModeThrottle && (len(w.overload.pending) > 0 || w.overload.isOverloaded()) {
+			// the handler is started when the load drops,
+			// meanwhile chunks of the session are buffered
+			w.overload.pending = append(w.overload.pending, startHandler)
+			return
+		}
+
+		startHandler()
+	}
+
+	admitHandler := func() {
+		if limit != nil && (len(limit.pending) > 0 || limit.isFull()) {
+			// unlike the global limit it doesn't stop reading,
+			// so other events are not affected
+			limit.pending = append(limit.pending, scheduleHandler)
+			return
+		}
+
+		scheduleHandler()
+	}
+
+	if w.probeDone != nil {
+		// the handler is started once the startup probe has passed,
+		// meanwhile chunks of the session are buffered
+		w.probePending = append(w.probePending, admitHandler)
+		return nil
+	}
+
+	admitHandler()
+	return nil
+}
+
+// onSessionClosed is called from a handler goroutine
+// when the response of the session is closed
+func (w *WorkerNG) onSessionClosed(session *workerSession, summary responseSummary) {
+	session.stopDeadline()
+
+	entry := newAccessLogEntry(session, summary)
+	entry.Version = w.version
+	w.metrics.ObserveSession(newSessionMetrics(entry))
+
+	if w.accessLogger != nil {
+		w.accessLogger(entry)
+	}
+
+	if w.accessLogService != nil {
+		w.accessLogService.log(entry)
+	}
+
+	if w.recentRequests != nil {
+		w.recentRequests.add(newRequestSummary(entry))
+	}
+}
+
+// rejectInvoke replies with an error to a new session
+// without starting a handler
+func (w *WorkerNG) rejectInvoke(id uint64, event string, code int, message string) {
+	response := w.newRejectResponse(id, event)
+	if code == ErrorOverloaded && w.overloadRetryAfter > 0 {
+		response.RetryableError(code, message, w.overloadRetryAfter)
+	} else {
+		response.ErrorMsg(code, message)
+	}
+	w.abandonedSessions[id] = struct{}{}
+}
+
+// newRejectResponse creates the response to a session rejected
+// without a handler. The session is logged and counted
+// by metrics like a failed one
+func (w *WorkerNG) newRejectResponse(id uint64, event string) *response {
+	response := newResponse(w.dispatcher, id, w.conn, w.conn.IsClosed())
+	session := newWorkerSession(id, event, nil, response, nil)
+	response.onClose = func(summary responseSummary) {
+		w.onSessionClosed(session, summary)
+	}
+	return response
+}
+
+func (w *WorkerNG) onHeartbeat(msg *Message) {
+	// Reply to a heartbeat has been received,
+	// so we are not disowned & disownTimer must be stopped
+	// It will be launched when the next heartbeat is sent
+	w.disownTimer.Stop()
+	w.awaitingHeartbeat = false
+	atomic.StoreInt64(&w.counters.lastHeartbeatReply, time.Now().UnixNano())
+}
+
+func (w *WorkerNG) onTerminate(msg *Message) {
+	if w.terminating {
+		return
+	}
+	w.terminating = true
+	w.pendingTerminate = msg
+
+	if grace := terminateGrace(msg.Payload); grace > 0 {
+		w.graceDeadline = time.Now().Add(grace)
+		if !w.overload.isIdle() {
+			// new invokes are rejected, while active handlers
+			// are allowed to finish within the granted time
+			w.graceExpired = w.clock.NewTimer(grace).C()
+			return
+		}
+	}
+
+	w.finishTermination()
+}
+
+// finishTermination stops the worker after it has been asked
+// to terminate and active handlers have finished or the grace period is over
+func (w *WorkerNG) finishTermination() {
+	msg := w.pendingTerminate
+	w.pendingTerminate = nil
+	w.graceExpired = nil
+
+	// downstream calls are cancelled once the grace period is over,
+	// so handlers can finish them within the granted time
+	w.closeTerminating()
+	// Cancel running handlers to prevent them
+	// from writing into the connection which is about to die
+	w.terminateAllSessions(ErrorWorkerTerminating, "the worker is terminating")
+
+	if w.terminationHandler != nil {
+		timeout := terminationTimeout
+		if !w.graceDeadline.IsZero() {
+			// the handler has the rest of the granted time
+			timeout = w.graceDeadline.Sub(time.Now())
+		}
+
+		ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+		onDone := make(chan struct{})
+		go func() {
+			w.terminationHandler(ctx)
+			close(onDone)
+		}()
+
+		select {
+		case <-onDone:
+			cancelTimeout()
+		case <-ctx.Done():
+			fmt.Printf("terminationHandler timeouted: %v\n", ctx.Err())
+		}
+	}
+
+	// According to spec we have time
+	// to prepare for being killed by cocaine-runtime
+	timeout := w.clock.NewTimer(w.disownTimeout)
+	defer timeout.Stop()
+
+	select {
+	case w.conn.Write() <- msg:
+		// reply with the same termination message
+	case <-w.conn.IsClosed():
+	case <-timeout.C():
+	}
+	w.stopGracefully()
+}
+
+// closeTerminating cancels downstream calls of active handlers
+func (w *WorkerNG) closeTerminating() {
+	select {
+	case <-w.terminateRequested:
+	default:
+		close(w.terminateRequested)
+	}
+}
+
+// shutdownExpired returns a channel which is closed when
+// the time of active handlers granted by Shutdown is over.
+// It is nil if there is no pending shutdown
+func (w *WorkerNG) shutdownExpired() <-chan struct{} {
+	if w.pendingShutdown == nil {
+		return nil
+	}
+	return w.pendingShutdown.ctx.Done()
 }
@@ -0,0 +1,113 @@
+package cocaine12
+
+// WorkerOption configures a worker created by NewWorkerWithOptions
+type WorkerOption func(*workerOptions) error
+
+type workerOptions struct {
+	config WorkerConfig
+	framer Framer
+	// the connection to cocaine-runtime, nil means to dial config.Endpoint
+	conn     socketIO
+	timeouts *TimeoutConfig
+	clock    Clock
+}
+
+// WithConfig replaces the whole configuration of the worker,
+// e.g. by one returned from LoadWorkerConfig.
+// Options passed after it override particular values.
+func WithConfig(config WorkerConfig) WorkerOption {
+	return func(o *workerOptions) error {
+		o.config = config
+		return nil
+	}
+}
+
+// WithEndpoint sets the unix socket path to connect to cocaine-runtime
+func WithEndpoint(endpoint string) WorkerOption {
+	return func(o *workerOptions) error {
+		o.config.Endpoint = endpoint
+		return nil
+	}
+}
+
+// WithUUID sets the id the worker introduces itself with to cocaine-runtime
+func WithUUID(uuid string) WorkerOption {
+	return func(o *workerOptions) error {
+		o.config.UUID = uuid
+		return nil
+	}
+}
+
+// WithTimeouts sets timeouts of the worker like Worker.UpdateTimeouts,
+// but before the worker is run
+func WithTimeouts(cfg TimeoutConfig) WorkerOption {
+	return func(o *workerOptions) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		o.timeouts = &cfg
+		return nil
+	}
+}
+
+// WithFramer wraps messages to cocaine-runtime into frames
+// of a non-standard transport like NewWorkerWithFramer
+func WithFramer(framer Framer) WorkerOption {
+	return func(o *workerOptions) error {
+		o.framer = framer
+		return nil
+	}
+}
+
+// WithConnection makes the worker talk to cocaine-runtime over conn,
+// e.g. an end of NewMemorySocketPair, instead of dialing the endpoint
+func WithConnection(conn socketIO) WorkerOption {
+	return func(o *workerOptions) error {
+		o.conn = conn
+		return nil
+	}
+}
+
+// WithClock replaces the clock of all timers of the worker.
+// It is intended for tests: pass NewFakeClock() and move the time
+// by Worker.AdvanceClock instead of sleeping
+func WithClock(clock Clock) WorkerOption {
+	return func(o *workerOptions) error {
+		o.clock = clock
+		return nil
+	}
+}
+
+// NewWorkerNGWithOptions creates WorkerNG configured by opts only.
+// Unlike NewWorkerNG it neither parses the command line
+// nor touches the global flag set.
+func NewWorkerNGWithOptions(opts ...WorkerOption) (*WorkerNG, error) {
+	o := workerOptions{
+		config: WorkerConfig{
+			Protocol: v1,
+		},
+	}
+
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := newWorkerNGWithConfig(o.config, o.framer, o.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.timeouts != nil {
+		w.heartbeatTimeout = o.timeouts.Heartbeat
+		w.disownTimeout = o.timeouts.Disown
+		w.responseDeadline = o.timeouts.ResponseDeadline
+		w.requestIdleTimeout = o.timeouts.RequestIdle
+	}
+
+	if o.clock != nil {
+		w.setClock(o.clock)
+	}
+	return w, nil
+}
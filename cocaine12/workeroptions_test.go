@@ -0,0 +1,55 @@
+package cocaine12
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWorkerWithOptions(t *testing.T) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	runtime, _ := newAsyncRW(in)
+
+	w, err := NewWorkerWithOptions(
+		WithConnection(sock),
+		WithUUID("options-uuid"),
+		WithTimeouts(TimeoutConfig{
+			Heartbeat: 50 * time.Millisecond,
+			Disown:    time.Second,
+		}),
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer w.Stop()
+
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	go w.Run(nil)
+
+	handshake := readTestMessage(t, runtime)
+	checkTypeAndSession(t, handshake, v1UtilitySession, v1Handshake)
+	assert.Equal(t, "options-uuid", fmt.Sprintf("%s", handshake.Payload[0]))
+
+	// the second heartbeat follows the first one after the custom interval
+	for i := 0; i < 2; i++ {
+		checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+		runtime.Write() <- newHeartbeatV1()
+	}
+
+	runtime.Write() <- newInvokeV1(2, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+}
+
+func TestNewWorkerWithOptionsErrors(t *testing.T) {
+	_, err := NewWorkerWithOptions(WithUUID("uuid"))
+	assert.Equal(t, ErrNoCocaineEndpoint, err)
+
+	_, err = NewWorkerWithOptions(WithEndpoint("/tmp/unused.sock"), WithTimeouts(TimeoutConfig{}))
+	assert.Equal(t, ErrInvalidTimeouts, err)
+}
@@ -28,8 +28,8 @@ func doBenchmarkWorkerEcho(b *testing.B, bullets uint64) {
 		panic(err)
 	}
 
-	w.impl.disownTimer = time.NewTimer(1 * time.Hour)
-	w.impl.heartbeatTimer = time.NewTimer(1 * time.Hour)
+	w.impl.disownTimer = w.impl.clock.NewTimer(1 * time.Hour)
+	w.impl.heartbeatTimer = w.impl.clock.NewTimer(1 * time.Hour)
 
 	w.On("echo", func(ctx context.Context, req Request, resp Response) {
 		defer resp.Close()
@@ -70,3 +70,58 @@ func BenchmarkWorkerEcho100(b *testing.B) {
 func BenchmarkWorkerEcho1000(b *testing.B) {
 	doBenchmarkWorkerEcho(b, 1000)
 }
+
+func doBenchmarkWorkerInvokeMemory(b *testing.B, opts MemorySocketOptions) {
+	sock, runtime := NewMemorySocketPair(opts)
+	w, err := newWorker(sock, "uuid", 1, true)
+	if err != nil {
+		panic(err)
+	}
+
+	w.impl.disownTimer = w.impl.clock.NewTimer(1 * time.Hour)
+	w.impl.heartbeatTimer = w.impl.clock.NewTimer(1 * time.Hour)
+
+	w.On("echo", func(ctx context.Context, req Request, resp Response) {
+		defer resp.Close()
+
+		data, err := req.Read(ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp.Write(data)
+	})
+
+	go func() {
+		w.Run(nil)
+	}()
+	defer w.Stop()
+
+	// handshake & heartbeat
+	<-runtime.Read()
+	<-runtime.Read()
+
+	go func() {
+		for i := uint64(0); i < uint64(b.N); i++ {
+			session := i + 2
+			runtime.Send(newInvokeV1(session, "echo"))
+			runtime.Send(newChunkV1(session, []byte("Dummy")))
+			runtime.Send(newChokeV1(session))
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// chunk
+		<-runtime.Read()
+		// choke
+		<-runtime.Read()
+	}
+}
+
+func BenchmarkWorkerInvokeMemory(b *testing.B) {
+	doBenchmarkWorkerInvokeMemory(b, MemorySocketOptions{})
+}
+
+func BenchmarkWorkerInvokeMemoryLatency(b *testing.B) {
+	doBenchmarkWorkerInvokeMemory(b, MemorySocketOptions{Latency: time.Millisecond})
+}
@@ -1,11 +1,14 @@
 package cocaine12
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -122,6 +125,12 @@ func TestWorkerV1(t *testing.T) {
 	eHeartbeat := <-sock2.Read()
 	checkTypeAndSession(t, eHeartbeat, v1UtilitySession, v1Heartbeat)
 
+	// the corrupted invoke is rejected
+	eMalformed := <-sock2.Read()
+	checkTypeAndSession(t, eMalformed, testSession-1, v1Error)
+	code, _ := unpackTestError(t, eMalformed)
+	assert.Equal(t, ErrorMalformedInvoke, code)
+
 	// test event
 	eChunk := <-sock2.Read()
 	checkTypeAndSession(t, eChunk, testSession, v1Write)
@@ -333,3 +342,2169 @@ func TestWorkerLoad(t *testing.T) {
 		t.Fatalf("unexpected exit")
 	}
 }
+
+func TestWorkerOnConnError(t *testing.T) {
+	const testID = "uuid"
+
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	sock2, _ := newAsyncRW(in)
+	w, err := newWorker(sock, testID, 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+	defer sock2.Close()
+
+	type connError struct {
+		op  string
+		err error
+	}
+	errs := make(chan connError, 1)
+	w.SetOnConnError(func(op string, err error) {
+		errs <- connError{op, err}
+	})
+
+	injected := fmt.Errorf("injected error")
+	in.(*pipeConn).writer.CloseWithError(injected)
+
+	select {
+	case e := <-errs:
+		assert.Equal(t, "read", e.op)
+		assert.Equal(t, injected, e.err)
+	case <-time.After(time.Second):
+		t.Fatal("the connection error has not been reported")
+	}
+
+	// a clean close must not be reported
+	in, out = testConn()
+	sock, _ = newAsyncRW(out)
+	sock.setErrorHandler(func(op string, err error) {
+		t.Errorf("unexpected %s error: %v", op, err)
+	})
+	sock.Close()
+	in.Close()
+}
+
+// newTestWorker creates a worker connected to an in-memory runtime
+func newTestWorker(t *testing.T) (*Worker, *asyncRWSocket) {
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	runtime, _ := newAsyncRW(in)
+	w, err := newWorker(sock, "uuid", 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+	return w, runtime
+}
+
+// runTestWorker runs the worker, consumes the handshake and
+// the first heartbeat and replies to it.
+// The returned channel receives the result of Run.
+func runTestWorker(t *testing.T, w *Worker, runtime *asyncRWSocket) <-chan error {
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.Run(nil)
+	}()
+
+	checkTypeAndSession(t, <-runtime.Read(), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, <-runtime.Read(), v1UtilitySession, v1Heartbeat)
+	runtime.Write() <- newHeartbeatV1()
+	return onStop
+}
+
+// readTestMessage reads the next message from the worker
+func readTestMessage(t *testing.T, runtime *asyncRWSocket) *Message {
+	select {
+	case msg, ok := <-runtime.Read():
+		if !ok {
+			t.Fatal("the connection has been closed")
+		}
+		return msg
+	case <-time.After(time.Second * 2):
+		t.Fatal("no message from the worker")
+	}
+	return nil
+}
+
+// unpackTestError decodes the payload of v1 error message
+func unpackTestError(t *testing.T, msg *Message) (code int, message string) {
+	var perr struct {
+		CodeInfo [2]int
+		Message  string
+	}
+	assert.NoError(t, convertPayload(msg.Payload, &perr))
+	return perr.CodeInfo[1], perr.Message
+}
+
+func TestWorkerMaxChunksPerSession(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	handlerErr := make(chan error, 1)
+	w.SetMaxChunksPerSession(2)
+	w.On("flood", func(ctx context.Context, req Request, res Response) {
+		for {
+			if _, err := req.Read(ctx); err != nil {
+				handlerErr <- err
+				return
+			}
+		}
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "flood")
+	for i := 0; i < 3; i++ {
+		runtime.Write() <- newChunkV1(testSession, []byte("Dummy"))
+	}
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorTooManyChunks, code)
+
+	select {
+	case err := <-handlerErr:
+		assert.Equal(t, ErrStreamIsClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("the request stream has not been closed")
+	}
+}
+
+func TestWorkerDisableEvent(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	echo := func(ctx context.Context, req Request, res Response) {
+		defer res.Close()
+		data, _ := req.Read(ctx)
+		res.Write(data)
+	}
+	w.On("a", echo)
+	w.On("b", echo)
+	runTestWorker(t, w, runtime)
+
+	w.DisableEvent("a")
+
+	runtime.Write() <- newInvokeV1(2, "a")
+	runtime.Write() <- newChunkV1(2, []byte("A"))
+	runtime.Write() <- newChokeV1(2)
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorEventDisabled, code)
+
+	runtime.Write() <- newInvokeV1(3, "b")
+	runtime.Write() <- newChunkV1(3, []byte("B"))
+	runtime.Write() <- newChokeV1(3)
+
+	checkTypeAndSession(t, readTestMessage(t, runtime), 3, v1Write)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 3, v1Close)
+
+	w.EnableEvent("a")
+
+	runtime.Write() <- newInvokeV1(4, "a")
+	runtime.Write() <- newChunkV1(4, []byte("A"))
+	runtime.Write() <- newChokeV1(4)
+
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 4, v1Write)
+	assert.Equal(t, []byte("A"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 4, v1Close)
+}
+
+func TestWorkerHeartbeatBuilder(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.impl.heartbeatTimeout = 50 * time.Millisecond
+	w.SetHandshakeBuilder(func(id string) *Message {
+		msg := newHandshakeV1(id)
+		msg.Payload = append(msg.Payload, "custom")
+		return msg
+	})
+	w.SetHeartbeatBuilder(func() *Message {
+		msg := newHeartbeatV1()
+		msg.Payload = []interface{}{"custom"}
+		return msg
+	})
+
+	go w.Run(nil)
+
+	eHandshake := readTestMessage(t, runtime)
+	checkTypeAndSession(t, eHandshake, v1UtilitySession, v1Handshake)
+	assert.Equal(t, []byte("custom"), eHandshake.Payload[1])
+
+	// the first heartbeat is sent on start,
+	// the second one is sent on the timer tick
+	for i := 0; i < 2; i++ {
+		eHeartbeat := readTestMessage(t, runtime)
+		checkTypeAndSession(t, eHeartbeat, v1UtilitySession, v1Heartbeat)
+		assert.Equal(t, []interface{}{[]byte("custom")}, eHeartbeat.Payload)
+		runtime.Write() <- newHeartbeatV1()
+	}
+}
+
+func TestWorkerTerminateCancelsHandlers(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	handlerStarted := make(chan struct{})
+	handlerErr := make(chan error, 1)
+	w.On("wait", func(ctx context.Context, req Request, res Response) {
+		close(handlerStarted)
+		<-ctx.Done()
+		// the response has been closed by the worker,
+		// which may have been already stopped as well
+		_, err := res.Write([]byte("late"))
+		assert.Contains(t, []error{io.ErrClosedPipe, ErrWorkerClosed}, err)
+		handlerErr <- ctx.Err()
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "wait")
+	<-handlerStarted
+	runtime.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{
+			Session: v1UtilitySession,
+			MsgType: v1Terminate,
+		},
+		Payload: []interface{}{100, "TestTermination"},
+	}
+
+	select {
+	case err := <-handlerErr:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the handler has not been cancelled")
+	}
+
+	select {
+	case err := <-onStop:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the worker has not been stopped")
+	}
+}
+
+func TestWorkerRunWithoutHandlers(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	logger := new(testLogger)
+	w.SetLogger(logger)
+	runTestWorker(t, w, runtime)
+
+	entry, ok := logger.find("the worker has no handlers, so every event is rejected")
+	if assert.True(t, ok) {
+		assert.Equal(t, WarnLevel, entry.level)
+	}
+}
+
+func TestWorkerRunWithoutHandlersStrict(t *testing.T) {
+	w, _ := newTestWorker(t)
+	defer w.Stop()
+
+	w.SetStrictMode(true)
+	assert.Equal(t, ErrNoHandlers, w.Run(nil))
+
+	// an explicit fallback handler is a valid configuration
+	w2, runtime := newTestWorker(t)
+	defer w2.Stop()
+
+	w2.SetStrictMode(true)
+	w2.SetFallbackHandler(DefaultFallbackHandler)
+	runTestWorker(t, w2, runtime)
+}
+
+type testNotFound struct{ key string }
+
+func TestWorkerRecoverMapper(t *testing.T) {
+	const errorNotFound = 404
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.SetRecoverMapper(func(event string, recovered interface{}) *ErrRequest {
+		if nf, ok := recovered.(testNotFound); ok {
+			return &ErrRequest{Code: errorNotFound, Message: event + ": no " + nf.key}
+		}
+		return nil
+	})
+	w.On("get", func(ctx context.Context, req Request, res Response) {
+		panic(testNotFound{"key"})
+	})
+	w.On("crash", func(ctx context.Context, req Request, res Response) {
+		panic("crash")
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "get")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+	code, message := unpackTestError(t, msg)
+	assert.Equal(t, errorNotFound, code)
+	assert.Equal(t, "get: no key", message)
+
+	runtime.Write() <- newInvokeV1(3, "crash")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 3, v1Error)
+	code, _ = unpackTestError(t, msg)
+	assert.Equal(t, ErrorPanicInHandler, code)
+}
+
+func TestWorkerPanicHandler(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	type panicInfo struct {
+		event     string
+		recovered interface{}
+		stack     []byte
+	}
+	panics := make(chan panicInfo, 1)
+	w.SetPanicHandler(func(event string, recovered interface{}, stack []byte, res Response) {
+		panics <- panicInfo{event, recovered, stack}
+		res.ErrorMsg(ErrorPanicInHandler, "custom")
+	})
+	w.On("crash", func(ctx context.Context, req Request, res Response) {
+		panic("crash")
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "crash")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+	code, message := unpackTestError(t, msg)
+	assert.Equal(t, ErrorPanicInHandler, code)
+	assert.Equal(t, "custom", message)
+
+	info := <-panics
+	assert.Equal(t, "crash", info.event)
+	assert.Equal(t, "crash", info.recovered)
+	assert.Contains(t, string(info.stack), "TestWorkerPanicHandler")
+}
+
+func TestWorkerPanicReport(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	reports := make(chan PanicReport, 1)
+	w.SetPanicReportHandler(func(report PanicReport, res Response) {
+		reports <- report
+		res.ErrorMsg(ErrorPanicInHandler, "custom")
+	})
+	w.SetPanicRequestSnapshot(func(chunk []byte) []byte {
+		return bytes.Replace(chunk, []byte("secret"), []byte("******"), -1)
+	})
+	w.On("crash", func(ctx context.Context, req Request, res Response) {
+		req.Read(ctx)
+		req.Read(ctx)
+		panic("crash")
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "crash")
+	runtime.Write() <- newChunkV1(2, []byte("token=secret"))
+	runtime.Write() <- newChunkV1(2, []byte("second"))
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+
+	report := <-reports
+	assert.Equal(t, "crash", report.Event)
+	assert.Equal(t, uint64(2), report.Session)
+	assert.Equal(t, "crash", report.Recovered)
+	assert.Contains(t, string(report.Stack), "TestWorkerPanicReport")
+	assert.Equal(t, []byte("token=******"), report.FirstChunk)
+}
+
+func TestWorkerBackpressureReject(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	release := make(chan struct{})
+	w.SetMaxActiveHandlers(1)
+	w.On("wait", func(ctx context.Context, req Request, res Response) {
+		<-release
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "wait")
+	runtime.Write() <- newInvokeV1(3, "wait")
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 3, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorOverloaded, code)
+
+	close(release)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+}
+
+func TestWorkerBackpressureThrottle(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started = make(chan uint64, 2)
+		release = make(chan struct{})
+	)
+	w.SetMaxActiveHandlers(1)
+	w.SetBackpressureMode(ModeThrottle)
+	w.On("wait", func(ctx context.Context, req Request, res Response) {
+		data, _ := req.Read(ctx)
+		started <- uint64(data[0])
+		<-release
+	})
+	runTestWorker(t, w, runtime)
+
+	for session := uint64(2); session < 4; session++ {
+		runtime.Write() <- newInvokeV1(session, "wait")
+		runtime.Write() <- newChunkV1(session, []byte{byte(session)})
+	}
+
+	assert.Equal(t, uint64(2), <-started)
+	select {
+	case <-started:
+		t.Fatal("the second handler must be deferred under load")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the deferred handler starts when the first one finishes
+	release <- struct{}{}
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+	select {
+	case session := <-started:
+		assert.Equal(t, uint64(3), session)
+	case <-time.After(time.Second):
+		t.Fatal("the deferred handler has not been started")
+	}
+	close(release)
+}
+
+func TestWorkerRunAfterStop(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	onStop := runTestWorker(t, w, runtime)
+
+	w.Stop()
+	select {
+	case err := <-onStop:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the worker has not been stopped")
+	}
+
+	assert.Equal(t, ErrWorkerStopped, w.Run(nil))
+}
+
+// blockingMetrics blocks the loop of the worker on an anomaly
+type blockingMetrics struct {
+	NullMetrics
+	delay time.Duration
+}
+
+func (m blockingMetrics) IncProtocolAnomaly(kind string) {
+	time.Sleep(m.delay)
+}
+
+func TestWorkerReadinessNotify(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	ready := make(chan struct{})
+	w.SetReadinessNotify(func() { close(ready) })
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+
+	select {
+	case <-ready:
+		t.Fatal("the worker is not running yet")
+	default:
+	}
+
+	runTestWorker(t, w, runtime)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("the readiness has not been notified")
+	}
+
+	runtime.Write() <- newInvokeV1(10, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+}
+
+func TestWorkerLifecycleHooks(t *testing.T) {
+	w, runtime := newTestWorker(t)
+
+	var (
+		started = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	w.OnStart(func() error {
+		close(started)
+		return nil
+	})
+	w.OnStop(func() { close(stopped) })
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("OnStart has not been called")
+	}
+
+	runtime.Write() <- newInvokeV1(10, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	select {
+	case <-stopped:
+		t.Fatal("the worker is still running")
+	default:
+	}
+
+	w.Stop()
+	assert.NoError(t, <-onStop)
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("OnStop must be called before Run returns")
+	}
+}
+
+func TestWorkerOnStartError(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	errStart := errors.New("no database")
+	w.OnStart(func() error { return errStart })
+	w.OnStop(func() { t.Error("OnStop must not be called if OnStart fails") })
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+
+	onStop := make(chan error, 1)
+	go func() {
+		onStop <- w.Run(nil)
+	}()
+	// the connection is closed without waiting for a heartbeat reply
+	for range runtime.Read() {
+	}
+
+	select {
+	case err := <-onStop:
+		assert.Equal(t, errStart, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run must return the error of OnStart")
+	}
+}
+
+func TestWorkerStartupProbe(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started int32
+		probes  int32
+	)
+	release := make(chan struct{})
+	ready := make(chan int32, 1)
+	w.OnStart(func() error {
+		atomic.StoreInt32(&started, 1)
+		return nil
+	})
+	w.SetStartupProbe(func(ctx context.Context) error {
+		assert.Equal(t, int32(1), atomic.LoadInt32(&started), "the probe must run after OnStart")
+		if atomic.AddInt32(&probes, 1) < 3 {
+			return errors.New("no database")
+		}
+
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, time.Minute)
+	w.SetReadinessNotify(func() {
+		ready <- atomic.LoadInt32(&probes)
+	})
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+
+	// the handshake and heartbeats are not delayed by the probe
+	runTestWorker(t, w, runtime)
+
+	// the request waits for the probe
+	runtime.Write() <- newInvokeV1(10, "ping")
+	select {
+	case msg := <-runtime.Read():
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, int32(3), <-ready)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+}
+
+func TestWorkerStartupProbeDeadline(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	errProbe := errors.New("no database")
+	w.SetStartupProbe(func(ctx context.Context) error {
+		return errProbe
+	}, 50*time.Millisecond)
+	w.SetReadinessNotify(func() { t.Error("a broken worker must not be ready") })
+	w.On("ping", func(ctx context.Context, req Request, res Response) {
+		t.Error("a broken worker must not handle requests")
+	})
+
+	onStop := runTestWorker(t, w, runtime)
+	runtime.Write() <- newInvokeV1(10, "ping")
+
+	// the waiting request is replied before the connection is closed
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 10, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorWorkerTerminating, code)
+	for msg := range runtime.Read() {
+		t.Errorf("unexpected message %v", msg)
+	}
+
+	select {
+	case err := <-onStop:
+		if perr, ok := err.(*StartupProbeError); assert.True(t, ok, "%v", err) {
+			assert.Equal(t, errProbe, perr.Err)
+			assert.True(t, perr.Attempts > 0)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run must return StartupProbeError")
+	}
+}
+
+func TestWorkerOff(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	ping := func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	}
+	w.On("ping", ping)
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+
+	w.Off("ping")
+	runtime.Write() <- newInvokeV1(11, "ping")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 11, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorNoEventHandler, code)
+
+	// handlers can be bound while the worker is running
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w.On("toggle", ping)
+			w.Off("toggle")
+		}
+		w.On("ping", ping)
+	}()
+	for session := uint64(12); session < 22; session++ {
+		runtime.Write() <- newInvokeV1(session, "toggle")
+		msg := readTestMessage(t, runtime)
+		assert.Equal(t, session, msg.Session)
+	}
+	<-done
+
+	runtime.Write() <- newInvokeV1(22, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 22, v1Close)
+}
+
+func TestWorkerConcurrentOn(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	handler := func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	}
+
+	// handlers are bound by many goroutines before
+	// and after the worker has started
+	var wg sync.WaitGroup
+	bind := func(prefix string) {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					w.On(fmt.Sprintf("%s-%d-%d", prefix, i, j), handler)
+				}
+			}(i)
+		}
+	}
+
+	bind("before")
+	w.On("ping", handler)
+	wg.Wait()
+	runTestWorker(t, w, runtime)
+
+	bind("after")
+	for session := uint64(10); session < 20; session++ {
+		runtime.Write() <- newInvokeV1(session, "ping")
+		checkTypeAndSession(t, readTestMessage(t, runtime), session, v1Close)
+	}
+	wg.Wait()
+
+	runtime.Write() <- newInvokeV1(20, "after-3-49")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 20, v1Close)
+}
+
+func TestWorkerDedicatedHeartbeat(t *testing.T) {
+	const (
+		heartbeatTimeout = 20 * time.Millisecond
+		loopBlocked      = 300 * time.Millisecond
+	)
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.impl.heartbeatTimeout = heartbeatTimeout
+	w.SetDedicatedHeartbeat(true)
+	w.SetMetrics(blockingMetrics{delay: loopBlocked})
+	runTestWorker(t, w, runtime)
+
+	// a choke for an unknown session makes the loop busy
+	runtime.Write() <- newChokeV1(100)
+
+	var (
+		heartbeats int
+		last       = time.Now()
+		deadline   = time.After(loopBlocked)
+	)
+	for {
+		select {
+		case msg := <-runtime.Read():
+			checkTypeAndSession(t, msg, v1UtilitySession, v1Heartbeat)
+			assert.True(t, time.Since(last) < 5*heartbeatTimeout, "heartbeats must be regular")
+			last = time.Now()
+			heartbeats++
+		case <-deadline:
+			assert.True(t, heartbeats >= 5, "too few heartbeats: %d", heartbeats)
+			return
+		}
+	}
+}
+
+func TestWorkerProgress(t *testing.T) {
+	const testSession = 10
+
+	for _, frames := range []bool{false, true} {
+		w, runtime := newTestWorker(t)
+
+		w.SetProgressFrames(frames)
+		w.On("job", func(ctx context.Context, req Request, res Response) {
+			defer res.Close()
+			res.SetProgress(50)
+			res.Write([]byte("half"))
+			assert.Equal(t, ErrInvalidProgress, res.SetProgress(101))
+			res.SetProgress(100)
+			res.Write([]byte("done"))
+		})
+		runTestWorker(t, w, runtime)
+
+		runtime.Write() <- newInvokeV1(testSession, "job")
+
+		var (
+			progress []float64
+			headers  []float64
+			data     []string
+		)
+	read:
+		for {
+			msg := readTestMessage(t, runtime)
+			assert.Equal(t, uint64(testSession), msg.Session)
+			if pct, ok := msg.Headers.Progress(); ok {
+				headers = append(headers, pct)
+			}
+
+			switch msg.MsgType {
+			case v1Progress:
+				progress = append(progress, msg.Payload[0].(float64))
+			case v1Write:
+				data = append(data, string(msg.Payload[0].([]byte)))
+			case v1Close:
+				break read
+			default:
+				t.Fatalf("unexpected message %v", msg)
+			}
+		}
+
+		assert.Equal(t, []string{"half", "done"}, data)
+		if frames {
+			assert.Equal(t, []float64{50, 100}, progress)
+			assert.Empty(t, headers)
+		} else {
+			// a stock cocaine-runtime gets known frames only
+			assert.Empty(t, progress)
+			assert.Equal(t, []float64{50, 100}, headers)
+		}
+		w.Stop()
+	}
+}
+
+func TestWorkerAutoClose(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.On("forget", func(ctx context.Context, req Request, res Response) {
+		res.Write([]byte("data"))
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "forget")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Write)
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Close)
+}
+
+func TestWorkerAutoCloseDisabled(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	responses := make(chan Response, 1)
+	w.SetAutoClose(false)
+	w.On("background", func(ctx context.Context, req Request, res Response) {
+		responses <- res
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "background")
+	res := <-responses
+
+	select {
+	case msg := <-runtime.Read():
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err := res.Write([]byte("late"))
+	assert.NoError(t, err)
+	assert.NoError(t, res.Close())
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Write)
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Close)
+}
+
+func TestWorkerKeepOpenAfterReturn(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	responses := make(chan Response, 1)
+	w.OnWithOptions("stream", func(ctx context.Context, req Request, res Response) {
+		responses <- res
+	}, HandlerOptions{KeepOpenAfterReturn: true})
+	w.On("forget", func(ctx context.Context, req Request, res Response) {})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "stream")
+	res := <-responses
+
+	// other events are closed automatically
+	runtime.Write() <- newInvokeV1(testSession+1, "forget")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+1, v1Close)
+
+	select {
+	case msg := <-runtime.Read():
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err := res.Write([]byte("late"))
+	assert.NoError(t, err)
+	assert.NoError(t, res.Close())
+
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Write)
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Close)
+}
+
+func TestWorkerWriteAfterDisown(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+	w.impl.heartbeatTimeout = 20 * time.Millisecond
+	w.impl.disownTimeout = 10 * time.Millisecond
+
+	responses := make(chan Response, 1)
+	w.SetAutoClose(false)
+	w.On("background", func(ctx context.Context, req Request, res Response) {
+		responses <- res
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "background")
+	res := <-responses
+
+	// heartbeats are not answered anymore
+	select {
+	case err := <-onStop:
+		assert.Equal(t, ErrDisowned, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the worker must be disowned")
+	}
+
+	_, err := res.Write([]byte("late"))
+	assert.Equal(t, ErrWorkerClosed, err)
+	assert.Equal(t, ErrWorkerClosed, res.SetProgress(50))
+	assert.Equal(t, ErrWorkerClosed, res.ErrorMsg(100, "late"))
+	assert.Equal(t, ErrWorkerClosed, res.Close())
+}
+
+func TestWorkerResponseDeadline(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	cancelled := make(chan struct{})
+	w.SetResponseDeadline(50 * time.Millisecond)
+	w.On("stream", func(ctx context.Context, req Request, res Response) {
+		defer close(cancelled)
+		for {
+			if _, err := res.Write([]byte("chunk")); err != nil {
+				<-ctx.Done()
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "stream")
+	for {
+		msg := readTestMessage(t, runtime)
+		assert.Equal(t, uint64(testSession), msg.Session)
+		if msg.MsgType == v1Write {
+			continue
+		}
+
+		checkTypeAndSession(t, msg, testSession, v1Error)
+		code, _ := unpackTestError(t, msg)
+		assert.Equal(t, ErrorResponseDeadline, code)
+		break
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the handler must be cancelled")
+	}
+}
+
+func TestWorkerLoggingFallbackHandler(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	logger := new(testLogger)
+	w.SetFallbackHandler(LoggingFallbackHandler(logger))
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "unknown")
+	runtime.Write() <- newChunkV1(testSession, []byte("Hello, "))
+	runtime.Write() <- newChunkV1(testSession, []byte("world"))
+	runtime.Write() <- newChokeV1(testSession)
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorNoEventHandler, code)
+
+	entry, ok := logger.find("request to an unhandled event")
+	if assert.True(t, ok, "the request must be logged") {
+		assert.Equal(t, "unknown", entry.fields["event"])
+		assert.Equal(t, 2, entry.fields["chunks"])
+		assert.Equal(t, 12, entry.fields["size"])
+		// sha1("Hello, world")
+		assert.Equal(t, "e02aa1b106d5c7c6a98def2b13005d5b84fd8dc8", entry.fields["sha1"])
+		assert.NotContains(t, entry.fields, "error")
+	}
+}
+
+func TestWorkerEventConcurrency(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started = make(chan uint64, 3)
+		release = make(chan struct{})
+	)
+	w.SetEventConcurrency("report", 2)
+	w.SetBackpressureMode(ModeThrottle)
+	w.On("report", func(ctx context.Context, req Request, res Response) {
+		data, _ := req.Read(ctx)
+		started <- uint64(data[0])
+		<-release
+	})
+	w.On("light", func(ctx context.Context, req Request, res Response) {})
+	runTestWorker(t, w, runtime)
+
+	for session := uint64(2); session < 5; session++ {
+		runtime.Write() <- newInvokeV1(session, "report")
+		runtime.Write() <- newChunkV1(session, []byte{byte(session)})
+	}
+
+	// both handlers run concurrently, so the order is not defined
+	assert.Equal(t, uint64(5), <-started+<-started)
+
+	// other events are not affected by the limit
+	runtime.Write() <- newInvokeV1(5, "light")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 5, v1Close)
+
+	select {
+	case <-started:
+		t.Fatal("the third report must be deferred")
+	default:
+	}
+
+	release <- struct{}{}
+	select {
+	case session := <-started:
+		assert.Equal(t, uint64(4), session)
+	case <-time.After(time.Second):
+		t.Fatal("the deferred report has not been started")
+	}
+	close(release)
+}
+
+func TestWorkerEventConcurrencyReject(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	release := make(chan struct{})
+	w.SetEventConcurrency("report", 1)
+	w.On("report", func(ctx context.Context, req Request, res Response) {
+		<-release
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "report")
+	runtime.Write() <- newInvokeV1(3, "report")
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 3, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorOverloaded, code)
+
+	close(release)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+}
+
+func TestWorkerOnWithConcurrency(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	w.OnWithConcurrency("report", func(ctx context.Context, req Request, res Response) {
+		started <- struct{}{}
+		<-release
+	}, 1)
+	w.On("ping", func(ctx context.Context, req Request, res Response) {})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(2, "report")
+	<-started
+	runtime.Write() <- newInvokeV1(3, "report")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 3, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorOverloaded, code)
+
+	// cheap events stay responsive
+	runtime.Write() <- newInvokeV1(4, "ping")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 4, v1Close)
+
+	close(release)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+}
+
+func TestWorkerTerminateGrace(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		handlerStarted = make(chan struct{})
+		release        = make(chan struct{})
+		handlerErr     = make(chan error, 2)
+		deadline       = make(chan time.Time, 1)
+	)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		close(handlerStarted)
+		<-release
+		_, err := res.Write([]byte("done"))
+		handlerErr <- err
+		handlerErr <- ctx.Err()
+	})
+	w.SetTerminationHandler(func(ctx context.Context) {
+		d, _ := ctx.Deadline()
+		deadline <- d
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "slow")
+	<-handlerStarted
+
+	terminateSent := time.Now()
+	runtime.Write() <- &Message{
+		CommonMessageInfo: CommonMessageInfo{
+			Session: v1UtilitySession,
+			MsgType: v1Terminate,
+		},
+		Payload: []interface{}{100, "TestTermination", 10},
+	}
+
+	// new invokes are rejected during the grace period
+	runtime.Write() <- newInvokeV1(testSession+1, "slow")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+1, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorWorkerTerminating, code)
+
+	select {
+	case <-onStop:
+		t.Fatal("the worker must wait for the active handler")
+	default:
+	}
+
+	// the active handler is allowed to finish
+	close(release)
+	assert.NoError(t, <-handlerErr)
+	assert.NoError(t, <-handlerErr)
+
+	select {
+	case err := <-onStop:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("the worker has not been stopped")
+	}
+
+	// the termination handler has the rest of the grace period
+	d := <-deadline
+	assert.WithinDuration(t, terminateSent.Add(10*time.Second), d, time.Second)
+}
+
+func TestWorkerVersion(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		logger  = new(testLogger)
+		entries = make(chan AccessLogEntry, 1)
+	)
+	w.SetVersion("1.2.3")
+	w.SetLogger(logger)
+	w.SetAccessLogger(func(entry AccessLogEntry) {
+		entries <- entry
+	})
+	assert.Equal(t, "1.2.3", w.Version())
+	runTestWorker(t, w, runtime)
+
+	entry, ok := logger.find("the worker has no handlers, so every event is rejected")
+	if assert.True(t, ok) {
+		assert.Equal(t, "1.2.3", entry.fields["version"])
+	}
+
+	runtime.Write() <- newInvokeV1(10, "unknown")
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Error)
+	select {
+	case entry := <-entries:
+		assert.Equal(t, "1.2.3", entry.Version)
+	case <-time.After(time.Second):
+		t.Fatal("the session has not been logged")
+	}
+}
+
+func TestWorkerRequestIdleTimeout(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	readErr := make(chan error, 1)
+	w.SetRequestIdleTimeout(50 * time.Millisecond)
+	w.On("upload", func(ctx context.Context, req Request, res Response) {
+		for {
+			if _, err := req.Read(ctx); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "upload")
+	// chunks keep the session alive
+	for i := 0; i < 3; i++ {
+		runtime.Write() <- newChunkV1(testSession, []byte("chunk"))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the client stalls without a choke
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorRequestIdleTimeout, code)
+
+	select {
+	case err := <-readErr:
+		if perr, ok := err.(*ErrRequest); assert.True(t, ok, "unexpected error %v", err) {
+			assert.Equal(t, ErrorRequestIdleTimeout, perr.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read has not returned")
+	}
+}
+
+func TestWorkerReplayResponse(t *testing.T) {
+	const (
+		testSession   = 10
+		replaySession = 20
+	)
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	w.On("test", func(ctx context.Context, req Request, res Response) {
+		res.Write([]byte("first"))
+		res.Write([]byte("second"))
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "test")
+	var frames []*Message
+	for len(frames) < 3 {
+		msg := readTestMessage(t, runtime)
+		assert.Equal(t, uint64(testSession), msg.Session)
+		frames = append(frames, msg)
+	}
+
+	assert.NoError(t, w.ReplayResponse(replaySession, frames))
+	for _, frame := range frames {
+		msg := readTestMessage(t, runtime)
+		checkTypeAndSession(t, msg, replaySession, frame.MsgType)
+		assert.Equal(t, frame.Payload, msg.Payload)
+		// recorded frames are not modified
+		assert.Equal(t, uint64(testSession), frame.Session)
+	}
+
+	w.Stop()
+	assert.Equal(t, ErrWorkerClosed, w.ReplayResponse(replaySession, frames))
+}
+
+func TestWorkerStopWhileWriting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w, runtime := newTestWorker(t)
+
+		var (
+			writing     = make(chan struct{})
+			handlerDone = make(chan error, 1)
+		)
+		w.On("flood", func(ctx context.Context, req Request, res Response) {
+			close(writing)
+			for {
+				if _, err := res.Write([]byte("chunk")); err != nil {
+					handlerDone <- err
+					return
+				}
+			}
+		})
+		onStop := runTestWorker(t, w, runtime)
+
+		runtime.Write() <- newInvokeV1(2, "flood")
+		<-writing
+
+		// the loop stops the worker on terminate
+		// concurrently with users
+		runtime.Write() <- &Message{
+			CommonMessageInfo: CommonMessageInfo{
+				Session: v1UtilitySession,
+				MsgType: v1Terminate,
+			},
+			Payload: []interface{}{100, "TestStopWhileWriting"},
+		}
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.Stop()
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-onStop:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Run has not returned after Stop")
+		}
+
+		select {
+		case err := <-handlerDone:
+			assert.Error(t, err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("the handler keeps writing after Stop")
+		}
+		runtime.Close()
+		runtime.Close()
+	}
+}
+
+func TestWorkerUpdateTimeouts(t *testing.T) {
+	const heartbeatTimeout = 20 * time.Millisecond
+
+	for _, dedicated := range []bool{false, true} {
+		w, runtime := newTestWorker(t)
+
+		w.impl.heartbeatTimeout = time.Hour
+		w.SetDedicatedHeartbeat(dedicated)
+		assert.Equal(t, ErrInvalidTimeouts, w.UpdateTimeouts(TimeoutConfig{}))
+		// nothing would apply the values
+		assert.Equal(t, ErrWorkerNotRunning, w.UpdateTimeouts(TimeoutConfig{
+			Heartbeat: heartbeatTimeout,
+			Disown:    time.Second,
+		}))
+		onStop := runTestWorker(t, w, runtime)
+
+		err := w.UpdateTimeouts(TimeoutConfig{
+			Heartbeat: heartbeatTimeout,
+			Disown:    time.Second,
+		})
+		assert.NoError(t, err)
+
+		// heartbeats follow the new interval
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+			runtime.Write() <- newHeartbeatV1()
+		}
+		assert.True(t, time.Since(start) < time.Second, "heartbeats are too rare")
+
+		w.Stop()
+		<-onStop
+		assert.Equal(t, ErrWorkerStopped, w.UpdateTimeouts(TimeoutConfig{
+			Heartbeat: heartbeatTimeout,
+			Disown:    time.Second,
+		}))
+	}
+}
+
+func TestWorkerUpdateTimeoutsDisableRequestIdle(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	chunks := make(chan struct{}, 2)
+	w.SetRequestIdleTimeout(50 * time.Millisecond)
+	w.On("upload", func(ctx context.Context, req Request, res Response) {
+		for {
+			if _, err := req.Read(ctx); err != nil {
+				break
+			}
+			chunks <- struct{}{}
+		}
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	// the session has been started with the idle timer
+	runtime.Write() <- newInvokeV1(testSession, "upload")
+	runtime.Write() <- newChunkV1(testSession, []byte("chunk"))
+	<-chunks
+	err := w.UpdateTimeouts(TimeoutConfig{
+		Heartbeat: time.Hour,
+		Disown:    time.Hour,
+	})
+	assert.NoError(t, err)
+
+	// neither the running timer nor a chunk terminate the session
+	runtime.Write() <- newChunkV1(testSession, []byte("chunk"))
+	time.Sleep(100 * time.Millisecond)
+	runtime.Write() <- newChokeV1(testSession)
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession, v1Close)
+}
+
+func TestWorkerOnWithTimeout(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	cancelled := make(chan error, 1)
+	// the timeout of the event overrides the response deadline
+	w.SetResponseDeadline(time.Hour)
+	w.OnWithTimeout("slow", func(ctx context.Context, req Request, res Response) {
+		<-ctx.Done()
+		cancelled <- res.Close()
+	}, 50*time.Millisecond)
+	w.On("fast", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "slow")
+	runtime.Write() <- newInvokeV1(testSession+1, "fast")
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession+1, v1Close)
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorHandlerTimeout, code)
+
+	select {
+	case err := <-cancelled:
+		// the response has been closed by the worker
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the handler must be cancelled")
+	}
+}
+
+func TestWorkerShutdown(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		close(started)
+		<-release
+		res.Write([]byte("done"))
+		res.Close()
+	})
+	w.On("fast", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "slow")
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- w.Shutdown(ctx)
+	}()
+
+	// new invokes are rejected, while the active handler is running.
+	// Invokes are served until the loop receives the shutdown request
+	for session := uint64(testSession + 1); ; session++ {
+		runtime.Write() <- newInvokeV1(session, "fast")
+		msg := readTestMessage(t, runtime)
+		if msg.MsgType == v1Close {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		checkTypeAndSession(t, msg, session, v1Error)
+		code, _ := unpackTestError(t, msg)
+		assert.Equal(t, ErrorWorkerTerminating, code)
+		break
+	}
+
+	close(release)
+	// replies are flushed before the connection is closed
+	chunk := readTestMessage(t, runtime)
+	checkTypeAndSession(t, chunk, testSession, v1Write)
+	assert.Equal(t, []byte("done"), chunk.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession, v1Close)
+
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown has not returned")
+	}
+	assert.NoError(t, <-onStop)
+	assert.Equal(t, ErrWorkerStopped, w.Shutdown(context.Background()))
+}
+
+func TestWorkerShutdownTimeout(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+
+	var (
+		started   = make(chan struct{})
+		cancelled = make(chan struct{})
+	)
+	w.On("stuck", func(ctx context.Context, req Request, res Response) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+	onStop := runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "stuck")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, w.Shutdown(ctx))
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorWorkerTerminating, code)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the handler must be cancelled")
+	}
+	assert.NoError(t, <-onStop)
+}
+
+func TestWorkerMigrate(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		close(started)
+		<-release
+		data, err := req.Read(ctx)
+		assert.NoError(t, err)
+		res.Write(data)
+		res.Close()
+	})
+	w.On("fast", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(testSession, "slow")
+	<-started
+
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	newRuntime, _ := newAsyncRW(in)
+	defer newRuntime.Close()
+
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- w.impl.migrate(sock)
+	}()
+
+	checkTypeAndSession(t, readTestMessage(t, newRuntime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, newRuntime), v1UtilitySession, v1Heartbeat)
+	newRuntime.Write() <- newHeartbeatV1()
+	// the same session id on the new connection is deferred
+	newRuntime.Write() <- newInvokeV1(testSession, "fast")
+
+	// new invokes are rejected on the old connection
+	runtime.Write() <- newInvokeV1(testSession+1, "fast")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+1, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorWorkerTerminating, code)
+
+	// the active session is drained on the old connection
+	runtime.Write() <- newChunkV1(testSession, []byte("tail"))
+	runtime.Write() <- newChokeV1(testSession)
+	close(release)
+
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Write)
+	assert.Equal(t, []byte("tail"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession, v1Close)
+
+	select {
+	case err := <-migrated:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the migration has not finished")
+	}
+
+	// the old connection is closed
+	select {
+	case _, ok := <-runtime.Read():
+		assert.False(t, ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the old connection has not been closed")
+	}
+
+	checkTypeAndSession(t, readTestMessage(t, newRuntime), testSession, v1Close)
+	newRuntime.Write() <- newInvokeV1(testSession+1, "fast")
+	checkTypeAndSession(t, readTestMessage(t, newRuntime), testSession+1, v1Close)
+}
+
+func TestWorkerMaxConcurrentSessions(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	w.SetMaxConcurrentSessions(1)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		close(started)
+		<-release
+		res.Close()
+	})
+	w.On("fast", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+	assert.Equal(t, 0, w.ActiveSessions())
+
+	runtime.Write() <- newInvokeV1(testSession, "slow")
+	<-started
+	assert.Equal(t, 1, w.ActiveSessions())
+
+	runtime.Write() <- newInvokeV1(testSession+1, "fast")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+1, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorOverloaded, code)
+
+	// the session is active until the client closes it
+	close(release)
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession, v1Close)
+	runtime.Write() <- newChokeV1(testSession)
+
+	runtime.Write() <- newInvokeV1(testSession+2, "fast")
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession+2, v1Close)
+	assert.Equal(t, 1, w.ActiveSessions())
+}
+
+func TestWorkerOverloadRetryAfter(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	release := make(chan struct{})
+	w.SetMaxConcurrentSessions(1)
+	w.SetOverloadRetryAfter(1500 * time.Millisecond)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		<-release
+		res.Close()
+	})
+	w.On("busy", func(ctx context.Context, req Request, res Response) {
+		res.RetryableError(ErrorOverloaded, "busy", 5*time.Second)
+	})
+	runTestWorker(t, w, runtime)
+
+	runtime.Write() <- newInvokeV1(10, "slow")
+	runtime.Write() <- newInvokeV1(11, "slow")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 11, v1Error)
+	// the hint is a header, so the error frame is valid without it
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorOverloaded, code)
+	retryAfter, ok := msg.Headers.RetryAfter()
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, retryAfter, "the hint is rounded up to seconds")
+
+	close(release)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 10, v1Close)
+	runtime.Write() <- newChokeV1(10)
+
+	runtime.Write() <- newInvokeV1(12, "busy")
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 12, v1Error)
+	retryAfter, ok = msg.Headers.RetryAfter()
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, retryAfter)
+}
+
+func TestWorkerEventMaxPayload(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	echo := func(ctx context.Context, req Request, res Response) {
+		data, err := req.ReadAll(ctx)
+		if err != nil {
+			return
+		}
+		res.Write(data)
+	}
+	writeErrors := make(chan error, 1)
+	w.SetMaxPayload(8)
+	w.SetEventMaxPayload("control", 4)
+	w.On("control", echo)
+	w.On("upload", echo)
+	w.On("download", func(ctx context.Context, req Request, res Response) {
+		_, err := res.Write([]byte("123456789"))
+		writeErrors <- err
+		res.Write([]byte("12345678"))
+	})
+	runTestWorker(t, w, runtime)
+
+	// the limit of the event
+	runtime.Write() <- newInvokeV1(testSession, "control")
+	runtime.Write() <- newChunkV1(testSession, []byte("12345"))
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorPayloadTooLarge, code)
+
+	// the global limit is used for other events
+	runtime.Write() <- newInvokeV1(testSession+1, "upload")
+	runtime.Write() <- newChunkV1(testSession+1, []byte("12345"))
+	runtime.Write() <- newChokeV1(testSession + 1)
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+1, v1Write)
+	assert.Equal(t, []byte("12345"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession+1, v1Close)
+
+	runtime.Write() <- newInvokeV1(testSession+2, "upload")
+	runtime.Write() <- newChunkV1(testSession+2, []byte("12345"))
+	runtime.Write() <- newChunkV1(testSession+2, []byte("6789"))
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+2, v1Error)
+	code, _ = unpackTestError(t, msg)
+	assert.Equal(t, ErrorPayloadTooLarge, code)
+
+	// replies are limited too
+	runtime.Write() <- newInvokeV1(testSession+3, "download")
+	assert.Equal(t, ErrPayloadTooLarge, <-writeErrors)
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, testSession+3, v1Write)
+	assert.Equal(t, []byte("12345678"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession+3, v1Close)
+}
+
+func TestWorkerCancelAllSessions(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var (
+		started   = make(chan struct{}, 2)
+		cancelled = make(chan error, 2)
+	)
+	w.On("slow", func(ctx context.Context, req Request, res Response) {
+		data, err := req.Read(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Write(append(data, "pong"...))
+		started <- struct{}{}
+
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+	})
+	w.On("fast", func(ctx context.Context, req Request, res Response) {
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+	assert.Empty(t, w.Sessions())
+
+	for i := uint64(0); i < 2; i++ {
+		runtime.Write() <- newInvokeV1(testSession+i, "slow")
+		runtime.Write() <- newChunkV1(testSession+i, []byte("ping"))
+		<-started
+		checkTypeAndSession(t, readTestMessage(t, runtime), testSession+i, v1Write)
+	}
+
+	sessions := w.Sessions()
+	if !assert.Len(t, sessions, 2) {
+		t.FailNow()
+	}
+	for i, session := range sessions {
+		assert.Equal(t, testSession+uint64(i), session.ID)
+		assert.Equal(t, "slow", session.Event)
+		assert.True(t, session.Age > 0)
+		assert.Equal(t, int64(len("ping")), session.BytesIn)
+		assert.Equal(t, int64(len("pingpong")), session.BytesOut)
+	}
+
+	cancelledSessions := w.CancelAllSessions()
+	if assert.Len(t, cancelledSessions, 2) {
+		assert.Equal(t, sessions[0].ID, cancelledSessions[0].ID)
+		assert.Equal(t, sessions[1].ID, cancelledSessions[1].ID)
+	}
+	for i := 0; i < 2; i++ {
+		msg := readTestMessage(t, runtime)
+		assert.EqualValues(t, v1Error, msg.MsgType)
+		code, _ := unpackTestError(t, msg)
+		assert.Equal(t, ErrorSessionCancelled, code)
+
+		select {
+		case err := <-cancelled:
+			assert.Equal(t, context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Fatal("the handler has not been cancelled")
+		}
+	}
+	assert.Empty(t, w.Sessions())
+	assert.Equal(t, 0, w.ActiveSessions())
+
+	// the worker keeps serving new invokes
+	runtime.Write() <- newInvokeV1(testSession+2, "fast")
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession+2, v1Close)
+}
+
+func TestWorkerChunkReassembly(t *testing.T) {
+	const testSession = 10
+
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	reads := make(chan string, 4)
+	w.SetChunkReassembly(true)
+	w.On("join", func(ctx context.Context, req Request, res Response) {
+		defer res.Close()
+		for {
+			data, err := req.Read(ctx)
+			if err != nil {
+				close(reads)
+				return
+			}
+			reads <- string(data)
+		}
+	})
+	runTestWorker(t, w, runtime)
+
+	newPart := func(data string) *Message {
+		msg := newChunkV1(testSession, []byte(data))
+		msg.Headers = CocaineHeaders{
+			[]interface{}{false, ChunkContinuedHeader, "true"},
+		}
+		return msg
+	}
+
+	runtime.Write() <- newInvokeV1(testSession, "join")
+	runtime.Write() <- newPart("hello, ")
+	runtime.Write() <- newPart("")
+	runtime.Write() <- newChunkV1(testSession, []byte("world"))
+	runtime.Write() <- newChunkV1(testSession, []byte("single"))
+	// the choke delivers the unfinished message
+	runtime.Write() <- newPart("ta")
+	runtime.Write() <- newPart("il")
+	runtime.Write() <- newChokeV1(testSession)
+
+	var got []string
+	for data := range reads {
+		got = append(got, data)
+	}
+	assert.Equal(t, []string{"hello, world", "single", "tail"}, got)
+	checkTypeAndSession(t, readTestMessage(t, runtime), testSession, v1Close)
+}
+
+func TestWorkerRequestIDEcho(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	ids := make(chan string, 2)
+	w.SetRequestIDEcho(true)
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		ids <- GetRequestID(ctx)
+		res.Write([]byte("first"))
+		res.Write([]byte("second"))
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+
+	// the id is generated if a client has sent none
+	runtime.Write() <- newInvokeV1(2, "echo")
+	generated := <-ids
+	assert.NotEmpty(t, generated)
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Write)
+	id, ok := msg.Headers.RequestID()
+	assert.True(t, ok)
+	assert.Equal(t, generated, id)
+
+	// only the first frame carries the id
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Write)
+	_, ok = msg.Headers.RequestID()
+	assert.False(t, ok)
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+
+	// the id of a client is echoed back
+	invoke := newInvokeV1(3, "echo")
+	invoke.Headers = requestIDHeaders("client-id")
+	runtime.Write() <- invoke
+	assert.Equal(t, "client-id", <-ids)
+
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 3, v1Write)
+	id, _ = msg.Headers.RequestID()
+	assert.Equal(t, "client-id", id)
+}
+
+func TestRequestID(t *testing.T) {
+	client := newRequestID(requestIDHeaders("client-id"))
+	assert.Equal(t, "client-id", client.String())
+
+	first, second := newRequestID(nil), newRequestID(nil)
+	assert.Len(t, first.String(), 16)
+	assert.Equal(t, first.String(), first.String(), "the id must be generated once")
+	assert.NotEqual(t, first.String(), second.String())
+
+	ctx := attachRequestID(context.Background(), first)
+	assert.Equal(t, first.String(), GetRequestID(ctx))
+	ctx = context.WithValue(context.Background(), RequestIDValue, "custom")
+	assert.Equal(t, "custom", GetRequestID(ctx))
+}
+
+func TestWorkerNoHeartbeatAfterStop(t *testing.T) {
+	w, runtime := newTestWorker(t)
+	defer w.Stop()
+
+	var heartbeats int32
+	w.SetHeartbeatBuilder(func() *Message {
+		atomic.AddInt32(&heartbeats, 1)
+		return newHeartbeatV1()
+	})
+	w.impl.heartbeatTimeout = time.Hour
+	onStop := runTestWorker(t, w, runtime)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&heartbeats))
+
+	w.Stop()
+	<-onStop
+	assert.False(t, w.impl.heartbeatTimer.Stop(), "the heartbeat timer must be stopped")
+	assert.False(t, w.impl.disownTimer.Stop(), "the disown timer must be stopped")
+
+	// a tick which has fired along with Stop
+	w.impl.onHeartbeatTimeout()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&heartbeats), "no heartbeat must be attempted after Stop")
+	assert.False(t, w.impl.heartbeatTimer.Stop(), "the heartbeat timer must not be reset")
+}
+
+// duplicateInvokes delivers every invoke twice like a buggy runtime
+type duplicateInvokes struct {
+	*v1Protocol
+}
+
+func (d duplicateInvokes) onMessage(p protocolHandler, msg *Message) error {
+	isInvoke := msg.Session != v1UtilitySession && msg.Session > d.maxSession
+	if err := d.v1Protocol.onMessage(p, msg); err != nil || !isInvoke {
+		return err
+	}
+	return p.onInvoke(msg)
+}
+
+func newDuplicateTestWorker(t *testing.T, policy DuplicateSessionPolicy) (*Worker, *asyncRWSocket, *testMetrics, chan struct{}) {
+	w, runtime := newTestWorker(t)
+
+	metrics := new(testMetrics)
+	finished := make(chan struct{}, 2)
+	w.SetMetrics(metrics)
+	w.SetDuplicateSessionPolicy(policy)
+	w.On("echo", func(ctx context.Context, req Request, res Response) {
+		defer func() { finished <- struct{}{} }()
+		data, err := req.Read(ctx)
+		if err != nil {
+			return
+		}
+		res.Write(data)
+		res.Close()
+	})
+	w.impl.dispatcher = duplicateInvokes{newV1Protocol().(*v1Protocol)}
+	runTestWorker(t, w, runtime)
+	return w, runtime, metrics, finished
+}
+
+func waitHandlers(t *testing.T, finished <-chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d handlers have not finished", n-i, n)
+		}
+	}
+
+	select {
+	case <-finished:
+		t.Fatal("too many handlers have been started")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorkerDuplicateSessionReject(t *testing.T) {
+	w, runtime, metrics, finished := newDuplicateTestWorker(t, DuplicateReject)
+	defer w.Stop()
+
+	runtime.Write() <- newInvokeV1(2, "echo")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorDuplicateSession, code)
+
+	// the active session keeps running
+	runtime.Write() <- newChunkV1(2, []byte("hello"))
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Write)
+	assert.Equal(t, []byte("hello"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+
+	waitHandlers(t, finished, 1)
+	assert.Equal(t, []string{AnomalyDuplicateSession}, metrics.Anomalies())
+}
+
+func TestWorkerDuplicateSessionReplace(t *testing.T) {
+	w, runtime, metrics, finished := newDuplicateTestWorker(t, DuplicateReplace)
+	defer w.Stop()
+
+	runtime.Write() <- newInvokeV1(2, "echo")
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Error)
+	code, _ := unpackTestError(t, msg)
+	assert.Equal(t, ErrorDuplicateSession, code)
+
+	// the new session gets chunks of the id
+	runtime.Write() <- newChunkV1(2, []byte("hello"))
+	msg = readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Write)
+	assert.Equal(t, []byte("hello"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+
+	// the replaced handler has returned as well
+	waitHandlers(t, finished, 2)
+	assert.Equal(t, []string{AnomalyDuplicateSession}, metrics.Anomalies())
+	assert.Equal(t, 1, w.ActiveSessions())
+}
+
+func TestWorkerChunkAfterChoke(t *testing.T) {
+	w, runtime := newTestWorker(t)
+
+	metrics := new(testMetrics)
+	finished := make(chan struct{}, 2)
+	release := make(chan struct{})
+	w.SetMetrics(metrics)
+	w.On("hold", func(ctx context.Context, req Request, res Response) {
+		defer func() { finished <- struct{}{} }()
+		data, err := req.Read(ctx)
+		if err != nil {
+			return
+		}
+		<-release
+		res.Write(data)
+		res.Close()
+	})
+	runTestWorker(t, w, runtime)
+	defer w.Stop()
+
+	runtime.Write() <- newInvokeV1(2, "hold")
+	runtime.Write() <- newChunkV1(2, []byte("hello"))
+	runtime.Write() <- newChokeV1(2)
+	// the handler is still responding, but the chunk is dropped
+	runtime.Write() <- newChunkV1(2, []byte("late"))
+	close(release)
+
+	msg := readTestMessage(t, runtime)
+	checkTypeAndSession(t, msg, 2, v1Write)
+	assert.Equal(t, []byte("hello"), msg.Payload[0])
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+
+	waitHandlers(t, finished, 1)
+	assert.Empty(t, metrics.Anomalies())
+}
+
+// gatedConn blocks reads until open is closed
+type gatedConn struct {
+	io.ReadWriteCloser
+	open chan struct{}
+}
+
+func (c *gatedConn) Read(b []byte) (int, error) {
+	<-c.open
+	return c.ReadWriteCloser.Read(b)
+}
+
+func TestWorkerFlowControl(t *testing.T) {
+	const (
+		chunkSize = 1024
+		window    = 4 * chunkSize
+		chunks    = 64
+	)
+
+	in, out := testConn()
+	sock, _ := newAsyncRW(out)
+	gate := &gatedConn{in, make(chan struct{})}
+	runtime, _ := newAsyncRW(gate)
+	w, err := newWorker(sock, "uuid", 1, true)
+	if err != nil {
+		t.Fatal("unable to create worker", err)
+	}
+	defer w.Stop()
+
+	var written int32
+	done := make(chan struct{})
+	w.SetFlowControlWindow(window)
+	w.On("download", func(ctx context.Context, req Request, res Response) {
+		defer close(done)
+		for i := 0; i < chunks; i++ {
+			if _, err := res.Write(make([]byte, chunkSize)); err != nil {
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+		res.Close()
+	})
+	go w.Run(nil)
+	runtime.Write() <- newInvokeV1(2, "download")
+
+	// the runtime reads nothing, so writes block once the window is full
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(window/chunkSize), atomic.LoadInt32(&written))
+
+	close(gate.open)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Handshake)
+	checkTypeAndSession(t, readTestMessage(t, runtime), v1UtilitySession, v1Heartbeat)
+	for i := 0; i < chunks; i++ {
+		checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Write)
+	}
+	checkTypeAndSession(t, readTestMessage(t, runtime), 2, v1Close)
+	<-done
+}
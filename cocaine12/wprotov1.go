@@ -11,6 +11,10 @@ const (
 	v1Write     = 0
 	v1Error     = 1
 	v1Close     = 2
+	// v1Progress reports the progress of a session out of the data stream.
+	// It is an extension of the protocol, which is unknown
+	// to a stock cocaine-runtime, see Worker.SetProgressFrames
+	v1Progress  = 3
 	v1Terminate = 1
 
 	v1UtilitySession = 1
@@ -92,6 +96,29 @@ func (v *v1Protocol) newError(session uint64, category, code int, message string
 	return newErrorV1(session, category, code, message)
 }
 
+func (v *v1Protocol) newProgress(session uint64, pct float64) *Message {
+	return newProgressV1(session, pct)
+}
+
+// NewInvokeMessage builds a frame which opens the session
+// calling the event of an application. args are appended
+// to the payload after the event.
+func NewInvokeMessage(session uint64, event string, args ...interface{}) *Message {
+	msg := newInvokeV1(session, event)
+	msg.Payload = append(msg.Payload, args...)
+	return msg
+}
+
+// NewChunkMessage builds a frame which sends data to the session
+func NewChunkMessage(session uint64, data []byte) *Message {
+	return newChunkV1(session, data)
+}
+
+// NewChokeMessage builds a frame which closes the session
+func NewChokeMessage(session uint64) *Message {
+	return newChokeV1(session)
+}
+
 func newHandshakeV1(id string) *Message {
 	return &Message{
 		CommonMessageInfo: CommonMessageInfo{
@@ -151,3 +178,13 @@ func newChokeV1(session uint64) *Message {
 		Payload: []interface{}{},
 	}
 }
+
+func newProgressV1(session uint64, pct float64) *Message {
+	return &Message{
+		CommonMessageInfo: CommonMessageInfo{
+			Session: session,
+			MsgType: v1Progress,
+		},
+		Payload: []interface{}{pct},
+	}
+}
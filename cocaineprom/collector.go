@@ -0,0 +1,191 @@
+// Package cocaineprom exports metrics of cocaine12.Worker to Prometheus.
+// It lives outside of the cocaine12 tree to keep the framework free of
+// the dependency on the Prometheus client. The client is pinned
+// to PROMETHEUS_VERSION from the Makefile, run `make cocaineprom`
+// to fetch it and to test the package.
+package cocaineprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	cocaine "github.com/cocaine/cocaine-framework-go/cocaine12"
+)
+
+const namespace = "cocaine_worker"
+
+// StatsSource provides counters of a worker. It is implemented by cocaine12.Worker
+type StatsSource interface {
+	Stats() cocaine.WorkerStats
+}
+
+// Collector implements prometheus.Collector. It receives finished sessions
+// as cocaine12.Metrics and reads the rest of the counters from StatsSource
+// on every scrape, so it must be set to the worker by SetMetrics:
+//
+//	collector := cocaineprom.NewCollector(w)
+//	w.SetMetrics(collector)
+//	prometheus.MustRegister(collector)
+type Collector struct {
+	cocaine.NullMetrics
+
+	source StatsSource
+
+	invokes   *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	anomalies *prometheus.CounterVec
+
+	connectAttempts  prometheus.Counter
+	connectSuccesses prometheus.Counter
+	connectFailures  prometheus.Counter
+	reconnects       prometheus.Counter
+	connectDurations prometheus.Histogram
+
+	activeSessions      *prometheus.Desc
+	heartbeatsSent      *prometheus.Desc
+	disowns             *prometheus.Desc
+	panics              *prometheus.Desc
+	sinceHeartbeatReply *prometheus.Desc
+}
+
+var (
+	_ prometheus.Collector      = &Collector{}
+	_ cocaine.Metrics           = &Collector{}
+	_ cocaine.ConnectionMetrics = &Collector{}
+)
+
+// NewCollector creates a collector of the worker's metrics
+func NewCollector(source StatsSource) *Collector {
+	return &Collector{
+		source: source,
+
+		invokes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "invokes_total",
+			Help:      "The number of finished sessions by event and status.",
+		}, []string{"event", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "The time from an invoke to the close of its response.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"event"}),
+		anomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "protocol_anomalies_total",
+			Help:      "The number of unexpected messages from cocaine-runtime.",
+		}, []string{"kind"}),
+
+		connectAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connect_attempts_total",
+			Help:      "The number of attempts to connect to cocaine-runtime.",
+		}),
+		connectSuccesses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connect_successes_total",
+			Help:      "The number of established connections to cocaine-runtime.",
+		}),
+		connectFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connect_failures_total",
+			Help:      "The number of attempts failed to dial or to send the handshake.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "The number of connections established after the previous one has been lost.",
+		}),
+		connectDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "connect_duration_seconds",
+			Help:      "The time it has taken to establish a connection to cocaine-runtime.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+
+		activeSessions: prometheus.NewDesc(namespace+"_active_sessions",
+			"The number of sessions, which have not been closed by a client yet.", nil, nil),
+		heartbeatsSent: prometheus.NewDesc(namespace+"_heartbeats_sent_total",
+			"The number of heartbeats sent to cocaine-runtime.", nil, nil),
+		disowns: prometheus.NewDesc(namespace+"_disowns_total",
+			"The number of times the worker has been disowned.", nil, nil),
+		panics: prometheus.NewDesc(namespace+"_panics_total",
+			"The number of panics recovered from handlers.", nil, nil),
+		sinceHeartbeatReply: prometheus.NewDesc(namespace+"_since_heartbeat_reply_seconds",
+			"The time since the last reply to a heartbeat.", nil, nil),
+	}
+}
+
+// ObserveSession counts the session and observes its duration
+func (c *Collector) ObserveSession(m cocaine.SessionMetrics) {
+	c.invokes.WithLabelValues(m.Event, m.Status).Inc()
+	c.durations.WithLabelValues(m.Event).Observe(m.Duration.Seconds())
+}
+
+// IncProtocolAnomaly counts unexpected messages by kind
+func (c *Collector) IncProtocolAnomaly(kind string) {
+	c.anomalies.WithLabelValues(kind).Inc()
+}
+
+// IncConnectAttempt counts attempts to connect to cocaine-runtime
+func (c *Collector) IncConnectAttempt() {
+	c.connectAttempts.Inc()
+}
+
+// IncConnectSuccess counts established connections
+func (c *Collector) IncConnectSuccess() {
+	c.connectSuccesses.Inc()
+}
+
+// IncConnectFailure counts failed attempts to connect
+func (c *Collector) IncConnectFailure() {
+	c.connectFailures.Inc()
+}
+
+// IncReconnect counts connections established after the previous one has been lost
+func (c *Collector) IncReconnect() {
+	c.reconnects.Inc()
+}
+
+// ObserveConnectDuration observes the time it has taken to connect
+func (c *Collector) ObserveConnectDuration(d time.Duration) {
+	c.connectDurations.Observe(d.Seconds())
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.invokes.Describe(ch)
+	c.durations.Describe(ch)
+	c.anomalies.Describe(ch)
+	c.connectAttempts.Describe(ch)
+	c.connectSuccesses.Describe(ch)
+	c.connectFailures.Describe(ch)
+	c.reconnects.Describe(ch)
+	c.connectDurations.Describe(ch)
+
+	ch <- c.activeSessions
+	ch <- c.heartbeatsSent
+	ch <- c.disowns
+	ch <- c.panics
+	ch <- c.sinceHeartbeatReply
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.invokes.Collect(ch)
+	c.durations.Collect(ch)
+	c.anomalies.Collect(ch)
+	c.connectAttempts.Collect(ch)
+	c.connectSuccesses.Collect(ch)
+	c.connectFailures.Collect(ch)
+	c.reconnects.Collect(ch)
+	c.connectDurations.Collect(ch)
+
+	stats := c.source.Stats()
+	ch <- prometheus.MustNewConstMetric(c.activeSessions, prometheus.GaugeValue, float64(stats.ActiveSessions))
+	ch <- prometheus.MustNewConstMetric(c.heartbeatsSent, prometheus.CounterValue, float64(stats.HeartbeatsSent))
+	ch <- prometheus.MustNewConstMetric(c.disowns, prometheus.CounterValue, float64(stats.Disowns))
+	ch <- prometheus.MustNewConstMetric(c.panics, prometheus.CounterValue, float64(stats.Panics))
+	ch <- prometheus.MustNewConstMetric(c.sinceHeartbeatReply, prometheus.GaugeValue, stats.SinceHeartbeatReply.Seconds())
+}
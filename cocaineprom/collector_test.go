@@ -0,0 +1,112 @@
+package cocaineprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	cocaine "github.com/cocaine/cocaine-framework-go/cocaine12"
+)
+
+type testStats cocaine.WorkerStats
+
+func (s testStats) Stats() cocaine.WorkerStats {
+	return cocaine.WorkerStats(s)
+}
+
+func gatherTestMetrics(t *testing.T, c *Collector) map[string][]*dto.Metric {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+
+	families, err := registry.Gather()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	metrics := make(map[string][]*dto.Metric)
+	for _, family := range families {
+		metrics[family.GetName()] = family.GetMetric()
+	}
+	return metrics
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(testStats{
+		ActiveSessions:      3,
+		HeartbeatsSent:      5,
+		Disowns:             1,
+		Panics:              2,
+		SinceHeartbeatReply: 2 * time.Second,
+	})
+
+	for i := 0; i < 2; i++ {
+		c.ObserveSession(cocaine.SessionMetrics{
+			Event:    "ping",
+			Duration: 100 * time.Millisecond,
+			Status:   cocaine.AccessStatusOK,
+		})
+	}
+	c.ObserveSession(cocaine.SessionMetrics{
+		Event:    "ping",
+		Duration: time.Second,
+		Status:   cocaine.AccessStatusError,
+	})
+	c.IncProtocolAnomaly(cocaine.AnomalyUnknownSessionChoke)
+
+	metrics := gatherTestMetrics(t, c)
+
+	invokes := metrics["cocaine_worker_invokes_total"]
+	if assert.Len(t, invokes, 2) {
+		for _, m := range invokes {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			assert.Equal(t, "ping", labels["event"])
+			if labels["status"] == cocaine.AccessStatusOK {
+				assert.Equal(t, 2.0, m.GetCounter().GetValue())
+			} else {
+				assert.Equal(t, 1.0, m.GetCounter().GetValue())
+			}
+		}
+	}
+
+	durations := metrics["cocaine_worker_handler_duration_seconds"]
+	if assert.Len(t, durations, 1) {
+		assert.Equal(t, uint64(3), durations[0].GetHistogram().GetSampleCount())
+		assert.InDelta(t, 1.2, durations[0].GetHistogram().GetSampleSum(), 1e-9)
+	}
+
+	assert.Equal(t, 1.0, metrics["cocaine_worker_protocol_anomalies_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 3.0, metrics["cocaine_worker_active_sessions"][0].GetGauge().GetValue())
+	assert.Equal(t, 5.0, metrics["cocaine_worker_heartbeats_sent_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 1.0, metrics["cocaine_worker_disowns_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 2.0, metrics["cocaine_worker_panics_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 2.0, metrics["cocaine_worker_since_heartbeat_reply_seconds"][0].GetGauge().GetValue())
+}
+
+func TestCollectorConnections(t *testing.T) {
+	c := NewCollector(testStats{})
+
+	c.IncConnectAttempt()
+	c.IncConnectFailure()
+	c.IncConnectAttempt()
+	c.IncConnectSuccess()
+	c.IncReconnect()
+	c.ObserveConnectDuration(500 * time.Millisecond)
+
+	metrics := gatherTestMetrics(t, c)
+	assert.Equal(t, 2.0, metrics["cocaine_worker_connect_attempts_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 1.0, metrics["cocaine_worker_connect_successes_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 1.0, metrics["cocaine_worker_connect_failures_total"][0].GetCounter().GetValue())
+	assert.Equal(t, 1.0, metrics["cocaine_worker_reconnects_total"][0].GetCounter().GetValue())
+
+	durations := metrics["cocaine_worker_connect_duration_seconds"]
+	if assert.Len(t, durations, 1) {
+		assert.Equal(t, uint64(1), durations[0].GetHistogram().GetSampleCount())
+		assert.InDelta(t, 0.5, durations[0].GetHistogram().GetSampleSum(), 1e-9)
+	}
+}